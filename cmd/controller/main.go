@@ -1,29 +1,48 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/mxcd/go-config/config"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	"github.com/mxcd/configmap-controller/internal/backend"
 	"github.com/mxcd/configmap-controller/internal/configmap"
 	"github.com/mxcd/configmap-controller/internal/controller"
+	"github.com/mxcd/configmap-controller/internal/etcd"
+	"github.com/mxcd/configmap-controller/internal/file"
+	"github.com/mxcd/configmap-controller/internal/gc"
+	"github.com/mxcd/configmap-controller/internal/health"
+	"github.com/mxcd/configmap-controller/internal/postgres"
 	"github.com/mxcd/configmap-controller/internal/redis"
 	"github.com/mxcd/configmap-controller/internal/repository"
+	"github.com/mxcd/configmap-controller/internal/rest"
+	"github.com/mxcd/configmap-controller/internal/sharding"
 	"github.com/mxcd/configmap-controller/internal/util"
 )
 
@@ -68,17 +87,104 @@ func main() {
 
 	ctrl.SetLogger(util.NewZerologLogger())
 
-	redisConnection, err := redis.NewRedisConnection(&redis.RedisConnectionOptions{
-		Host:          config.Get().String("REDIS_HOST"),
-		Port:          config.Get().Int("REDIS_PORT"),
-		Password:      config.Get().String("REDIS_PASSWORD"),
-		DatabaseIndex: config.Get().Int("REDIS_DATABASE_INDEX"),
-		Sentinel:      config.Get().Bool("REDIS_SENTINEL"),
+	err = run(&runOptions{
+		metricsAddr:          metricsAddr,
+		probeAddr:            probeAddr,
+		enableLeaderElection: enableLeaderElection,
+		secureMetrics:        secureMetrics,
+		enableHTTP2:          enableHTTP2,
 	})
 	if err != nil {
-		log.Fatal().Err(err).Msg("unable to create redis connection")
+		log.Fatal().Err(err).Msg("controller terminated")
+	}
+}
+
+type runOptions struct {
+	metricsAddr          string
+	probeAddr            string
+	enableLeaderElection bool
+	secureMetrics        bool
+	enableHTTP2          bool
+}
+
+// run sets up and runs the manager. Errors are returned instead of exiting the process
+// so that deferred cleanup of the connections and tracing always runs.
+func run(options *runOptions) error {
+	shutdownTracing, err := util.InitTracing(context.Background())
+	if err != nil {
+		return fmt.Errorf("unable to initialize tracing: %w", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Error().Err(err).Msg("unable to shut down tracing")
+		}
+	}()
+
+	storageBackendName := config.Get().String("STORAGE_BACKEND")
+
+	// redis stores the ConfigMap data or coordinates the shards
+	var redisConnection *redis.RedisConnection
+	if storageBackendName == "redis" || config.Get().Bool("SHARDING_ENABLED") {
+		redisConnection, err = redis.NewRedisConnection(&redis.RedisConnectionOptions{
+			Host:          config.Get().String("REDIS_HOST"),
+			Port:          config.Get().Int("REDIS_PORT"),
+			Password:      config.Get().String("REDIS_PASSWORD"),
+			DatabaseIndex: config.Get().Int("REDIS_DATABASE_INDEX"),
+			Sentinel:      config.Get().Bool("REDIS_SENTINEL"),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to create redis connection: %w", err)
+		}
+		defer redisConnection.Close()
+	}
+
+	var etcdConnection *etcd.EtcdConnection
+	if storageBackendName == "etcd" {
+		etcdConnection, err = etcd.NewEtcdConnection(&etcd.EtcdConnectionOptions{
+			Endpoints:   strings.Split(config.Get().String("ETCD_ENDPOINTS"), ","),
+			Username:    config.Get().String("ETCD_USERNAME"),
+			Password:    config.Get().String("ETCD_PASSWORD"),
+			DialTimeout: util.GetDuration("ETCD_DIAL_TIMEOUT"),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to create etcd connection: %w", err)
+		}
+		defer etcdConnection.Close()
+	}
+
+	var postgresConnection *postgres.PostgresConnection
+	if storageBackendName == "postgres" {
+		postgresConnection, err = postgres.NewPostgresConnection(&postgres.PostgresConnectionOptions{
+			URL: config.Get().String("POSTGRES_URL"),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to create postgres connection: %w", err)
+		}
+		defer postgresConnection.Close()
+	}
+
+	var shardManager *sharding.ShardManager
+	if config.Get().Bool("SHARDING_ENABLED") {
+		if options.enableLeaderElection {
+			log.Warn().Msg("leader election is disabled in sharding mode")
+			options.enableLeaderElection = false
+		}
+
+		replicaID := config.Get().String("SHARDING_REPLICA_ID")
+		if replicaID == "" {
+			replicaID, err = os.Hostname()
+			if err != nil {
+				return fmt.Errorf("unable to determine sharding replica id: %w", err)
+			}
+		}
+
+		shardManager = sharding.NewShardManager(&sharding.ShardManagerOptions{
+			Redis:             redisConnection,
+			ReplicaID:         replicaID,
+			HeartbeatInterval: util.GetDuration("SHARDING_HEARTBEAT_INTERVAL"),
+			MemberTTL:         util.GetDuration("SHARDING_MEMBER_TTL"),
+		})
 	}
-	defer redisConnection.Close()
 
 	// if the enable-http2 flag is false (the default), http/2 should be disabled
 	// due to its vulnerabilities. More specifically, disabling http/2 will
@@ -92,7 +198,7 @@ func main() {
 	}
 
 	tlsOpts := []func(*tls.Config){}
-	if !enableHTTP2 {
+	if !options.enableHTTP2 {
 		tlsOpts = append(tlsOpts, disableHTTP2)
 	}
 
@@ -100,17 +206,45 @@ func main() {
 		TLSOpts: tlsOpts,
 	})
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	shutdownGracePeriod := util.GetDuration("SHUTDOWN_GRACE_PERIOD")
+	// leave the synchronizer enough time to drain before the manager gives up on it
+	gracefulShutdownTimeout := shutdownGracePeriod + 5*time.Second
+
+	cacheOptions := cache.Options{}
+	var managedSelector labels.Selector
+	if selector := config.Get().String("MANAGED_LABEL_SELECTOR"); selector != "" {
+		// only labelled ConfigMaps are cached, all others are invisible to the controller
+		managedSelector, err = labels.Parse(selector)
+		if err != nil {
+			return fmt.Errorf("invalid label selector for MANAGED_LABEL_SELECTOR: %w", err)
+		}
+		cacheOptions.ByObject = map[client.Object]cache.ByObject{
+			&corev1.ConfigMap{}: {Label: managedSelector},
+		}
+		log.Info().Str("selector", selector).Msg("restricting configmap cache to label selector")
+	}
+
+	restConfig := ctrl.GetConfigOrDie()
+	// kubernetes api calls become spans of the reconcile traces, long running watches are left out
+	restConfig.Wrap(func(transport http.RoundTripper) http.RoundTripper {
+		return otelhttp.NewTransport(transport, otelhttp.WithFilter(func(request *http.Request) bool {
+			return request.URL.Query().Get("watch") != "true"
+		}))
+	})
+
+	mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
 		Scheme: scheme,
+		Cache:  cacheOptions,
 		Metrics: metricsserver.Options{
-			BindAddress:   metricsAddr,
-			SecureServing: secureMetrics,
+			BindAddress:   options.metricsAddr,
+			SecureServing: options.secureMetrics,
 			TLSOpts:       tlsOpts,
 		},
-		WebhookServer:          webhookServer,
-		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "6a273dc7.mxcd.de",
+		WebhookServer:           webhookServer,
+		HealthProbeBindAddress:  options.probeAddr,
+		LeaderElection:          options.enableLeaderElection,
+		LeaderElectionID:        "6a273dc7.mxcd.de",
+		GracefulShutdownTimeout: &gracefulShutdownTimeout,
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -124,36 +258,211 @@ func main() {
 		// LeaderElectionReleaseOnCancel: true,
 	})
 	if err != nil {
-		log.Fatal().Err(err).Msg("unable to start manager")
+		return fmt.Errorf("unable to start manager: %w", err)
 	}
 
+	configMapRepository := repository.NewConfigMapRepository()
 	configMapReconciler := &controller.ConfigMapReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:     mgr.GetClient(),
+		Scheme:     mgr.GetScheme(),
+		Repository: configMapRepository,
+	}
+	if managedSelector != nil {
+		configMapReconciler.APIReader = mgr.GetAPIReader()
 	}
 
 	err = configMapReconciler.SetupWithManager(mgr)
 	if err != nil {
-		log.Fatal().Err(err).Msgf("unable to create configmap controller")
+		return fmt.Errorf("unable to create configmap controller: %w", err)
 	}
 
+	releasePolicy, err := backend.ParseKeyPolicy(config.Get().String("RELEASE_POLICY"))
+	if err != nil {
+		return fmt.Errorf("invalid release policy: %w", err)
+	}
+	deletionPolicy, err := backend.ParseKeyPolicy(config.Get().String("DELETION_POLICY"))
+	if err != nil {
+		return fmt.Errorf("invalid deletion policy: %w", err)
+	}
+
+	keyNaming, err := configmap.NewKeyNaming(&configmap.KeyNamingOptions{
+		Prefix:          config.Get().String("REDIS_KEY_PREFIX"),
+		Template:        config.Get().String("REDIS_KEY_TEMPLATE"),
+		ClusterTemplate: config.Get().String("REDIS_CLUSTER_KEY_TEMPLATE"),
+		Cluster:         config.Get().String("CLUSTER_NAME"),
+		Scope:           config.Get().String("KEY_SCOPE"),
+		MultiCluster:    config.Get().Bool("MULTI_CLUSTER_ENABLED"),
+	})
+	if err != nil {
+		return err
+	}
+	var storageBackend backend.Backend
+	if storageBackendName == "http" {
+		headers := http.Header{}
+		if authHeader := config.Get().String("HTTP_AUTH_HEADER"); authHeader != "" {
+			name, value, _ := strings.Cut(authHeader, ":")
+			headers.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+		storageBackend, err = rest.NewRestBackend(&rest.RestBackendOptions{
+			BaseURL:     config.Get().String("HTTP_BASE_URL"),
+			Headers:     headers,
+			DataPath:    config.Get().String("HTTP_DATA_PATH"),
+			ListPath:    config.Get().String("HTTP_LIST_PATH"),
+			ChangesPath: config.Get().String("HTTP_CHANGES_PATH"),
+			ChangesMode: config.Get().String("HTTP_CHANGES_MODE"),
+			Timeout:     util.GetDuration("HTTP_TIMEOUT"),
+		})
+		if err != nil {
+			return err
+		}
+	} else if storageBackendName == "file" {
+		storageBackend, err = file.NewFileBackend(&file.FileBackendOptions{
+			Directory: config.Get().String("FILE_DIRECTORY"),
+			Format:    config.Get().String("FILE_FORMAT"),
+		})
+		if err != nil {
+			return err
+		}
+	} else if postgresConnection != nil {
+		postgresBackend, err := postgres.NewPostgresBackend(&postgres.PostgresBackendOptions{
+			Postgres: postgresConnection,
+			Table:    config.Get().String("POSTGRES_TABLE"),
+			Listen:   config.Get().Bool("POSTGRES_LISTEN"),
+		})
+		if err != nil {
+			return err
+		}
+		if config.Get().Bool("POSTGRES_CREATE_SCHEMA") {
+			err = postgresBackend.CreateSchema(context.Background())
+			if err != nil {
+				return fmt.Errorf("unable to create postgres schema: %w", err)
+			}
+		}
+		storageBackend = postgresBackend
+	} else if etcdConnection != nil {
+		storageBackend, err = etcd.NewEtcdBackend(&etcd.EtcdBackendOptions{
+			Etcd:          etcdConnection,
+			Prefix:        config.Get().String("ETCD_KEY_PREFIX"),
+			StorageLayout: config.Get().String("ETCD_STORAGE_LAYOUT"),
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		storageLayout, err := redis.ParseStorageLayout(config.Get().String("REDIS_STORAGE_LAYOUT"))
+		if err != nil {
+			return err
+		}
+		storageBackend = redis.NewRedisBackend(&redis.RedisBackendOptions{
+			Redis:         redisConnection,
+			StorageLayout: storageLayout,
+		})
+	}
+
+	// the cluster name only identifies the synchronizations if several clusters share the backend
+	synchronizerCluster := ""
+	if config.Get().Bool("MULTI_CLUSTER_ENABLED") {
+		synchronizerCluster = config.Get().String("CLUSTER_NAME")
+	}
 	configMapSynchronizer := configmap.NewConfigMapSynchronizer(&configmap.ConfigMapSynchronizerOptions{
-		Redis:      redisConnection,
+		Backend:    storageBackend,
 		Reconciler: configMapReconciler,
+		Sharding:   shardManager,
+
+		ShutdownGracePeriod: shutdownGracePeriod,
+		ReleasePolicy:       releasePolicy,
+		DeletionPolicy:      deletionPolicy,
+		KeyNaming:           keyNaming,
+		Recorder:            mgr.GetEventRecorderFor("configmap-controller"),
+		Cluster:             synchronizerCluster,
+	})
+	configMapReconciler.Finalizer = configMapSynchronizer
+	configMapReconciler.Releaser = configMapSynchronizer
+	configMapRepository.AddListener(configMapSynchronizer, &repository.ListenerOptions{
+		QueueSize: config.Get().Int("REPOSITORY_QUEUE_SIZE"),
+		Name:      "configmap-synchronizer",
 	})
-	defer configMapSynchronizer.Stop()
 
-	repository.GetConfigMapRepository().AddListener(configMapSynchronizer)
+	err = mgr.Add(configMapSynchronizer)
+	if err != nil {
+		return fmt.Errorf("unable to add configmap synchronizer to manager: %w", err)
+	}
+
+	if managedSelector != nil {
+		// ConfigMaps that left the selector while the controller was down keep their finalizer otherwise
+		err = mgr.Add(&controller.UnselectedReleaser{
+			Reconciler:     configMapReconciler,
+			Selector:       managedSelector,
+			LeaderElection: configMapSynchronizer.NeedLeaderElection(),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to add configmap releaser to manager: %w", err)
+		}
+	}
+
+	if shardManager != nil {
+		err = mgr.Add(shardManager)
+		if err != nil {
+			return fmt.Errorf("unable to add shard manager to manager: %w", err)
+		}
+	}
+
+	if config.Get().Bool("GC_ENABLED") {
+		gcPolicy, err := backend.ParseKeyPolicy(config.Get().String("GC_POLICY"))
+		if err != nil {
+			return fmt.Errorf("invalid garbage collection policy: %w", err)
+		}
+
+		// a restricted cache does not see unlabelled ConfigMaps, their keys must not be considered orphaned
+		var reader client.Reader = mgr.GetClient()
+		if config.Get().String("MANAGED_LABEL_SELECTOR") != "" {
+			reader = mgr.GetAPIReader()
+		}
+
+		err = mgr.Add(gc.NewOrphanCollector(&gc.OrphanCollectorOptions{
+			Backend:     storageBackend,
+			Reader:      reader,
+			KeyNaming:   keyNaming,
+			Interval:    util.GetDuration("GC_INTERVAL"),
+			GracePeriod: util.GetDuration("GC_GRACE_PERIOD"),
+			Policy:      gcPolicy,
+			DryRun:      config.Get().Bool("GC_DRY_RUN"),
+			Sharding:    shardManager,
+		}))
+		if err != nil {
+			return fmt.Errorf("unable to add orphan collector to manager: %w", err)
+		}
+	}
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
-		log.Fatal().Err(err).Msgf("unable to create healthcheck")
+		return fmt.Errorf("unable to create healthcheck: %w", err)
+	}
+	if err := mgr.AddHealthzCheck("synchronizer", health.NewProgressChecker(configMapSynchronizer, util.GetDuration("HEALTH_SYNC_STALL_THRESHOLD"))); err != nil {
+		return fmt.Errorf("unable to create synchronizer healthcheck: %w", err)
+	}
+	if redisConnection != nil {
+		if err := mgr.AddReadyzCheck("redis", health.NewPingChecker(redisConnection, util.GetDuration("HEALTH_REDIS_TIMEOUT"))); err != nil {
+			return fmt.Errorf("unable to create redis readycheck: %w", err)
+		}
 	}
-	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
-		log.Fatal().Err(err).Msgf("unable to create readycheck")
+	if etcdConnection != nil {
+		if err := mgr.AddReadyzCheck("etcd", health.NewPingChecker(etcdConnection, util.GetDuration("HEALTH_ETCD_TIMEOUT"))); err != nil {
+			return fmt.Errorf("unable to create etcd readycheck: %w", err)
+		}
+	}
+	if postgresConnection != nil {
+		if err := mgr.AddReadyzCheck("postgres", health.NewPingChecker(postgresConnection, util.GetDuration("HEALTH_POSTGRES_TIMEOUT"))); err != nil {
+			return fmt.Errorf("unable to create postgres readycheck: %w", err)
+		}
+	}
+	if err := mgr.AddReadyzCheck("informer-cache", health.NewCacheSyncChecker(mgr.GetCache(), util.GetDuration("HEALTH_CACHE_SYNC_TIMEOUT"))); err != nil {
+		return fmt.Errorf("unable to create informer cache readycheck: %w", err)
 	}
 
 	log.Info().Msg("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
-		log.Fatal().Err(err).Msgf("error running manager")
+		return fmt.Errorf("error running manager: %w", err)
 	}
+
+	return nil
 }
@@ -0,0 +1,206 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Backend stores the data of ConfigMaps under keys. Several ConfigMaps may share a key, every field is owned
+// by the ConfigMap that wrote it first. A ConfigMap only writes, removes and pulls its own fields. Unowned
+// fields, e.g. added by an application, belong to the key's ConfigMap as long as it is the sole owner.
+type Backend interface {
+	// Get returns the fields of the key and their owners, nil if the key was never written
+	Get(ctx context.Context, key string) (*Entry, error)
+	// Put writes the fields owned by or free for owner and removes its stale fields except for
+	// the protected ones. It returns the fields owned by other ConfigMaps.
+	Put(ctx context.Context, key string, owner string, data map[string]string, protected []string) ([]string, error)
+	// Delete gives up the ownership of owner's fields. The policy applies to the whole key if owner is its
+	// sole owner or empty. On shared keys only owner's fields are deleted and never expired.
+	Delete(ctx context.Context, key string, owner string, policy *KeyPolicy) error
+	// Watch notifies about changes of the key until ctx is cancelled, the channel is closed if the watch
+	// breaks. It returns nil if the backend can not watch keys, they are polled instead.
+	Watch(ctx context.Context, key string) (<-chan struct{}, error)
+	// List returns the keys written by the controller that match the glob pattern. Keys of other
+	// applications and the backend's own bookkeeping are left out.
+	List(ctx context.Context, pattern string) ([]string, error)
+}
+
+// LayoutBackend is implemented by backends that can store a key in several layouts
+type LayoutBackend interface {
+	Backend
+	// WithLayout returns the backend storing keys in the named layout
+	WithLayout(name string) (Backend, error)
+}
+
+// ClusterBackend is implemented by backends that track which of several clusters sharing a key
+// synchronized it last
+type ClusterBackend interface {
+	Backend
+	// RecordSync stores the status of the cluster in the metadata of an existing key. A push makes the
+	// cluster the origin of the key's data.
+	RecordSync(ctx context.Context, key string, cluster string, status *ClusterStatus) error
+	// Origin returns the cluster whose push changed the key's data last, empty if unknown
+	Origin(ctx context.Context, key string) (string, error)
+}
+
+const (
+	SyncPush = "push"
+	SyncPull = "pull"
+)
+
+// ClusterStatus is the last synchronization of a key by one cluster
+type ClusterStatus struct {
+	// SyncPush or SyncPull
+	Action string `json:"action"`
+	// hex encoded hash of the fields the ConfigMap owns in the key, equal in clusters that are in sync
+	Hash string    `json:"hash"`
+	Time time.Time `json:"time"`
+}
+
+type Entry struct {
+	Data map[string]string
+	// owning ConfigMap of each field, unowned fields are missing
+	Owners map[string]string
+}
+
+// OwnedFields returns the fields of data that belong to owner
+func OwnedFields(data map[string]string, owners map[string]string, owner string) map[string]string {
+	sole := isSoleOwner(owners, owner)
+	fields := make(map[string]string, len(data))
+	for field, value := range data {
+		fieldOwner, ok := owners[field]
+		if (ok && fieldOwner == owner) || (!ok && sole) {
+			fields[field] = value
+		}
+	}
+	return fields
+}
+
+// ApplyPut applies a Put to the fields and owners of a key in place and returns the conflicts.
+// It implements the ownership rules for backends that keep the whole key in one place.
+func ApplyPut(entry *Entry, owner string, data map[string]string, protected []string) []string {
+	sole := isSoleOwner(entry.Owners, owner)
+	isProtected := make(map[string]bool, len(protected))
+	for _, field := range protected {
+		isProtected[field] = true
+	}
+
+	for field := range entry.Data {
+		fieldOwner, ok := entry.Owners[field]
+		if _, desired := data[field]; !desired && !isProtected[field] && ((ok && fieldOwner == owner) || (!ok && sole)) {
+			delete(entry.Data, field)
+			delete(entry.Owners, field)
+		}
+	}
+
+	conflicts := []string{}
+	for field, value := range data {
+		if fieldOwner, ok := entry.Owners[field]; ok && fieldOwner != owner {
+			conflicts = append(conflicts, field)
+			continue
+		}
+		entry.Data[field] = value
+		entry.Owners[field] = owner
+	}
+	return conflicts
+}
+
+// ReleaseFields removes the ownership of owner from the owners. It returns true if owner was the sole owner.
+func ReleaseFields(owners map[string]string, owner string) bool {
+	if owner == "" || isSoleOwner(owners, owner) {
+		return true
+	}
+	for field, fieldOwner := range owners {
+		if fieldOwner == owner {
+			delete(owners, field)
+		}
+	}
+	return false
+}
+
+func isSoleOwner(owners map[string]string, owner string) bool {
+	for _, fieldOwner := range owners {
+		if fieldOwner != owner {
+			return false
+		}
+	}
+	return true
+}
+
+// DecodeJSONFields decodes a json object. Values that are not strings are returned as json.
+func DecodeJSONFields(document []byte) (map[string]string, error) {
+	values := map[string]json.RawMessage{}
+	err := json.Unmarshal(document, &values)
+	if err != nil {
+		return nil, fmt.Errorf("invalid json document: %w", err)
+	}
+
+	data := make(map[string]string, len(values))
+	for field, value := range values {
+		var text string
+		if json.Unmarshal(value, &text) == nil {
+			data[field] = text
+		} else {
+			data[field] = string(value)
+		}
+	}
+	return data, nil
+}
+
+// MatchPattern reports whether the key matches the redis style glob pattern with *, ?, [...] and \ escapes.
+// Use PatternMatcher to match many keys against the same pattern.
+func MatchPattern(pattern string, key string) bool {
+	return PatternMatcher(pattern)(key)
+}
+
+// PatternMatcher compiles the redis style glob pattern once and returns a function matching keys against it.
+// Invalid patterns match no key.
+func PatternMatcher(pattern string) func(key string) bool {
+	characters := []rune(pattern)
+	expression := &strings.Builder{}
+	expression.WriteString("^")
+	for i := 0; i < len(characters); i++ {
+		switch characters[i] {
+		case '*':
+			expression.WriteString("(?s:.*)")
+		case '?':
+			expression.WriteString("(?s:.)")
+		case '\\':
+			if i+1 < len(characters) {
+				i++
+				expression.WriteString(regexp.QuoteMeta(string(characters[i])))
+			}
+		case '[':
+			end := slices.Index(characters[i+1:], ']')
+			if end < 0 {
+				expression.WriteString(`\[`)
+				continue
+			}
+			class := string(characters[i+1 : i+1+end])
+			negated := strings.HasPrefix(class, "^")
+			if negated {
+				class = class[1:]
+			}
+			expression.WriteString("[")
+			if negated {
+				expression.WriteString("^")
+			}
+			// ranges keep their dash, QuoteMeta does not escape it
+			expression.WriteString(regexp.QuoteMeta(class) + "]")
+			i += end + 1
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(characters[i])))
+		}
+	}
+	expression.WriteString("$")
+	regex, err := regexp.Compile(expression.String())
+	if err != nil {
+		return func(string) bool { return false }
+	}
+	return regex.MatchString
+}
@@ -0,0 +1,52 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type KeyPolicyAction string
+
+const (
+	KeyPolicyKeep   KeyPolicyAction = "keep"
+	KeyPolicyDelete KeyPolicyAction = "delete"
+	KeyPolicyExpire KeyPolicyAction = "expire"
+)
+
+// KeyPolicy describes what happens to a key once its ConfigMap is no longer synchronized
+type KeyPolicy struct {
+	Action KeyPolicyAction
+	// time to live of the key, only used by KeyPolicyExpire
+	TTL time.Duration
+}
+
+// ParseKeyPolicy parses "keep", "delete" or "expire:<duration>". "retain" is accepted as an alias of "keep".
+func ParseKeyPolicy(value string) (*KeyPolicy, error) {
+	switch value {
+	case "keep", "retain":
+		return &KeyPolicy{Action: KeyPolicyKeep}, nil
+	case "delete":
+		return &KeyPolicy{Action: KeyPolicyDelete}, nil
+	}
+
+	ttlString, ok := strings.CutPrefix(value, "expire:")
+	if !ok {
+		return nil, fmt.Errorf("invalid key policy %q, expected keep, delete or expire:<duration>", value)
+	}
+	ttl, err := time.ParseDuration(ttlString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key policy %q: %w", value, err)
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("invalid key policy %q: ttl must be positive", value)
+	}
+	return &KeyPolicy{Action: KeyPolicyExpire, TTL: ttl}, nil
+}
+
+func (p *KeyPolicy) String() string {
+	if p.Action == KeyPolicyExpire {
+		return fmt.Sprintf("%s:%s", p.Action, p.TTL)
+	}
+	return string(p.Action)
+}
@@ -0,0 +1,34 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKeyPolicy(t *testing.T) {
+	policy, err := ParseKeyPolicy("keep")
+	require.NoError(t, err)
+	assert.Equal(t, KeyPolicyKeep, policy.Action)
+
+	policy, err = ParseKeyPolicy("retain")
+	require.NoError(t, err)
+	assert.Equal(t, KeyPolicyKeep, policy.Action)
+
+	policy, err = ParseKeyPolicy("delete")
+	require.NoError(t, err)
+	assert.Equal(t, KeyPolicyDelete, policy.Action)
+
+	policy, err = ParseKeyPolicy("expire:1h30m")
+	require.NoError(t, err)
+	assert.Equal(t, KeyPolicyExpire, policy.Action)
+	assert.Equal(t, 90*time.Minute, policy.TTL)
+	assert.Equal(t, "expire:1h30m0s", policy.String())
+
+	for _, value := range []string{"", "drop", "expire:", "expire:soon", "expire:-1s"} {
+		_, err = ParseKeyPolicy(value)
+		assert.Error(t, err, value)
+	}
+}
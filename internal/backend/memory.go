@@ -0,0 +1,179 @@
+package backend
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps the keys in memory. It is meant for tests and supports watches.
+type MemoryBackend struct {
+	lock     *sync.Mutex
+	entries  map[string]*memoryEntry
+	watchers map[string]map[chan struct{}]bool
+}
+
+type memoryEntry struct {
+	Entry
+	// zero if the key does not expire
+	expiresAt time.Time
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		lock:     &sync.Mutex{},
+		entries:  make(map[string]*memoryEntry),
+		watchers: make(map[string]map[chan struct{}]bool),
+	}
+}
+
+func (b *MemoryBackend) Get(_ context.Context, key string) (*Entry, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entry := b.entry(key)
+	if entry == nil {
+		return nil, nil
+	}
+	return &Entry{Data: maps.Clone(entry.Data), Owners: maps.Clone(entry.Owners)}, nil
+}
+
+func (b *MemoryBackend) Put(_ context.Context, key string, owner string, data map[string]string, protected []string) ([]string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entry := b.entry(key)
+	if entry == nil {
+		entry = &memoryEntry{Entry: Entry{Data: map[string]string{}, Owners: map[string]string{}}}
+		b.entries[key] = entry
+	}
+
+	previous := maps.Clone(entry.Data)
+	conflicts := ApplyPut(&entry.Entry, owner, data, protected)
+	slices.Sort(conflicts)
+	if !maps.Equal(previous, entry.Data) {
+		b.notify(key)
+	}
+	return conflicts, nil
+}
+
+func (b *MemoryBackend) Delete(_ context.Context, key string, owner string, policy *KeyPolicy) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entry := b.entry(key)
+	if entry == nil {
+		return nil
+	}
+
+	owners := maps.Clone(entry.Owners)
+	if ReleaseFields(owners, owner) {
+		switch policy.Action {
+		case KeyPolicyDelete:
+			delete(b.entries, key)
+			b.notify(key)
+		case KeyPolicyExpire:
+			// an expiring key keeps its time to live
+			if entry.expiresAt.IsZero() {
+				entry.expiresAt = time.Now().Add(policy.TTL)
+			}
+			entry.Owners = map[string]string{}
+		default:
+			entry.Owners = map[string]string{}
+		}
+		return nil
+	}
+
+	if policy.Action == KeyPolicyDelete {
+		// putting no fields removes all fields of the owner
+		ApplyPut(&entry.Entry, owner, map[string]string{}, nil)
+		b.notify(key)
+	}
+	entry.Owners = owners
+	return nil
+}
+
+func (b *MemoryBackend) Watch(ctx context.Context, key string) (<-chan struct{}, error) {
+	changes := make(chan struct{}, 1)
+	b.lock.Lock()
+	if b.watchers[key] == nil {
+		b.watchers[key] = make(map[chan struct{}]bool)
+	}
+	b.watchers[key][changes] = true
+	b.lock.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		delete(b.watchers[key], changes)
+		if len(b.watchers[key]) == 0 {
+			delete(b.watchers, key)
+		}
+		close(changes)
+	})
+	return changes, nil
+}
+
+func (b *MemoryBackend) List(_ context.Context, pattern string) ([]string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	matches := PatternMatcher(pattern)
+	keys := []string{}
+	for key := range b.entries {
+		if b.entry(key) != nil && matches(key) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+// Set replaces the data of the key as an application would, keeping the owners of the remaining fields
+func (b *MemoryBackend) Set(key string, data map[string]string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entry := b.entry(key)
+	if entry == nil {
+		entry = &memoryEntry{Entry: Entry{Owners: map[string]string{}}}
+		b.entries[key] = entry
+	}
+	entry.Data = maps.Clone(data)
+	maps.DeleteFunc(entry.Owners, func(field string, _ string) bool {
+		_, ok := data[field]
+		return !ok
+	})
+	b.notify(key)
+}
+
+// TTL returns the remaining time to live of the key, zero if it does not expire
+func (b *MemoryBackend) TTL(key string) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entry := b.entry(key)
+	if entry == nil || entry.expiresAt.IsZero() {
+		return 0
+	}
+	return time.Until(entry.expiresAt)
+}
+
+// entry returns the entry of the key, nil if it does not exist or expired. The caller must hold lock.
+func (b *MemoryBackend) entry(key string) *memoryEntry {
+	entry, ok := b.entries[key]
+	if !ok {
+		return nil
+	}
+	if !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		delete(b.entries, key)
+		return nil
+	}
+	return entry
+}
+
+// notify wakes up the watchers of the key without blocking. The caller must hold lock.
+func (b *MemoryBackend) notify(key string) {
+	for changes := range b.watchers[key] {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+}
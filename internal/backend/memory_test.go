@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBackendOwnership(t *testing.T) {
+	backend := NewMemoryBackend()
+	ctx := context.Background()
+
+	entry, err := backend.Get(ctx, "app")
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+
+	conflicts, err := backend.Put(ctx, "app", "default/first", map[string]string{"a": "1", "shared": "first"}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, conflicts)
+	conflicts, err = backend.Put(ctx, "app", "default/second", map[string]string{"b": "2", "shared": "second"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"shared"}, conflicts)
+
+	// stale fields of the owner are removed, protected ones are kept
+	_, err = backend.Put(ctx, "app", "default/first", map[string]string{"a": "3"}, []string{"shared"})
+	require.NoError(t, err)
+	entry, err = backend.Get(ctx, "app")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "3", "b": "2", "shared": "first"}, entry.Data)
+	assert.Equal(t, map[string]string{"a": "default/first", "b": "default/second", "shared": "default/first"}, entry.Owners)
+	assert.Equal(t, map[string]string{"b": "2"}, OwnedFields(entry.Data, entry.Owners, "default/second"))
+
+	// shared keys only lose the owner's fields
+	require.NoError(t, backend.Delete(ctx, "app", "default/second", &KeyPolicy{Action: KeyPolicyDelete}))
+	entry, err = backend.Get(ctx, "app")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "3", "shared": "first"}, entry.Data)
+
+	require.NoError(t, backend.Delete(ctx, "app", "default/first", &KeyPolicy{Action: KeyPolicyExpire, TTL: time.Hour}))
+	assert.InDelta(t, time.Hour, backend.TTL("app"), float64(time.Second))
+	require.NoError(t, backend.Delete(ctx, "app", "", &KeyPolicy{Action: KeyPolicyDelete}))
+	entry, err = backend.Get(ctx, "app")
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+}
+
+func TestMemoryBackendWatch(t *testing.T) {
+	backend := NewMemoryBackend()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	changes, err := backend.Watch(ctx, "app")
+	require.NoError(t, err)
+	_, err = backend.Put(context.Background(), "app", "default/app", map[string]string{"a": "1"}, nil)
+	require.NoError(t, err)
+	backend.Set("other", map[string]string{"a": "1"})
+
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("no change notification")
+	}
+	select {
+	case <-changes:
+		t.Fatal("unexpected change notification")
+	default:
+	}
+
+	cancel()
+	assert.Eventually(t, func() bool {
+		_, ok := <-changes
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMemoryBackendList(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.Set("default/a", map[string]string{})
+	backend.Set("prod:default:b", map[string]string{})
+
+	keys, err := backend.List(context.Background(), "*/*")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"default/a"}, keys)
+}
+
+func TestMatchPattern(t *testing.T) {
+	assert.True(t, MatchPattern("*/*", "default/app"))
+	assert.True(t, MatchPattern("cfg:prod:*:*", "cfg:prod:default:app"))
+	assert.False(t, MatchPattern("cfg:prod:*:*", "cfg:staging:default:app"))
+	assert.True(t, MatchPattern("app-?", "app-1"))
+	assert.True(t, MatchPattern("app-[0-9]", "app-7"))
+	assert.False(t, MatchPattern("app-[^0-9]", "app-7"))
+	assert.True(t, MatchPattern(`a\*b`, "a*b"))
+	assert.False(t, MatchPattern(`a\*b`, "axb"))
+	assert.True(t, MatchPattern("ä.*", "ä.x"))
+
+	matches := PatternMatcher("cfg:*")
+	assert.True(t, matches("cfg:default/app"))
+	assert.False(t, matches("other"))
+}
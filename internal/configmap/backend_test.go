@@ -0,0 +1,104 @@
+package configmap
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+	"github.com/mxcd/configmap-controller/internal/controller"
+	"github.com/mxcd/configmap-controller/internal/redis"
+)
+
+func TestSynchronizerJSONLayout(t *testing.T) {
+	redisServer, redisBackend := newTestRedis(t)
+	configMap := newTestConfigMap("document", map[string]string{"b": "2", "a": "1"})
+	configMap.Annotations[controller.StorageLayoutAnnotation] = "json"
+	reconciler := newTestReconciler(configMap)
+
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:    redisBackend,
+		Reconciler: reconciler,
+	})
+	startSynchronizer(t, synchronizer)
+	handleUpdate(synchronizer, configMap)
+
+	document, err := redisServer.Get("default/document")
+	require.NoError(t, err)
+	assert.Equal(t, `{"a":"1","b":"2"}`, document)
+
+	require.NoError(t, redisServer.Set("default/document", `{"a":"9","c":3}`))
+	job := synchronizer.getJobs()["default/document"]
+	job.SyncLock.Lock()
+	defer job.SyncLock.Unlock()
+	require.NoError(t, job.pullRedisConfigMap(context.Background()))
+	assert.Equal(t, map[string]string{"a": "9", "c": "3"}, job.ConfigMap.Data)
+}
+
+func TestSynchronizerEmptyConfigMap(t *testing.T) {
+	redisServer, redisBackend := newTestRedis(t)
+	configMap := newTestConfigMap("empty", map[string]string{})
+	reconciler := newTestReconciler(configMap)
+
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:    redisBackend,
+		Reconciler: reconciler,
+	})
+	startSynchronizer(t, synchronizer)
+	handleUpdate(synchronizer, configMap)
+
+	assert.False(t, redisServer.Exists("default/empty"))
+	assert.True(t, redisServer.Exists(redis.MetaKey("default/empty")))
+
+	// fields added in redis are pulled
+	redisServer.HSet("default/empty", "added", "x")
+	job := synchronizer.getJobs()["default/empty"]
+	job.SyncLock.Lock()
+	defer job.SyncLock.Unlock()
+	require.NoError(t, job.pullRedisConfigMap(context.Background()))
+	assert.Equal(t, map[string]string{"added": "x"}, job.ConfigMap.Data)
+}
+
+func TestSynchronizerMemoryBackend(t *testing.T) {
+	memoryBackend := backend.NewMemoryBackend()
+	configMap := newTestConfigMap("memory", map[string]string{"foo": "bar"})
+	reconciler := newTestReconciler(configMap)
+
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:    memoryBackend,
+		Reconciler: reconciler,
+	})
+	startSynchronizer(t, synchronizer)
+	handleUpdate(synchronizer, configMap)
+
+	entry, err := memoryBackend.Get(context.Background(), "default/memory")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"foo": "bar"}, entry.Data)
+
+	// watched keys are pulled on change without waiting for the resync interval
+	memoryBackend.Set("default/memory", map[string]string{"foo": "baz"})
+	assert.Eventually(t, func() bool {
+		stored := &corev1.ConfigMap{}
+		require.NoError(t, reconciler.Get(context.Background(), client.ObjectKeyFromObject(configMap), stored))
+		return stored.Data["foo"] == "baz"
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestSynchronizerStorageLayoutNotSupported(t *testing.T) {
+	configMap := newTestConfigMap("layout", map[string]string{"foo": "bar"})
+	configMap.Annotations[controller.StorageLayoutAnnotation] = "json"
+
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:    backend.NewMemoryBackend(),
+		Reconciler: newTestReconciler(configMap),
+	})
+	handleUpdate(synchronizer, configMap)
+
+	job := synchronizer.getJobs()["default/layout"]
+	assert.Equal(t, selectNone, job.pushFilter)
+}
@@ -0,0 +1,132 @@
+package configmap
+
+import (
+	"context"
+	"errors"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+	"github.com/mxcd/configmap-controller/internal/controller"
+	"github.com/mxcd/configmap-controller/internal/util"
+)
+
+var keepPolicy = &backend.KeyPolicy{Action: backend.KeyPolicyKeep}
+
+// Release implements controller.ConfigMapReleaser. It stops the job of the ConfigMap that lost the managed
+// annotation and applies the release policy to its redis keys. ConfigMaps without job, e.g. released while
+// the controller was down, are released by the keys derived from the ConfigMap.
+func (s *ConfigMapSynchronizer) Release(ctx context.Context, configMap *corev1.ConfigMap) error {
+	namespacedNameString := util.GetConfigMapNamespacedNameString(configMap)
+	if !s.isActive() || !s.isResponsible(namespacedNameString) {
+		return controller.ErrNotResponsible
+	}
+
+	policy := s.options.ReleasePolicy
+	if policy == nil {
+		policy = keepPolicy
+	}
+	err := s.applyKeyPolicy(ctx, namespacedNameString, configMap, s.removeJob(namespacedNameString), policy)
+	if err != nil {
+		if !errors.Is(err, controller.ErrNotResponsible) {
+			log.Error().Err(err).Str("name", namespacedNameString).Str("policy", policy.String()).Msg("unable to apply release policy")
+			s.recordEvent(configMap, corev1.EventTypeWarning, "ReleaseFailed", "unable to apply release policy %s to redis key: %v", policy, err)
+		}
+		return err
+	}
+
+	log.Info().Str("name", namespacedNameString).Str("policy", policy.String()).Msg("configmap released")
+	s.recordEvent(configMap, corev1.EventTypeNormal, "Released", "synchronization stopped, applied release policy %s to redis key", policy)
+	return nil
+}
+
+// Finalize implements controller.ConfigMapFinalizer. It stops the job of the deleted ConfigMap
+// and applies its deletion policy to the redis key.
+func (s *ConfigMapSynchronizer) Finalize(ctx context.Context, configMap *corev1.ConfigMap) error {
+	namespacedNameString := util.GetConfigMapNamespacedNameString(configMap)
+	if !s.isActive() || !s.isResponsible(namespacedNameString) {
+		return controller.ErrNotResponsible
+	}
+
+	policy := s.deletionPolicy(configMap)
+	err := s.applyKeyPolicy(ctx, namespacedNameString, configMap, s.removeJob(namespacedNameString), policy)
+	if err != nil {
+		if !errors.Is(err, controller.ErrNotResponsible) {
+			s.recordEvent(configMap, corev1.EventTypeWarning, "CleanupFailed", "unable to apply deletion policy %s to redis key: %v", policy, err)
+		}
+		return err
+	}
+
+	log.Info().Str("name", namespacedNameString).Str("policy", policy.String()).Msg("configmap finalized")
+	s.recordEvent(configMap, corev1.EventTypeNormal, "CleanedUp", "applied deletion policy %s to redis key", policy)
+	return nil
+}
+
+// deletionPolicy returns the policy of the deletion policy annotation. Invalid annotations fall back to keeping the key.
+func (s *ConfigMapSynchronizer) deletionPolicy(configMap *corev1.ConfigMap) *backend.KeyPolicy {
+	value, ok := configMap.Annotations[controller.DeletionPolicyAnnotation]
+	if !ok {
+		if s.options.DeletionPolicy != nil {
+			return s.options.DeletionPolicy
+		}
+		return keepPolicy
+	}
+
+	policy, err := backend.ParseKeyPolicy(value)
+	if err != nil {
+		log.Warn().Err(err).Str("name", util.GetConfigMapNamespacedNameString(configMap)).Msg("invalid deletion policy, keeping redis key")
+		s.recordEvent(configMap, corev1.EventTypeWarning, "InvalidDeletionPolicy", "%v, keeping redis key", err)
+		return keepPolicy
+	}
+	return policy
+}
+
+// applyKeyPolicy stops the job, if any, and applies the policy to the redis keys of the ConfigMap.
+// It returns controller.ErrNotResponsible if another replica holds the lease of the ConfigMap.
+func (s *ConfigMapSynchronizer) applyKeyPolicy(ctx context.Context, namespacedNameString string, configMap *corev1.ConfigMap, job *ConfigMapSynchronizationJob, policy *backend.KeyPolicy) error {
+	if job != nil {
+		job.Remove()
+		defer s.deactivateJob(namespacedNameString, job)
+
+		// wait for an in-flight poll so that the key is not written again after the policy was applied
+		job.SyncLock.Lock()
+		defer job.SyncLock.Unlock()
+	}
+
+	if s.options.Sharding != nil {
+		acquired, err := s.options.Sharding.AcquireLease(ctx, namespacedNameString)
+		if err != nil {
+			return err
+		}
+		if !acquired {
+			return controller.ErrNotResponsible
+		}
+		defer s.releaseLease(namespacedNameString)
+	}
+
+	return s.releaseKeys(ctx, namespacedNameString, configMap, policy)
+}
+
+// removeJob unregisters the job of the ConfigMap. It returns nil if there is none.
+func (s *ConfigMapSynchronizer) removeJob(namespacedNameString string) *ConfigMapSynchronizationJob {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	job := s.jobs[namespacedNameString]
+	delete(s.jobs, namespacedNameString)
+	return job
+}
+
+// isActive returns true while the synchronizer is started
+func (s *ConfigMapSynchronizer) isActive() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ctx != nil
+}
+
+func (s *ConfigMapSynchronizer) recordEvent(configMap *corev1.ConfigMap, eventType string, reason string, messageFmt string, args ...interface{}) {
+	if s.options.Recorder == nil || configMap == nil {
+		return
+	}
+	s.options.Recorder.Eventf(configMap, eventType, reason, messageFmt, args...)
+}
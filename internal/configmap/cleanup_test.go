@@ -0,0 +1,233 @@
+package configmap
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+	"github.com/mxcd/configmap-controller/internal/controller"
+	"github.com/mxcd/configmap-controller/internal/repository"
+)
+
+func TestSynchronizerAppliesReleasePolicy(t *testing.T) {
+	for _, policyString := range []string{"keep", "delete", "expire:1h"} {
+		t.Run(policyString, func(t *testing.T) {
+			redisServer, redisBackend := newTestRedis(t)
+			configMap := newTestConfigMap("released", map[string]string{"foo": "bar"})
+			policy, err := backend.ParseKeyPolicy(policyString)
+			require.NoError(t, err)
+			recorder := record.NewFakeRecorder(10)
+
+			synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+				Backend:       redisBackend,
+				Reconciler:    newTestReconciler(configMap),
+				ReleasePolicy: policy,
+				Recorder:      recorder,
+			})
+			startSynchronizer(t, synchronizer)
+
+			name := types.NamespacedName{Namespace: "default", Name: "released"}
+			synchronizer.Handle(context.Background(), &repository.RepositoryEvent[corev1.ConfigMap]{
+				Type:    repository.RepositoryEventCreated,
+				Name:    name,
+				Element: configMap.DeepCopy(),
+			})
+			require.True(t, isJobRunning(synchronizer, "default/released"))
+			require.Equal(t, "bar", redisServer.HGet("default/released", "foo"))
+
+			require.NoError(t, synchronizer.Release(context.Background(), configMap.DeepCopy()))
+			synchronizer.Handle(context.Background(), &repository.RepositoryEvent[corev1.ConfigMap]{
+				Type:     repository.RepositoryEventReleased,
+				Name:     name,
+				Previous: configMap.DeepCopy(),
+			})
+			assert.False(t, isJobRunning(synchronizer, "default/released"))
+			assert.Empty(t, synchronizer.getJobs())
+
+			switch policy.Action {
+			case backend.KeyPolicyKeep:
+				assert.True(t, redisServer.Exists("default/released"))
+				assert.Zero(t, redisServer.TTL("default/released"))
+			case backend.KeyPolicyDelete:
+				assert.False(t, redisServer.Exists("default/released"))
+			case backend.KeyPolicyExpire:
+				assert.Equal(t, time.Hour, redisServer.TTL("default/released"))
+			}
+
+			select {
+			case event := <-recorder.Events:
+				assert.Contains(t, event, "Released")
+				assert.Contains(t, event, policyString)
+			default:
+				assert.Fail(t, "no event recorded")
+			}
+
+			// the stopped job must not recreate the key
+			time.Sleep(1500 * time.Millisecond)
+			if policy.Action == backend.KeyPolicyDelete {
+				assert.False(t, redisServer.Exists("default/released"))
+			}
+		})
+	}
+}
+
+func TestSynchronizerReleasesConfigMapWithoutJob(t *testing.T) {
+	redisServer, redisBackend := newTestRedis(t)
+	configMap := newTestConfigMap("restarted", map[string]string{"foo": "bar"})
+	redisServer.HSet("default/restarted", "foo", "bar")
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:       redisBackend,
+		Reconciler:    newTestReconciler(configMap),
+		ReleasePolicy: &backend.KeyPolicy{Action: backend.KeyPolicyDelete},
+	})
+
+	// only a started synchronizer releases
+	assert.ErrorIs(t, synchronizer.Release(context.Background(), configMap), controller.ErrNotResponsible)
+	assert.True(t, redisServer.Exists("default/restarted"))
+
+	// the ConfigMap was released while the controller was down, the key is derived from the ConfigMap
+	startSynchronizer(t, synchronizer)
+	require.NoError(t, synchronizer.Release(context.Background(), configMap))
+	assert.False(t, redisServer.Exists("default/restarted"))
+}
+
+func TestSynchronizerFinalizeAppliesDeletionPolicy(t *testing.T) {
+	redisServer, redisBackend := newTestRedis(t)
+	configMap := newTestConfigMap("finalized", map[string]string{"foo": "bar"})
+	configMap.Annotations[controller.DeletionPolicyAnnotation] = "delete"
+	recorder := record.NewFakeRecorder(10)
+
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:    redisBackend,
+		Reconciler: newTestReconciler(configMap),
+		Recorder:   recorder,
+	})
+
+	// only a started synchronizer finalizes
+	assert.ErrorIs(t, synchronizer.Finalize(context.Background(), configMap), controller.ErrNotResponsible)
+	startSynchronizer(t, synchronizer)
+
+	synchronizer.Handle(context.Background(), &repository.RepositoryEvent[corev1.ConfigMap]{
+		Type:    repository.RepositoryEventCreated,
+		Name:    types.NamespacedName{Namespace: "default", Name: "finalized"},
+		Element: configMap.DeepCopy(),
+	})
+	require.True(t, redisServer.Exists("default/finalized"))
+
+	require.NoError(t, synchronizer.Finalize(context.Background(), configMap))
+	assert.False(t, redisServer.Exists("default/finalized"))
+	assert.False(t, isJobRunning(synchronizer, "default/finalized"))
+	assert.Contains(t, <-recorder.Events, "CleanedUp")
+}
+
+func TestSynchronizerDeletionPolicy(t *testing.T) {
+	defaultPolicy := &backend.KeyPolicy{Action: backend.KeyPolicyExpire, TTL: time.Minute}
+	recorder := record.NewFakeRecorder(10)
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		DeletionPolicy: defaultPolicy,
+		Recorder:       recorder,
+	})
+
+	configMap := newTestConfigMap("policy", nil)
+	assert.Equal(t, defaultPolicy, synchronizer.deletionPolicy(configMap))
+
+	configMap.Annotations[controller.DeletionPolicyAnnotation] = "keep"
+	assert.Equal(t, backend.KeyPolicyKeep, synchronizer.deletionPolicy(configMap).Action)
+	// retain is an alias of keep
+	configMap.Annotations[controller.DeletionPolicyAnnotation] = "retain"
+	assert.Equal(t, backend.KeyPolicyKeep, synchronizer.deletionPolicy(configMap).Action)
+
+	configMap.Annotations[controller.DeletionPolicyAnnotation] = "expire:10m"
+	assert.Equal(t, &backend.KeyPolicy{Action: backend.KeyPolicyExpire, TTL: 10 * time.Minute}, synchronizer.deletionPolicy(configMap))
+
+	// invalid annotations never lose data
+	configMap.Annotations[controller.DeletionPolicyAnnotation] = "destroy"
+	assert.Equal(t, backend.KeyPolicyKeep, synchronizer.deletionPolicy(configMap).Action)
+	assert.Contains(t, <-recorder.Events, "InvalidDeletionPolicy")
+}
+
+// pausingBackend holds the next Get until it is resumed
+type pausingBackend struct {
+	backend.Backend
+	lock    sync.Mutex
+	entered chan struct{}
+	resume  chan struct{}
+}
+
+// pause holds the next Get. The returned channel is closed once the Get waits.
+func (b *pausingBackend) pause() (<-chan struct{}, func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.entered = make(chan struct{})
+	b.resume = make(chan struct{})
+	resume := b.resume
+	return b.entered, func() { close(resume) }
+}
+
+func (b *pausingBackend) Get(ctx context.Context, key string) (*backend.Entry, error) {
+	b.lock.Lock()
+	entered, resume := b.entered, b.resume
+	b.entered, b.resume = nil, nil
+	b.lock.Unlock()
+	if resume != nil {
+		close(entered)
+		<-resume
+	}
+	return b.Backend.Get(ctx, key)
+}
+
+func TestSynchronizerDeletionDuringPull(t *testing.T) {
+	redisServer, redisBackend := newTestRedis(t)
+	storage := &pausingBackend{Backend: redisBackend}
+	configMap := newTestConfigMap("deleted", map[string]string{"foo": "bar"})
+	configMap.Annotations[controller.DeletionPolicyAnnotation] = "delete"
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:    storage,
+		Reconciler: newTestReconciler(configMap),
+	})
+	startSynchronizer(t, synchronizer)
+
+	name := types.NamespacedName{Namespace: "default", Name: "deleted"}
+	synchronizer.Handle(context.Background(), &repository.RepositoryEvent[corev1.ConfigMap]{
+		Type:    repository.RepositoryEventCreated,
+		Name:    name,
+		Element: configMap.DeepCopy(),
+	})
+	require.True(t, redisServer.Exists("default/deleted"))
+
+	entered, resume := storage.pause()
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no pull started")
+	}
+
+	// the deleted event removes the job while the pull waits for redis, Finalize finds no job
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		synchronizer.Handle(context.Background(), &repository.RepositoryEvent[corev1.ConfigMap]{
+			Type:     repository.RepositoryEventDeleted,
+			Name:     name,
+			Previous: configMap.DeepCopy(),
+		})
+	}()
+	require.Eventually(t, func() bool {
+		return len(synchronizer.getJobs()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, synchronizer.Finalize(context.Background(), configMap))
+	resume()
+	<-done
+
+	assert.False(t, redisServer.Exists("default/deleted"))
+	time.Sleep(1500 * time.Millisecond)
+	assert.False(t, redisServer.Exists("default/deleted"))
+}
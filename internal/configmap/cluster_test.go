@@ -0,0 +1,124 @@
+package configmap
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+	"github.com/mxcd/configmap-controller/internal/controller"
+	"github.com/mxcd/configmap-controller/internal/redis"
+	"github.com/mxcd/configmap-controller/internal/repository"
+)
+
+type testCluster struct {
+	synchronizer *ConfigMapSynchronizer
+	reconciler   *controller.ConfigMapReconciler
+}
+
+func newTestCluster(t *testing.T, redisBackend backend.Backend, cluster string, configMaps ...*corev1.ConfigMap) *testCluster {
+	keyNaming, err := NewKeyNaming(&KeyNamingOptions{Cluster: cluster, MultiCluster: true})
+	require.NoError(t, err)
+	reconciler := newTestReconciler(configMaps...)
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:    redisBackend,
+		Reconciler: reconciler,
+		KeyNaming:  keyNaming,
+		Cluster:    cluster,
+	})
+	startSynchronizer(t, synchronizer)
+	return &testCluster{synchronizer: synchronizer, reconciler: reconciler}
+}
+
+// get returns the ConfigMap as stored in the cluster
+func (c *testCluster) get(t *testing.T, name string) *corev1.ConfigMap {
+	configMap := &corev1.ConfigMap{}
+	require.NoError(t, c.reconciler.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: name}, configMap))
+	return configMap
+}
+
+// handle passes the ConfigMap to the synchronizer like an informer event
+func (c *testCluster) handle(configMap *corev1.ConfigMap) {
+	c.synchronizer.Handle(context.Background(), &repository.RepositoryEvent[corev1.ConfigMap]{
+		Type:    repository.RepositoryEventUpdated,
+		Name:    client.ObjectKeyFromObject(configMap),
+		Element: configMap.DeepCopy(),
+	})
+}
+
+func TestSynchronizerMultiCluster(t *testing.T) {
+	redisServer, redisConnection := newTestRedisConnection(t)
+	redisBackend := redis.NewRedisBackend(&redis.RedisBackendOptions{Redis: redisConnection})
+	ctx := context.Background()
+
+	eu := newTestCluster(t, redisBackend, "eu", newTestConfigMap("app", map[string]string{"foo": "bar"}))
+	us := newTestCluster(t, redisBackend, "us", newTestConfigMap("app", map[string]string{"foo": "bar"}))
+
+	eu.handle(eu.get(t, "app"))
+	origin, err := redisBackend.Origin(ctx, "default/app")
+	require.NoError(t, err)
+	assert.Equal(t, "eu", origin)
+	// writing data the hub already has does not change the origin
+	us.handle(us.get(t, "app"))
+	origin, err = redisBackend.Origin(ctx, "default/app")
+	require.NoError(t, err)
+	assert.Equal(t, "eu", origin)
+
+	// an edit in one cluster lands in the other one
+	edited := us.get(t, "app")
+	edited.Data["foo"] = "baz"
+	require.NoError(t, us.reconciler.Update(ctx, edited))
+	us.handle(edited)
+	assert.Eventually(t, func() bool {
+		return eu.get(t, "app").Data["foo"] == "baz"
+	}, 5*time.Second, 10*time.Millisecond)
+	pulled := eu.get(t, "app")
+
+	origin, err = redisBackend.Origin(ctx, "default/app")
+	require.NoError(t, err)
+	assert.Equal(t, "us", origin)
+	statuses, err := redisBackend.ClusterStatuses(ctx, "default/app")
+	require.NoError(t, err)
+	require.Contains(t, statuses, "eu")
+	require.Contains(t, statuses, "us")
+	assert.Equal(t, backend.SyncPull, statuses["eu"].Action)
+	assert.Equal(t, backend.SyncPush, statuses["us"].Action)
+	assert.Equal(t, statuses["us"].Hash, statuses["eu"].Hash)
+
+	// the echo of the pull is no change
+	eu.handle(pulled)
+	origin, err = redisBackend.Origin(ctx, "default/app")
+	require.NoError(t, err)
+	assert.Equal(t, "us", origin)
+
+	// an event of a version pulled before must not revert the hub
+	redisServer.HSet("default/app", "foo", "qux")
+	assert.Eventually(t, func() bool {
+		return eu.get(t, "app").Data["foo"] == "qux"
+	}, 5*time.Second, 10*time.Millisecond)
+	eu.handle(pulled)
+	assert.Equal(t, "qux", redisServer.HGet("default/app", "foo"))
+}
+
+func TestSynchronizerClusterScope(t *testing.T) {
+	redisServer, redisBackend := newTestRedis(t)
+	local := newTestConfigMap("local", map[string]string{"foo": "bar"})
+	local.Annotations[controller.KeyScopeAnnotation] = ClusterScope
+	invalid := newTestConfigMap("invalid", map[string]string{"foo": "bar"})
+	invalid.Annotations[controller.KeyScopeAnnotation] = "global"
+
+	eu := newTestCluster(t, redisBackend, "eu", local, invalid)
+	eu.handle(local)
+	eu.handle(invalid)
+
+	assert.Equal(t, "bar", redisServer.HGet("eu/default/local", "foo"))
+	assert.False(t, redisServer.Exists("default/local"))
+	// ConfigMaps with invalid scope synchronize no fields
+	assert.Empty(t, redisServer.HGet("default/invalid", "foo"))
+}
@@ -0,0 +1,131 @@
+package configmap
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/mxcd/configmap-controller/internal/controller"
+)
+
+const regexPatternPrefix = "regex:"
+
+// FieldFilter selects ConfigMap fields by include and exclude patterns. Patterns are globs,
+// or regular expressions if prefixed with "regex:". Commas within a pattern are escaped as "\,",
+// e.g. "regex:^key{1\,3}$". A nil FieldFilter selects all fields.
+type FieldFilter struct {
+	include []fieldMatcher
+	exclude []fieldMatcher
+}
+
+type fieldMatcher func(field string) bool
+
+// ParseFieldFilter parses comma separated include and exclude patterns. Empty includes select all fields.
+func ParseFieldFilter(include string, exclude string) (*FieldFilter, error) {
+	if include == "" && exclude == "" {
+		return nil, nil
+	}
+
+	includeMatchers, err := parseFieldMatchers(include)
+	if err != nil {
+		return nil, err
+	}
+	excludeMatchers, err := parseFieldMatchers(exclude)
+	if err != nil {
+		return nil, err
+	}
+	return &FieldFilter{include: includeMatchers, exclude: excludeMatchers}, nil
+}
+
+func parseFieldMatchers(patterns string) ([]fieldMatcher, error) {
+	matchers := []fieldMatcher{}
+	for _, pattern := range splitPatterns(patterns) {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		if expression, ok := strings.CutPrefix(pattern, regexPatternPrefix); ok {
+			regex, err := regexp.Compile(expression)
+			if err != nil {
+				return nil, fmt.Errorf("invalid field pattern %q: %w", pattern, err)
+			}
+			matchers = append(matchers, regex.MatchString)
+			continue
+		}
+
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid field pattern %q: %w", pattern, err)
+		}
+		matchers = append(matchers, func(field string) bool {
+			matched, _ := path.Match(pattern, field)
+			return matched
+		})
+	}
+	return matchers, nil
+}
+
+// splitPatterns splits the patterns at commas that are not escaped by a backslash. Other escape sequences
+// are kept, "\," has the same meaning as "," in globs and regular expressions.
+func splitPatterns(patterns string) []string {
+	result := []string{}
+	pattern := &strings.Builder{}
+	for i := 0; i < len(patterns); i++ {
+		switch {
+		case patterns[i] == '\\' && i+1 < len(patterns):
+			if patterns[i+1] != ',' {
+				pattern.WriteByte('\\')
+			}
+			pattern.WriteByte(patterns[i+1])
+			i++
+		case patterns[i] == ',':
+			result = append(result, pattern.String())
+			pattern.Reset()
+		default:
+			pattern.WriteByte(patterns[i])
+		}
+	}
+	return append(result, pattern.String())
+}
+
+// Matches returns true if the field is included and not excluded
+func (f *FieldFilter) Matches(field string) bool {
+	if f == nil {
+		return true
+	}
+	for _, matcher := range f.exclude {
+		if matcher(field) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, matcher := range f.include {
+		if matcher(field) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFieldFilters returns the push (ConfigMap to redis) and pull (redis to ConfigMap) filters of the ConfigMap
+func parseFieldFilters(configMap *corev1.ConfigMap) (*FieldFilter, *FieldFilter, error) {
+	annotations := configMap.Annotations
+	push, err := ParseFieldFilter(annotations[controller.PushIncludeAnnotation], annotations[controller.PushExcludeAnnotation])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid push filter: %w", err)
+	}
+	pull, err := ParseFieldFilter(annotations[controller.PullIncludeAnnotation], annotations[controller.PullExcludeAnnotation])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid pull filter: %w", err)
+	}
+	return push, pull, nil
+}
+
+// selectNone is used in place of filters that can not be parsed so that nothing is synchronized
+var selectNone = &FieldFilter{include: []fieldMatcher{func(string) bool { return false }}}
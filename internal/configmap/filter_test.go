@@ -0,0 +1,95 @@
+package configmap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mxcd/configmap-controller/internal/controller"
+)
+
+func TestFieldFilter(t *testing.T) {
+	filter, err := ParseFieldFilter("", "")
+	require.NoError(t, err)
+	assert.Nil(t, filter)
+	assert.True(t, filter.Matches("anything"))
+
+	filter, err = ParseFieldFilter("app.*, regex:^feature_[0-9]+$", "app.secret*")
+	require.NoError(t, err)
+	assert.True(t, filter.Matches("app.url"))
+	assert.True(t, filter.Matches("feature_42"))
+	assert.False(t, filter.Matches("feature_x"))
+	assert.False(t, filter.Matches("app.secretToken"))
+	assert.False(t, filter.Matches("other"))
+
+	filter, err = ParseFieldFilter("", "*.local")
+	require.NoError(t, err)
+	assert.True(t, filter.Matches("app.url"))
+	assert.False(t, filter.Matches("app.local"))
+
+	// commas within patterns are escaped, an escaped backslash before a comma ends the pattern
+	filter, err = ParseFieldFilter(`regex:^key{1\,3}$, regex:^a\\,b\,c`, "")
+	require.NoError(t, err)
+	assert.True(t, filter.Matches("key"))
+	assert.True(t, filter.Matches("keyyy"))
+	assert.False(t, filter.Matches("keyyyy"))
+	assert.True(t, filter.Matches(`a\b`))
+	assert.True(t, filter.Matches("b,c"))
+	assert.False(t, filter.Matches("b"))
+
+	_, err = ParseFieldFilter("[", "")
+	assert.Error(t, err)
+	_, err = ParseFieldFilter("", "regex:(")
+	assert.Error(t, err)
+}
+
+func TestSynchronizerFieldFilters(t *testing.T) {
+	redisServer, redisBackend := newTestRedis(t)
+	configMap := newTestConfigMap("filtered", map[string]string{
+		"app.url":      "a",
+		"app.name":     "n",
+		"secret.token": "s",
+		"local":        "l",
+	})
+	configMap.Annotations[controller.PushExcludeAnnotation] = "secret.*"
+	configMap.Annotations[controller.PullIncludeAnnotation] = "app.*,remote.*"
+	reconciler := newTestReconciler(configMap)
+
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:    redisBackend,
+		Reconciler: reconciler,
+	})
+	startSynchronizer(t, synchronizer)
+	handleUpdate(synchronizer, configMap)
+
+	// only pushed fields are written
+	assert.Equal(t, "a", redisServer.HGet("default/filtered", "app.url"))
+	assert.Equal(t, "l", redisServer.HGet("default/filtered", "local"))
+	assert.Empty(t, redisServer.HGet("default/filtered", "secret.token"))
+
+	redisServer.HSet("default/filtered", "app.url", "b")
+	redisServer.HSet("default/filtered", "remote.flag", "on")
+	redisServer.HSet("default/filtered", "local", "ignored")
+	redisServer.HDel("default/filtered", "app.name")
+
+	// only pulled fields are applied, the others are preserved
+	job := synchronizer.getJobs()["default/filtered"]
+	job.SyncLock.Lock()
+	defer job.SyncLock.Unlock()
+	require.NoError(t, job.pullRedisConfigMap(context.Background()))
+	assert.Equal(t, map[string]string{
+		"app.url":      "b",
+		"remote.flag":  "on",
+		"secret.token": "s",
+		"local":        "l",
+	}, job.ConfigMap.Data)
+
+	// fields outside the pull filter are not removed from redis
+	redisServer.HSet("default/filtered", "pushed.elsewhere", "x")
+	require.NoError(t, job.WriteRedisConfigMap(context.Background()))
+	assert.Equal(t, "l", redisServer.HGet("default/filtered", "local"))
+	assert.Equal(t, "x", redisServer.HGet("default/filtered", "pushed.elsewhere"))
+	assert.Empty(t, redisServer.HGet("default/filtered", "secret.token"))
+}
@@ -0,0 +1,286 @@
+package configmap
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+	"github.com/mxcd/configmap-controller/internal/controller"
+	"github.com/mxcd/configmap-controller/internal/redis"
+)
+
+const (
+	DefaultKeyTemplate        = "{{.Namespace}}/{{.Name}}"
+	DefaultClusterKeyTemplate = "{{.Cluster}}/{{.Namespace}}/{{.Name}}"
+)
+
+const (
+	// SharedScope keys are the same in every cluster, clusters sharing a redis synchronize through them
+	SharedScope = "shared"
+	// ClusterScope keys contain the cluster name, every cluster writes keys of its own
+	ClusterScope = "cluster"
+)
+
+type KeyNamingOptions struct {
+	// prepended to every templated key
+	Prefix string
+	// text/template with the fields Cluster, Namespace and Name. Defaults to DefaultKeyTemplate.
+	Template string
+	// template of keys in cluster scope. Defaults to DefaultClusterKeyTemplate.
+	ClusterTemplate string
+	Cluster         string
+	// scope of ConfigMaps without key scope annotation. Defaults to SharedScope.
+	Scope string
+	// shared keys are written by several clusters and never collected as orphans
+	MultiCluster bool
+}
+
+// KeyNaming derives the redis keys of a ConfigMap. The redis key annotation overrides the naming entirely
+// and may list several comma separated keys. A nil KeyNaming uses the default template without prefix.
+type KeyNaming struct {
+	prefix          string
+	cluster         string
+	scope           string
+	multiCluster    bool
+	template        *template.Template
+	clusterTemplate *template.Template
+	// match the keys built by the templates, by scope
+	keyExpressions map[string]*regexp.Regexp
+	// match the cluster scoped keys of any cluster and of this cluster
+	anyClusterKey func(key string) bool
+	clusterKey    func(key string) bool
+}
+
+// matches cluster scoped keys of the default templates
+var defaultClusterKey = backend.PatternMatcher("*/*/*")
+
+// parses the keys of a nil KeyNaming, the default options can not fail
+var defaultKeyNaming, _ = NewKeyNaming(&KeyNamingOptions{})
+
+type keyTemplateData struct {
+	Cluster   string
+	Namespace string
+	Name      string
+}
+
+func NewKeyNaming(options *KeyNamingOptions) (*KeyNaming, error) {
+	keyTemplate, err := parseKeyTemplate(options.Template, DefaultKeyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key template: %w", err)
+	}
+	clusterTemplate, err := parseKeyTemplate(options.ClusterTemplate, DefaultClusterKeyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster key template: %w", err)
+	}
+
+	scope := options.Scope
+	if scope == "" {
+		scope = SharedScope
+	}
+	if scope != SharedScope && scope != ClusterScope {
+		return nil, fmt.Errorf("invalid key scope %q", scope)
+	}
+	if options.Cluster == "" && (scope == ClusterScope || options.MultiCluster) {
+		return nil, fmt.Errorf("cluster scoped keys require a cluster name")
+	}
+
+	naming := &KeyNaming{
+		prefix:          options.Prefix,
+		cluster:         options.Cluster,
+		scope:           scope,
+		multiCluster:    options.MultiCluster,
+		template:        keyTemplate,
+		clusterTemplate: clusterTemplate,
+		keyExpressions:  make(map[string]*regexp.Regexp),
+	}
+	naming.anyClusterKey = backend.PatternMatcher(naming.pattern(clusterTemplate, "*"))
+	naming.clusterKey = backend.PatternMatcher(naming.pattern(clusterTemplate, escapePattern(options.Cluster)))
+	naming.keyExpressions[SharedScope] = naming.keyExpression(keyTemplate)
+	if options.Cluster != "" {
+		naming.keyExpressions[ClusterScope] = naming.keyExpression(clusterTemplate)
+	}
+	return naming, nil
+}
+
+func parseKeyTemplate(templateString string, defaultTemplate string) (*template.Template, error) {
+	if templateString == "" {
+		templateString = defaultTemplate
+	}
+
+	keyTemplate, err := template.New("key").Option("missingkey=error").Parse(templateString)
+	if err != nil {
+		return nil, err
+	}
+	// catch references to unknown fields before the first key is built
+	err = keyTemplate.Execute(&strings.Builder{}, &keyTemplateData{})
+	if err != nil {
+		return nil, err
+	}
+	return keyTemplate, nil
+}
+
+// Keys returns the redis keys of the ConfigMap. The first key is the primary key that is pulled
+// from, all further keys are mirrors that only receive writes. Annotated keys must neither be empty
+// nor keys of the controller's bookkeeping, the ConfigMap is not synchronized then.
+func (n *KeyNaming) Keys(configMap *corev1.ConfigMap) ([]string, error) {
+	annotation, ok := configMap.Annotations[controller.RedisKeyAnnotation]
+	if !ok {
+		// an invalid scope is reported by the synchronizer, the key falls back to the default scope
+		scope, _ := n.Scope(configMap)
+		return []string{n.build(scope, configMap.Namespace, configMap.Name)}, nil
+	}
+
+	keys := []string{}
+	for _, key := range strings.Split(annotation, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return nil, fmt.Errorf("empty redis key in %q", annotation)
+		}
+		if strings.HasPrefix(key, redis.ControllerKeyPrefix) {
+			return nil, fmt.Errorf("redis key %q is reserved for the controller's bookkeeping", key)
+		}
+		if !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Scope returns the key scope of the ConfigMap, the key scope annotation overrides the default scope
+func (n *KeyNaming) Scope(configMap *corev1.ConfigMap) (string, error) {
+	defaultScope := SharedScope
+	if n != nil {
+		defaultScope = n.scope
+	}
+
+	scope, ok := configMap.Annotations[controller.KeyScopeAnnotation]
+	switch {
+	case !ok:
+		return defaultScope, nil
+	case scope == SharedScope:
+		return SharedScope, nil
+	case scope != ClusterScope:
+		return defaultScope, fmt.Errorf("invalid key scope %q", scope)
+	case n == nil || n.cluster == "":
+		return defaultScope, fmt.Errorf("cluster scoped keys require a cluster name")
+	}
+	return ClusterScope, nil
+}
+
+// Patterns returns redis SCAN patterns that match the templated keys this cluster is responsible for.
+// Cluster scoped keys are only matched if they are in use. In multi-cluster mode shared keys are left
+// out, they may belong to the ConfigMaps of other clusters.
+func (n *KeyNaming) Patterns() []string {
+	if n == nil {
+		return []string{"*/*"}
+	}
+
+	cluster := escapePattern(n.cluster)
+	patterns := []string{}
+	if !n.multiCluster {
+		patterns = append(patterns, n.pattern(n.template, cluster))
+	}
+	if n.scope == ClusterScope || n.multiCluster {
+		patterns = append(patterns, n.pattern(n.clusterTemplate, cluster))
+	}
+	return patterns
+}
+
+// IsForeign returns true if the key is a cluster scoped key of another cluster. The pattern of shared
+// keys may match them as well, e.g. */* matches us/default/app.
+func (n *KeyNaming) IsForeign(key string) bool {
+	if n == nil {
+		return defaultClusterKey(key)
+	}
+	if !n.anyClusterKey(key) {
+		return false
+	}
+	return n.cluster == "" || !n.clusterKey(key)
+}
+
+// NamespacedName returns the namespaced name of the ConfigMap a templated key of this cluster was built for.
+// Keys of other clusters and keys outside of the templates return false.
+func (n *KeyNaming) NamespacedName(key string) (string, bool) {
+	if n == nil {
+		n = defaultKeyNaming
+	}
+
+	for _, scope := range []string{SharedScope, ClusterScope} {
+		expression, ok := n.keyExpressions[scope]
+		if !ok {
+			continue
+		}
+		namespaceIndex, nameIndex := expression.SubexpIndex("namespace"), expression.SubexpIndex("name")
+		match := expression.FindStringSubmatch(key)
+		if match == nil || namespaceIndex < 0 || nameIndex < 0 {
+			continue
+		}
+		namespace, name := match[namespaceIndex], match[nameIndex]
+		// templates may use the fields several times or not at all, only keys that build back are accepted
+		if n.build(scope, namespace, name) == key {
+			return namespace + "/" + name, true
+		}
+	}
+	return "", false
+}
+
+const (
+	namespaceSentinel = "\x00namespace\x00"
+	nameSentinel      = "\x00name\x00"
+)
+
+// keyExpression returns a regular expression matching the keys of the template in this cluster.
+// The first occurrences of namespace and name are captured.
+func (n *KeyNaming) keyExpression(keyTemplate *template.Template) *regexp.Regexp {
+	builder := &strings.Builder{}
+	keyTemplate.Execute(builder, &keyTemplateData{Cluster: n.cluster, Namespace: namespaceSentinel, Name: nameSentinel})
+
+	namespaceExpression := `(?P<namespace>[a-z0-9](?:[-a-z0-9]*[a-z0-9])?)`
+	nameExpression := `(?P<name>[a-z0-9](?:[-a-z0-9.]*[a-z0-9])?)`
+	expression := regexp.QuoteMeta(n.prefix + builder.String())
+	for _, field := range []struct{ sentinel, expression string }{
+		{namespaceSentinel, namespaceExpression},
+		{nameSentinel, nameExpression},
+	} {
+		sentinel := regexp.QuoteMeta(field.sentinel)
+		expression = strings.Replace(expression, sentinel, field.expression, 1)
+		expression = strings.ReplaceAll(expression, sentinel, `[-a-z0-9.]+`)
+	}
+	return regexp.MustCompile("^" + expression + "$")
+}
+
+// pattern returns the pattern of the template's keys in the cluster, which has to be escaped already
+func (n *KeyNaming) pattern(keyTemplate *template.Template, cluster string) string {
+	prefix := escapePattern(n.prefix)
+
+	builder := &strings.Builder{}
+	keyTemplate.Execute(builder, &keyTemplateData{Cluster: cluster, Namespace: "*", Name: "*"})
+	return prefix + builder.String()
+}
+
+func (n *KeyNaming) build(scope string, namespace string, name string) string {
+	if n == nil {
+		return namespace + "/" + name
+	}
+
+	keyTemplate := n.template
+	if scope == ClusterScope {
+		keyTemplate = n.clusterTemplate
+	}
+
+	builder := &strings.Builder{}
+	builder.WriteString(n.prefix)
+	// the templates were validated in NewKeyNaming, execution can not fail
+	keyTemplate.Execute(builder, &keyTemplateData{Cluster: n.cluster, Namespace: namespace, Name: name})
+	return builder.String()
+}
+
+func escapePattern(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+	return replacer.Replace(value)
+}
@@ -0,0 +1,215 @@
+package configmap
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+	"github.com/mxcd/configmap-controller/internal/controller"
+	"github.com/mxcd/configmap-controller/internal/redis"
+	"github.com/mxcd/configmap-controller/internal/repository"
+)
+
+func mustKeys(t *testing.T, naming *KeyNaming, configMap *corev1.ConfigMap) []string {
+	keys, err := naming.Keys(configMap)
+	require.NoError(t, err)
+	return keys
+}
+
+func TestKeyNaming(t *testing.T) {
+	configMap := newTestConfigMap("app", nil)
+
+	var defaultNaming *KeyNaming
+	assert.Equal(t, "default/app", mustKeys(t, defaultNaming, configMap)[0])
+	assert.Equal(t, []string{"*/*"}, defaultNaming.Patterns())
+
+	naming, err := NewKeyNaming(&KeyNamingOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "default/app", mustKeys(t, naming, configMap)[0])
+	assert.Equal(t, []string{"*/*"}, naming.Patterns())
+
+	naming, err = NewKeyNaming(&KeyNamingOptions{
+		Prefix:   "team-a:",
+		Template: "cfg:{{.Cluster}}:{{.Namespace}}:{{.Name}}",
+		Cluster:  "prod[eu]",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "team-a:cfg:prod[eu]:default:app", mustKeys(t, naming, configMap)[0])
+	assert.Equal(t, []string{`team-a:cfg:prod\[eu\]:*:*`}, naming.Patterns())
+
+	// the annotation binds an existing hash to the ConfigMap
+	configMap.Annotations[controller.RedisKeyAnnotation] = "legacy-app-settings"
+	assert.Equal(t, []string{"legacy-app-settings"}, mustKeys(t, naming, configMap))
+	configMap.Annotations[controller.RedisKeyAnnotation] = "app:eu, app:us,app:eu"
+	assert.Equal(t, []string{"app:eu", "app:us"}, mustKeys(t, naming, configMap))
+
+	// empty keys and the controller's bookkeeping are rejected
+	for _, annotation := range []string{"", " ", "app:eu,,app:us", "configmap-controller:owners:app", "app, configmap-controller:members"} {
+		configMap.Annotations[controller.RedisKeyAnnotation] = annotation
+		keys, err := naming.Keys(configMap)
+		assert.Error(t, err, annotation)
+		assert.Nil(t, keys)
+	}
+
+	_, err = NewKeyNaming(&KeyNamingOptions{Template: "{{.Namespace"})
+	assert.Error(t, err)
+	_, err = NewKeyNaming(&KeyNamingOptions{Template: "{{.Environment}}/{{.Name}}"})
+	assert.Error(t, err)
+}
+
+func TestKeyNamingScope(t *testing.T) {
+	configMap := newTestConfigMap("app", nil)
+
+	naming, err := NewKeyNaming(&KeyNamingOptions{Cluster: "eu"})
+	require.NoError(t, err)
+	assert.Equal(t, "default/app", mustKeys(t, naming, configMap)[0])
+	configMap.Annotations[controller.KeyScopeAnnotation] = ClusterScope
+	assert.Equal(t, "eu/default/app", mustKeys(t, naming, configMap)[0])
+	// annotated cluster scoped keys are not collected in single cluster mode
+	assert.Equal(t, []string{"*/*"}, naming.Patterns())
+
+	naming, err = NewKeyNaming(&KeyNamingOptions{Prefix: "cfg:", Cluster: "eu", Scope: ClusterScope, MultiCluster: true})
+	require.NoError(t, err)
+	delete(configMap.Annotations, controller.KeyScopeAnnotation)
+	assert.Equal(t, "cfg:eu/default/app", mustKeys(t, naming, configMap)[0])
+	configMap.Annotations[controller.KeyScopeAnnotation] = SharedScope
+	assert.Equal(t, "cfg:default/app", mustKeys(t, naming, configMap)[0])
+	// shared keys may belong to other clusters
+	assert.Equal(t, []string{"cfg:eu/*/*"}, naming.Patterns())
+
+	naming, err = NewKeyNaming(&KeyNamingOptions{Cluster: "eu", Scope: ClusterScope})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"*/*", "eu/*/*"}, naming.Patterns())
+
+	assert.False(t, naming.IsForeign("eu/default/app"))
+	assert.True(t, naming.IsForeign("us/default/app"))
+	assert.False(t, naming.IsForeign("default/app"))
+	var defaultNaming *KeyNaming
+	assert.True(t, defaultNaming.IsForeign("us/default/app"))
+	assert.False(t, defaultNaming.IsForeign("default/app"))
+
+	// invalid annotations fall back to the default scope
+	configMap.Annotations[controller.KeyScopeAnnotation] = "global"
+	scope, err := naming.Scope(configMap)
+	assert.Error(t, err)
+	assert.Equal(t, ClusterScope, scope)
+	naming, err = NewKeyNaming(&KeyNamingOptions{})
+	require.NoError(t, err)
+	configMap.Annotations[controller.KeyScopeAnnotation] = ClusterScope
+	_, err = naming.Scope(configMap)
+	assert.Error(t, err)
+	assert.Equal(t, "default/app", mustKeys(t, naming, configMap)[0])
+
+	_, err = NewKeyNaming(&KeyNamingOptions{Scope: ClusterScope})
+	assert.Error(t, err)
+	_, err = NewKeyNaming(&KeyNamingOptions{MultiCluster: true})
+	assert.Error(t, err)
+	_, err = NewKeyNaming(&KeyNamingOptions{Cluster: "eu", Scope: "global"})
+	assert.Error(t, err)
+	_, err = NewKeyNaming(&KeyNamingOptions{ClusterTemplate: "{{.Zone}}"})
+	assert.Error(t, err)
+}
+
+func TestKeyNamingNamespacedName(t *testing.T) {
+	var defaultNaming *KeyNaming
+	namespacedName, ok := defaultNaming.NamespacedName("default/app")
+	assert.True(t, ok)
+	assert.Equal(t, "default/app", namespacedName)
+	_, ok = defaultNaming.NamespacedName("eu/default/app")
+	assert.False(t, ok)
+
+	naming, err := NewKeyNaming(&KeyNamingOptions{
+		Prefix:   "cfg:",
+		Template: "{{.Namespace}}:{{.Name}}:{{.Namespace}}",
+		Cluster:  "eu.west",
+	})
+	require.NoError(t, err)
+	namespacedName, ok = naming.NamespacedName("cfg:kube-system:app.settings:kube-system")
+	assert.True(t, ok)
+	assert.Equal(t, "kube-system/app.settings", namespacedName)
+	namespacedName, ok = naming.NamespacedName("cfg:eu.west/default/app")
+	assert.True(t, ok)
+	assert.Equal(t, "default/app", namespacedName)
+	// the namespace has to be the same in both places
+	_, ok = naming.NamespacedName("cfg:default:app:other")
+	assert.False(t, ok)
+	_, ok = naming.NamespacedName("cfg:us/default/app")
+	assert.False(t, ok)
+	_, ok = naming.NamespacedName("default:app:default")
+	assert.False(t, ok)
+
+	// keys of templates without namespace can not be traced back
+	naming, err = NewKeyNaming(&KeyNamingOptions{Template: "{{.Name}}"})
+	require.NoError(t, err)
+	_, ok = naming.NamespacedName("app")
+	assert.False(t, ok)
+}
+
+func TestSynchronizerWritesTemplatedKey(t *testing.T) {
+	redisServer, redisBackend := newTestRedis(t)
+	templated := newTestConfigMap("templated", map[string]string{"foo": "bar"})
+	bound := newTestConfigMap("bound", map[string]string{"foo": "baz"})
+	bound.Annotations[controller.RedisKeyAnnotation] = "legacy-app-settings"
+	keyNaming, err := NewKeyNaming(&KeyNamingOptions{Prefix: "cfg:", Template: "{{.Namespace}}:{{.Name}}"})
+	require.NoError(t, err)
+
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:    redisBackend,
+		Reconciler: newTestReconciler(templated, bound),
+		KeyNaming:  keyNaming,
+	})
+	startSynchronizer(t, synchronizer)
+
+	for _, configMap := range []*corev1.ConfigMap{templated, bound} {
+		synchronizer.Handle(context.Background(), &repository.RepositoryEvent[corev1.ConfigMap]{
+			Type:    repository.RepositoryEventCreated,
+			Name:    types.NamespacedName{Namespace: configMap.Namespace, Name: configMap.Name},
+			Element: configMap.DeepCopy(),
+		})
+	}
+
+	assert.Equal(t, "bar", redisServer.HGet("cfg:default:templated", "foo"))
+	assert.Equal(t, "baz", redisServer.HGet("legacy-app-settings", "foo"))
+	assert.False(t, redisServer.Exists("default/templated"))
+}
+
+func TestSynchronizerRejectsReservedKey(t *testing.T) {
+	redisServer, redisBackend := newTestRedis(t)
+	configMap := newTestConfigMap("hijacking", map[string]string{"replica-a": "1"})
+	configMap.Annotations[controller.RedisKeyAnnotation] = "configmap-controller:members"
+	redisServer.ZAdd("configmap-controller:members", 1, "replica-a")
+	recorder := record.NewFakeRecorder(10)
+
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:    redisBackend,
+		Reconciler: newTestReconciler(configMap),
+		Recorder:   recorder,
+	})
+	startSynchronizer(t, synchronizer)
+
+	synchronizer.Handle(context.Background(), &repository.RepositoryEvent[corev1.ConfigMap]{
+		Type:    repository.RepositoryEventCreated,
+		Name:    types.NamespacedName{Namespace: configMap.Namespace, Name: configMap.Name},
+		Element: configMap.DeepCopy(),
+	})
+	assert.Contains(t, <-recorder.Events, "InvalidKey")
+	time.Sleep(1500 * time.Millisecond)
+
+	members, err := redisServer.ZMembers("configmap-controller:members")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"replica-a"}, members)
+	assert.False(t, redisServer.Exists("default/hijacking"))
+	assert.False(t, redisServer.Exists(redis.MetaKey("configmap-controller:members")))
+
+	// the release policy does not touch the key either
+	synchronizer.options.ReleasePolicy = &backend.KeyPolicy{Action: backend.KeyPolicyDelete}
+	require.NoError(t, synchronizer.Release(context.Background(), configMap.DeepCopy()))
+	assert.True(t, redisServer.Exists("configmap-controller:members"))
+}
@@ -0,0 +1,15 @@
+package configmap
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var fieldConflicts = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "configmap_controller_field_conflicts_total",
+	Help: "Number of fields not written to redis because another ConfigMap owns them",
+})
+
+func init() {
+	metrics.Registry.MustRegister(fieldConflicts)
+}
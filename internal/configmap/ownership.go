@@ -0,0 +1,55 @@
+package configmap
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+	"github.com/mxcd/configmap-controller/internal/controller"
+)
+
+// configMapBackend returns the backend of the storage layout annotation or the default backend
+func configMapBackend(configMap *corev1.ConfigMap, defaultBackend backend.Backend) (backend.Backend, error) {
+	name, ok := configMap.Annotations[controller.StorageLayoutAnnotation]
+	if !ok {
+		return defaultBackend, nil
+	}
+	layoutBackend, ok := defaultBackend.(backend.LayoutBackend)
+	if !ok {
+		return nil, fmt.Errorf("storage layout %q not supported by the backend", name)
+	}
+	return layoutBackend.WithLayout(name)
+}
+
+// releaseKeys gives up the ownership of the ConfigMap's fields. The policy applies to a whole key if the
+// ConfigMap is its sole owner. On shared keys only the ConfigMap's own fields are deleted and never expired.
+func (s *ConfigMapSynchronizer) releaseKeys(ctx context.Context, namespacedNameString string, configMap *corev1.ConfigMap, policy *backend.KeyPolicy) error {
+	storage, err := configMapBackend(configMap, s.options.Backend)
+	if err != nil {
+		return err
+	}
+	// ConfigMaps with invalid keys were never synchronized
+	keys, err := s.options.KeyNaming.Keys(configMap)
+	if err != nil {
+		return nil
+	}
+	for _, key := range keys {
+		err = storage.Delete(ctx, key, namespacedNameString, policy)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportConflicts logs and records fields that could not be written because other ConfigMaps own them
+func (j *ConfigMapSynchronizationJob) reportConflicts(key string, conflicts []string) {
+	fieldConflicts.Add(float64(len(conflicts)))
+	log.Warn().Str("name", j.Name).Str("key", key).Strs("fields", conflicts).Msg("fields owned by another configmap, skipping")
+	j.recordEvent(corev1.EventTypeWarning, "FieldConflict",
+		"fields %s of redis key %s are owned by another ConfigMap", strings.Join(conflicts, ", "), key)
+}
@@ -0,0 +1,115 @@
+package configmap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+	"github.com/mxcd/configmap-controller/internal/controller"
+	"github.com/mxcd/configmap-controller/internal/redis"
+	"github.com/mxcd/configmap-controller/internal/repository"
+)
+
+func handleUpdate(synchronizer *ConfigMapSynchronizer, configMap *corev1.ConfigMap) {
+	synchronizer.Handle(context.Background(), &repository.RepositoryEvent[corev1.ConfigMap]{
+		Type:    repository.RepositoryEventUpdated,
+		Name:    types.NamespacedName{Namespace: configMap.Namespace, Name: configMap.Name},
+		Element: configMap.DeepCopy(),
+	})
+}
+
+func TestSynchronizerFanOut(t *testing.T) {
+	redisServer, redisBackend := newTestRedis(t)
+	configMap := newTestConfigMap("regional", map[string]string{"foo": "bar"})
+	configMap.Annotations[controller.RedisKeyAnnotation] = "app:eu,app:us"
+	reconciler := newTestReconciler(configMap)
+
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:    redisBackend,
+		Reconciler: reconciler,
+	})
+	startSynchronizer(t, synchronizer)
+	handleUpdate(synchronizer, configMap)
+
+	assert.Equal(t, "bar", redisServer.HGet("app:eu", "foo"))
+	assert.Equal(t, "bar", redisServer.HGet("app:us", "foo"))
+
+	// the primary key is pulled, the mirror is overwritten on the next write
+	redisServer.HSet("app:us", "foo", "ignored")
+	redisServer.HSet("app:eu", "foo", "pulled")
+	job := synchronizer.getJobs()["default/regional"]
+	job.SyncLock.Lock()
+	require.NoError(t, job.pullRedisConfigMap(context.Background()))
+	assert.Equal(t, "pulled", job.ConfigMap.Data["foo"])
+	require.NoError(t, job.WriteRedisConfigMap(context.Background()))
+	job.SyncLock.Unlock()
+	assert.Equal(t, "pulled", redisServer.HGet("app:us", "foo"))
+}
+
+func TestSynchronizerFanIn(t *testing.T) {
+	redisServer, redisBackend := newTestRedis(t)
+	first := newTestConfigMap("first", map[string]string{"a": "1", "shared": "first"})
+	first.Annotations[controller.RedisKeyAnnotation] = "app"
+	second := newTestConfigMap("second", map[string]string{"b": "2", "shared": "second"})
+	second.Annotations[controller.RedisKeyAnnotation] = "app"
+	recorder := record.NewFakeRecorder(10)
+	conflictsBefore := testutil.ToFloat64(fieldConflicts)
+
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:       redisBackend,
+		Reconciler:    newTestReconciler(first, second),
+		Recorder:      recorder,
+		ReleasePolicy: &backend.KeyPolicy{Action: backend.KeyPolicyDelete},
+	})
+	startSynchronizer(t, synchronizer)
+	handleUpdate(synchronizer, first)
+	handleUpdate(synchronizer, second)
+
+	assert.Equal(t, "1", redisServer.HGet("app", "a"))
+	assert.Equal(t, "2", redisServer.HGet("app", "b"))
+	// the field belongs to the ConfigMap that wrote it first
+	assert.Equal(t, "first", redisServer.HGet("app", "shared"))
+	assert.Equal(t, "default/first", redisServer.HGet(redis.OwnersKey("app"), "shared"))
+	assert.Equal(t, conflictsBefore+1, testutil.ToFloat64(fieldConflicts))
+	assert.Contains(t, <-recorder.Events, "FieldConflict")
+
+	// each ConfigMap only pulls its own fields and keeps its conflicting value
+	redisServer.HSet("app", "b", "3")
+	redisServer.HSet("app", "unowned", "x")
+	jobs := synchronizer.getJobs()
+	for _, job := range jobs {
+		job.SyncLock.Lock()
+		require.NoError(t, job.pullRedisConfigMap(context.Background()))
+		job.SyncLock.Unlock()
+	}
+	assert.Equal(t, map[string]string{"a": "1", "shared": "first"}, jobs["default/first"].ConfigMap.Data)
+	assert.Equal(t, map[string]string{"b": "3", "shared": "second"}, jobs["default/second"].ConfigMap.Data)
+
+	// removing a field only deletes the ConfigMap's own field
+	second.Data = map[string]string{"c": "4", "shared": "second"}
+	handleUpdate(synchronizer, second)
+	assert.Equal(t, "", redisServer.HGet("app", "b"))
+	assert.Equal(t, "4", redisServer.HGet("app", "c"))
+	assert.Equal(t, "1", redisServer.HGet("app", "a"))
+	assert.Equal(t, "x", redisServer.HGet("app", "unowned"))
+
+	// releasing deletes the own fields of a shared key only
+	require.NoError(t, synchronizer.Release(context.Background(), first.DeepCopy()))
+	synchronizer.Handle(context.Background(), &repository.RepositoryEvent[corev1.ConfigMap]{
+		Type:     repository.RepositoryEventReleased,
+		Name:     types.NamespacedName{Namespace: "default", Name: "first"},
+		Previous: first.DeepCopy(),
+	})
+	assert.Equal(t, "", redisServer.HGet("app", "a"))
+	assert.Equal(t, "", redisServer.HGet("app", "shared"))
+	assert.Equal(t, "4", redisServer.HGet("app", "c"))
+	assert.Equal(t, "x", redisServer.HGet("app", "unowned"))
+	assert.Equal(t, "", redisServer.HGet(redis.OwnersKey("app"), "shared"))
+}
@@ -2,114 +2,290 @@ package configmap
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
+	"maps"
+	"slices"
+	"time"
 
-	"github.com/mxcd/configmap-controller/internal/util"
 	"github.com/rs/zerolog/log"
 	"github.com/zeebo/blake3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
 )
 
+var tracer = otel.Tracer("github.com/mxcd/configmap-controller/internal/configmap")
+
+func (j *ConfigMapSynchronizationJob) startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, name)
+	span.SetAttributes(
+		attribute.String("k8s.namespace.name", j.ConfigMap.Namespace),
+		attribute.String("k8s.configmap.name", j.ConfigMap.Name),
+		attribute.StringSlice("redis.keys", j.keys),
+	)
+	return ctx, span
+}
+
+func recordSpanError(span trace.Span, err error, description string) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, description)
+}
+
+// pullRedisConfigMap applies changes of the ConfigMap's fields in the primary redis key to the ConfigMap.
+// Only fields selected by the pull filter are applied, all other fields of the ConfigMap are preserved.
+// The caller must hold SyncLock.
 func (j *ConfigMapSynchronizationJob) pullRedisConfigMap(ctx context.Context) error {
-	key := util.GetConfigMapNamespacedNameString(j.ConfigMap)
+	ctx, span := j.startSpan(ctx, "ConfigMapSynchronizationJob.pullRedisConfigMap")
+	defer span.End()
+
+	// an invalid key annotation was reported when the ConfigMap was set
+	if len(j.keys) == 0 {
+		return nil
+	}
+	key := j.keys[0]
 
-	configMapData, err := j.RedisConnection.Client.HGetAll(ctx, key).Result()
+	entry, err := j.storage.Get(ctx, key)
 	if err != nil {
-		log.Err(err).Str("name", key).Msg("unable to get configmap data from redis")
+		log.Err(err).Str("name", j.Name).Str("key", key).Msg("unable to get configmap data from redis")
+		recordSpanError(span, err, "unable to get configmap data from redis")
 		return err
 	}
 
 	// config map not in redis
-	if len(configMapData) == 0 {
-		log.Debug().Str("name", key).Msg("configmap data not found in redis")
+	if entry == nil {
+		// the key of a removed job may just have been deleted by its key policy
+		if j.IsRemoved() {
+			return nil
+		}
+		log.Debug().Str("name", j.Name).Str("key", key).Msg("configmap data not found in redis")
 		return j.WriteRedisConfigMap(ctx)
 	}
 
-	// config map with data in redis => remove empty flag
-	_, hasEmptyFlag := configMapData["_empty"]
-	if len(configMapData) > 1 && hasEmptyFlag {
-		_, err = j.RedisConnection.Client.HDel(ctx, key, "_empty").Result()
-		if err != nil {
-			log.Err(err).Str("name", key).Msg("unable to remove empty flag from redis")
-			return err
-		}
+	pulledData, err := j.transform.Pull(backend.OwnedFields(entry.Data, entry.Owners, j.Name), j.ConfigMap.Data)
+	if err != nil {
+		log.Err(err).Str("name", j.Name).Str("key", key).Msg("unable to transform redis fields")
+		recordSpanError(span, err, "unable to transform redis fields")
+		return err
 	}
+	maps.DeleteFunc(pulledData, func(field string, _ string) bool {
+		return !j.pullFilter.Matches(field)
+	})
 
-	delete(configMapData, "_empty")
-
-	hashString := generateConfigMapDataHash(configMapData)
+	hashString := generateConfigMapDataHash(pulledData)
 	if hashString == j.DataHash {
-		log.Trace().Str("name", key).Msg("configmap data unchanged")
+		log.Trace().Str("name", j.Name).Str("key", key).Msg("configmap data unchanged")
 		return nil
 	}
 
-	log.Info().Str("name", key).Msg("updating configmap data in k8s")
+	configMapData := make(map[string]string, len(j.ConfigMap.Data)+len(pulledData))
+	for field, value := range j.ConfigMap.Data {
+		// removed in redis if synchronized in both directions, conflicts and one-way fields stay untouched
+		_, pulled := pulledData[field]
+		if !pulled && j.pullFilter.Matches(field) && j.pushFilter.Matches(field) && !j.isConflict(field, value, entry.Owners) {
+			continue
+		}
+		configMapData[field] = value
+	}
+	for field, value := range pulledData {
+		configMapData[field] = value
+	}
+	j.DataHash = hashString
+
+	if maps.Equal(configMapData, j.ConfigMap.Data) {
+		log.Trace().Str("name", j.Name).Str("key", key).Msg("configmap data unchanged")
+		return nil
+	}
 
+	logEvent := log.Info().Str("name", j.Name).Str("key", key)
+	if clusterBackend := j.clusterBackend(); clusterBackend != nil {
+		origin, err := clusterBackend.Origin(ctx, key)
+		if err != nil {
+			log.Warn().Err(err).Str("name", j.Name).Str("key", key).Msg("unable to get origin cluster of redis key")
+		}
+		logEvent = logEvent.Str("origin", origin)
+	}
+	logEvent.Msg("updating configmap data in k8s")
+	span.AddEvent("configmap data changed")
 	j.ConfigMap.Data = configMapData
-	j.DataHash = hashString
 
-	err = j.Reconciler.Update(ctx, j.ConfigMap)
+	updateCtx, updateSpan := j.startSpan(ctx, "ConfigMapReconciler.Update")
+	err = j.Reconciler.Update(updateCtx, j.ConfigMap)
+	updateSpan.End()
 	if err != nil {
-		log.Err(err).Str("name", key).Msg("unable to update configmap data in k8s")
+		log.Err(err).Str("name", j.Name).Str("key", key).Msg("unable to update configmap data in k8s")
+		recordSpanError(span, err, "unable to update configmap data in k8s")
 		return err
 	}
+	j.pulledVersions = append(j.pulledVersions, j.ConfigMap.ResourceVersion)
+	if len(j.pulledVersions) > maxPulledVersions {
+		j.pulledVersions = j.pulledVersions[1:]
+	}
+	j.recordSync(ctx, key, backend.SyncPull, backend.OwnedFields(entry.Data, entry.Owners, j.Name))
 
-	log.Debug().Str("name", key).Msg("configmap data updated")
+	log.Debug().Str("name", j.Name).Str("key", key).Msg("configmap data updated")
 	return nil
 }
 
+// WriteRedisConfigMap writes the fields selected by the push filter to all redis keys of the ConfigMap.
+// Fields owned by other ConfigMaps are skipped and reported as conflicts. The caller must hold SyncLock.
 func (j *ConfigMapSynchronizationJob) WriteRedisConfigMap(ctx context.Context) error {
-	key := util.GetConfigMapNamespacedNameString(j.ConfigMap)
-
-	log.Info().Str("name", key).Msg("writing configmap data to redis")
+	ctx, span := j.startSpan(ctx, "ConfigMapSynchronizationJob.WriteRedisConfigMap")
+	defer span.End()
 
-	configMapData := j.ConfigMap.Data
-
-	if configMapData == nil {
-		configMapData = make(map[string]string)
+	keys := j.keys
+	if len(keys) == 0 {
+		j.dirty.Store(false)
+		return nil
 	}
+	log.Info().Str("name", j.Name).Strs("keys", keys).Msg("writing configmap data to redis")
 
-	// place empty key if no data exists so HMSet will be written to redis
-	if len(configMapData) == 0 {
-		log.Debug().Str("name", key).Msg("configmap data is empty")
-		configMapData["_empty"] = ""
+	pushedData := make(map[string]string, len(j.ConfigMap.Data))
+	for field, value := range j.ConfigMap.Data {
+		if j.pushFilter.Matches(field) {
+			pushedData[field] = value
+		}
 	}
-
-	redisConfigMapData, err := j.RedisConnection.Client.HGetAll(ctx, key).Result()
+	redisData, err := j.transform.Push(pushedData)
 	if err != nil {
-		log.Err(err).Str("name", key).Msg("unable to get configmap data from redis")
+		log.Err(err).Str("name", j.Name).Msg("unable to transform configmap data")
+		recordSpanError(span, err, "unable to transform configmap data")
+		j.recordEvent(corev1.EventTypeWarning, "TransformFailed", "unable to transform configmap data: %v", err)
 		return err
 	}
 
-	// remove keys that are not in the configMapData
-	removeFields := []string{}
-	for k := range redisConfigMapData {
-		if _, ok := configMapData[k]; !ok {
-			removeFields = append(removeFields, k)
+	// only a push that changes the data makes this cluster the origin, writing pulled data back is no change
+	changed := false
+	if j.clusterBackend() != nil {
+		entry, err := j.storage.Get(ctx, keys[0])
+		if err != nil {
+			log.Err(err).Str("name", j.Name).Str("key", keys[0]).Msg("unable to get configmap fields from redis")
+			recordSpanError(span, err, "unable to get configmap fields from redis")
+			return err
 		}
+		changed = entry == nil || !maps.Equal(backend.OwnedFields(entry.Data, entry.Owners, j.Name), redisData)
 	}
 
-	if len(removeFields) > 0 {
-		_, err = j.RedisConnection.Client.HDel(ctx, key, removeFields...).Result()
+	var primaryConflicts []string
+	for i, key := range keys {
+		protected, err := j.protectedFields(ctx, key)
 		if err != nil {
-			log.Err(err).Str("name", key).Msg("unable to remove fields from redis")
+			log.Err(err).Str("name", j.Name).Str("key", key).Msg("unable to get configmap fields from redis")
+			recordSpanError(span, err, "unable to get configmap fields from redis")
 			return err
 		}
+
+		conflicts, err := j.storage.Put(ctx, key, j.Name, redisData, protected)
+		if err != nil {
+			log.Err(err).Str("name", j.Name).Str("key", key).Msg("unable to write configmap data to redis")
+			recordSpanError(span, err, "unable to write configmap data to redis")
+			return err
+		}
+		if len(conflicts) > 0 {
+			span.AddEvent("field conflict", trace.WithAttributes(attribute.String("redis.key", key), attribute.StringSlice("fields", conflicts)))
+			j.reportConflicts(key, conflicts)
+		}
+		if i == 0 {
+			primaryConflicts = conflicts
+		}
 	}
 
-	_, err = j.RedisConnection.Client.HMSet(ctx, key, configMapData).Result()
+	// the hash covers the fields the next pull is expected to see
+	writtenData := maps.Clone(redisData)
+	for _, field := range primaryConflicts {
+		delete(writtenData, field)
+	}
+	if changed {
+		j.recordSync(ctx, keys[0], backend.SyncPush, writtenData)
+	}
+	expectedData, err := j.transform.Pull(writtenData, j.ConfigMap.Data)
 	if err != nil {
-		log.Err(err).Str("name", key).Msg("unable to write configmap data to redis")
+		log.Err(err).Str("name", j.Name).Msg("unable to transform written redis fields")
+		recordSpanError(span, err, "unable to transform written redis fields")
 		return err
 	}
+	maps.DeleteFunc(expectedData, func(field string, _ string) bool {
+		return !j.pullFilter.Matches(field)
+	})
+	j.DataHash = generateConfigMapDataHash(expectedData)
+	j.dirty.Store(false)
 
-	j.DataHash = generateConfigMapDataHash(configMapData)
-
-	log.Debug().Str("name", key).Msg("configmap data written")
+	log.Debug().Str("name", j.Name).Strs("keys", keys).Msg("configmap data written")
 	return nil
 }
 
+// clusterBackend returns the job's storage if it records the synchronizations of this cluster
+func (j *ConfigMapSynchronizationJob) clusterBackend() backend.ClusterBackend {
+	if j.Cluster == "" {
+		return nil
+	}
+	clusterBackend, _ := j.storage.(backend.ClusterBackend)
+	return clusterBackend
+}
+
+// recordSync records the synchronized fields of the key as status of this cluster. Failures are only
+// logged, the status is informational.
+func (j *ConfigMapSynchronizationJob) recordSync(ctx context.Context, key string, action string, data map[string]string) {
+	clusterBackend := j.clusterBackend()
+	if clusterBackend == nil {
+		return
+	}
+	status := &backend.ClusterStatus{
+		Action: action,
+		Hash:   hex.EncodeToString([]byte(generateConfigMapDataHash(data))),
+		Time:   time.Now(),
+	}
+	err := clusterBackend.RecordSync(ctx, key, j.Cluster, status)
+	if err != nil {
+		log.Warn().Err(err).Str("name", j.Name).Str("key", key).Str("cluster", j.Cluster).Msg("unable to record cluster status of redis key")
+	}
+}
+
+// protectedFields returns the owned fields of the key whose ConfigMap keys are not synchronized
+// in both directions. They are never removed by a write.
+func (j *ConfigMapSynchronizationJob) protectedFields(ctx context.Context, key string) ([]string, error) {
+	if j.pushFilter == nil && j.pullFilter == nil {
+		return nil, nil
+	}
+
+	entry, err := j.storage.Get(ctx, key)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	data, err := j.transform.Pull(backend.OwnedFields(entry.Data, entry.Owners, j.Name), j.ConfigMap.Data)
+	if err != nil {
+		return nil, err
+	}
+	maps.DeleteFunc(data, func(field string, _ string) bool {
+		return j.pushFilter.Matches(field) && j.pullFilter.Matches(field)
+	})
+	protectedData, err := j.transform.Push(data)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Collect(maps.Keys(protectedData)), nil
+}
+
+// isConflict returns true if a redis field of the ConfigMap key is owned by another ConfigMap.
+// Keys that can not be transformed are treated as conflicts so that they are never removed.
+func (j *ConfigMapSynchronizationJob) isConflict(field string, value string, owners map[string]string) bool {
+	redisData, err := j.transform.Push(map[string]string{field: value})
+	if err != nil {
+		return true
+	}
+	for redisField := range redisData {
+		if owner, ok := owners[redisField]; ok && owner != j.Name {
+			return true
+		}
+	}
+	return false
+}
+
 func generateConfigMapDataHash(configMapData map[string]string) string {
-	delete(configMapData, "_empty")
 	data, err := json.Marshal(configMapData)
 	if err != nil {
 		log.Err(err).Msg("unable to marshal configmap data")
@@ -2,135 +2,601 @@ package configmap
 
 import (
 	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/mxcd/configmap-controller/internal/backend"
 	"github.com/mxcd/configmap-controller/internal/controller"
-	"github.com/mxcd/configmap-controller/internal/redis"
 	"github.com/mxcd/configmap-controller/internal/repository"
+	"github.com/mxcd/configmap-controller/internal/sharding"
+	"github.com/mxcd/configmap-controller/internal/transform"
 	"github.com/mxcd/configmap-controller/internal/util"
 	"github.com/rs/zerolog/log"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
 )
 
+const (
+	// pull interval of keys the backend can not watch
+	pollInterval = 1 * time.Second
+	// pull interval of watched keys, catches up on changes a broken watch missed
+	resyncInterval = 30 * time.Second
+	// number of ConfigMap versions written by pulls that are remembered to detect outdated events
+	maxPulledVersions = 16
+)
+
+// ConfigMapSynchronizer is a leader election aware manager.Runnable. Jobs are registered
+// from repository events at any time but only run while the synchronizer is started.
 type ConfigMapSynchronizer struct {
 	options *ConfigMapSynchronizerOptions
 	jobs    map[string]*ConfigMapSynchronizationJob
 	lock    *sync.Mutex
+	// context of the current leadership term, nil while not started
+	ctx context.Context
+	// context for redis and kubernetes writes. It outlives ctx by the shutdown grace period
+	// so that in-flight writes can complete.
+	workCtx    context.Context
+	cancelWork context.CancelFunc
+	inFlight   *sync.WaitGroup
 }
 
 type ConfigMapSynchronizerOptions struct {
-	Redis      *redis.RedisConnection
+	// stores the ConfigMap data, usually a redis.RedisBackend
+	Backend    backend.Backend
 	Reconciler *controller.ConfigMapReconciler
+	// enables active-active mode. Only ConfigMaps of this replica's shard are synchronized.
+	Sharding *sharding.ShardManager
+	// time to wait for in-flight writes to complete on shutdown
+	ShutdownGracePeriod time.Duration
+	// applied to the redis key when a ConfigMap is released. Defaults to keeping the key.
+	ReleasePolicy *backend.KeyPolicy
+	// applied to the redis key of deleted ConfigMaps without deletion policy annotation. Defaults to keeping the key.
+	DeletionPolicy *backend.KeyPolicy
+	// optional, records kubernetes events on the ConfigMaps
+	Recorder record.EventRecorder
+	// derives the redis keys, nil uses the namespaced name
+	KeyNaming *KeyNaming
+	// identifies this cluster in multi-cluster mode, its synchronizations are recorded in backends
+	// implementing backend.ClusterBackend. Empty in single cluster mode.
+	Cluster string
 }
 
+// ConfigMapSynchronizationJob synchronizes a single ConfigMap. Lock guards the lifecycle
+// (Running, removal) and SyncLock serializes all redis and kubernetes operations of the job
+// and guards ConfigMap and DataHash. The ConfigMap is a private copy owned by the job.
 type ConfigMapSynchronizationJob struct {
-	ConfigMap       *corev1.ConfigMap
-	DataHash        string
-	RedisConnection *redis.RedisConnection
-	Reconciler      *controller.ConfigMapReconciler
-	Running         bool
-	Lock            *sync.Mutex
+	// namespaced name string of the ConfigMap, never changes
+	Name       string
+	ConfigMap  *corev1.ConfigMap
+	DataHash   string
+	Backend    backend.Backend
+	KeyNaming  *KeyNaming
+	Recorder   record.EventRecorder
+	Reconciler *controller.ConfigMapReconciler
+	Sharding   *sharding.ShardManager
+	Running    bool
+	Lock       *sync.Mutex
+	SyncLock   *sync.Mutex
+	cancel     context.CancelFunc
+	// field filters of the ConfigMap, guarded by SyncLock
+	pushFilter *FieldFilter
+	pullFilter *FieldFilter
+	// converts ConfigMap keys and values into redis fields, guarded by SyncLock
+	transform *transform.Pipeline
+	// Backend in the storage layout of the ConfigMap, guarded by SyncLock
+	storage backend.Backend
+	// redis keys of the ConfigMap, nil if the key annotation is invalid. Guarded by SyncLock.
+	keys []string
+	// set once the ConfigMap was deleted. A removed job can not be started again.
+	removed bool
+	// set while the latest ConfigMap state has not been written to redis
+	dirty atomic.Bool
+	// unix nanoseconds of the last completed poll iteration, zero while the job is not running
+	lastProgress atomic.Int64
+	// cluster name in multi-cluster mode, see ConfigMapSynchronizerOptions
+	Cluster string
+	// resource versions of the latest ConfigMap updates by pulls, guarded by SyncLock
+	pulledVersions []string
 }
 
-func (s *ConfigMapSynchronizer) Handle(event *repository.RepositoryEvent[corev1.ConfigMap]) {
+func (s *ConfigMapSynchronizer) Handle(ctx context.Context, event *repository.RepositoryEvent[corev1.ConfigMap]) {
 	switch event.Type {
-	case repository.RepositoryEventUpdated:
-		s.handleConfigMapUpdated(event)
-	case repository.RepositoryEventDeleted:
-		s.handleConfigMapDeleted(event)
+	case repository.RepositoryEventCreated, repository.RepositoryEventUpdated:
+		s.handleConfigMapUpdated(ctx, event)
+	case repository.RepositoryEventDeleted, repository.RepositoryEventReleased:
+		s.handleConfigMapRemoved(event)
 	default:
 		log.Warn().Str("type", string(event.Type)).Msg("unsupported event type")
 	}
 }
 
 func NewConfigMapSynchronizer(options *ConfigMapSynchronizerOptions) *ConfigMapSynchronizer {
-	return &ConfigMapSynchronizer{
-		options: options,
-		jobs:    make(map[string]*ConfigMapSynchronizationJob),
-		lock:    &sync.Mutex{},
+	synchronizer := &ConfigMapSynchronizer{
+		options:  options,
+		jobs:     make(map[string]*ConfigMapSynchronizationJob),
+		lock:     &sync.Mutex{},
+		inFlight: &sync.WaitGroup{},
 	}
+	if options.Sharding != nil {
+		options.Sharding.AddChangeListener(synchronizer.rebalance)
+	}
+	return synchronizer
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable. In sharding mode every replica runs its own shard.
+func (s *ConfigMapSynchronizer) NeedLeaderElection() bool {
+	return s.options.Sharding == nil
+}
+
+// Start implements manager.Runnable. It starts all registered jobs and blocks until
+// the context is cancelled, which happens when leadership is lost or the manager stops.
+// On cancellation polling stops immediately while in-flight writes get the shutdown grace
+// period to complete before the final state is flushed to redis.
+func (s *ConfigMapSynchronizer) Start(ctx context.Context) error {
+	log.Info().Msg("starting configmap synchronizer")
+
+	s.lock.Lock()
+	s.ctx = ctx
+	s.workCtx, s.cancelWork = context.WithCancel(context.WithoutCancel(ctx))
+	s.lock.Unlock()
+
+	s.rebalance()
+
+	<-ctx.Done()
+
+	log.Info().Msg("stopping configmap synchronizer")
+	s.lock.Lock()
+	s.ctx = nil
+	workCtx, cancelWork := s.workCtx, s.cancelWork
+	s.lock.Unlock()
+
+	s.Stop()
+	return s.drain(workCtx, cancelWork)
 }
 
+// Stop stops polling of all jobs without waiting for in-flight writes
 func (s *ConfigMapSynchronizer) Stop() {
+	for _, job := range s.getJobs() {
+		job.Stop()
+	}
+}
+
+// drain waits for in-flight writes, flushes pending ConfigMap state and releases all shard leases.
+// Writes still running after the grace period are cancelled.
+func (s *ConfigMapSynchronizer) drain(workCtx context.Context, cancelWork context.CancelFunc) error {
+	defer cancelWork()
+	deadline := time.Now().Add(s.options.ShutdownGracePeriod)
+	flushCtx, cancelFlush := context.WithDeadline(workCtx, deadline)
+	defer cancelFlush()
+
+	if !waitTimeout(s.inFlight, time.Until(deadline)) {
+		log.Warn().Msg("shutdown grace period exceeded, cancelling in-flight writes")
+		cancelWork()
+		s.inFlight.Wait()
+	}
+
+	jobs := s.getJobs()
+	for name, job := range jobs {
+		if !job.dirty.Load() || flushCtx.Err() != nil || !s.isResponsible(name) {
+			continue
+		}
+		log.Debug().Str("name", name).Msg("flushing configmap data to redis")
+		job.SyncLock.Lock()
+		if job.acquireLease(flushCtx) {
+			job.WriteRedisConfigMap(flushCtx)
+		}
+		job.SyncLock.Unlock()
+	}
+
+	for name, job := range jobs {
+		s.deactivateJob(name, job)
+	}
+
+	log.Info().Msg("configmap synchronizer stopped")
+	return nil
+}
+
+func (s *ConfigMapSynchronizer) getJobs() map[string]*ConfigMapSynchronizationJob {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	for _, job := range s.jobs {
-		job.Stop()
+	jobs := make(map[string]*ConfigMapSynchronizationJob, len(s.jobs))
+	for name, job := range s.jobs {
+		jobs[name] = job
+	}
+	return jobs
+}
+
+// waitTimeout waits for the wait group and returns false if the timeout expired first
+func waitTimeout(waitGroup *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		waitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
 	}
 }
 
-func (s *ConfigMapSynchronizer) handleConfigMapUpdated(event *repository.RepositoryEvent[corev1.ConfigMap]) {
+// CheckProgress returns an error if any job has not completed a poll iteration within the given threshold
+func (s *ConfigMapSynchronizer) CheckProgress(threshold time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stalledJobs := []string{}
+	for name, job := range s.jobs {
+		lastProgress := job.lastProgress.Load()
+		if lastProgress != 0 && time.Since(time.Unix(0, lastProgress)) > threshold {
+			stalledJobs = append(stalledJobs, name)
+		}
+	}
+
+	if len(stalledJobs) > 0 {
+		sort.Strings(stalledJobs)
+		return fmt.Errorf("synchronization stalled for %s", strings.Join(stalledJobs, ", "))
+	}
+	return nil
+}
+
+func (s *ConfigMapSynchronizer) handleConfigMapUpdated(ctx context.Context, event *repository.RepositoryEvent[corev1.ConfigMap]) {
 	namespacedNameString := util.GetNamespacedNameString(event.Name)
 
-	if job, ok := s.jobs[namespacedNameString]; ok {
-		job.Lock.Lock()
-		defer job.Lock.Unlock()
-		job.ConfigMap = event.Element
-		job.WriteRedisConfigMap(context.Background())
-	} else {
-		job := &ConfigMapSynchronizationJob{
-			ConfigMap:       event.Element,
-			DataHash:        "",
-			Reconciler:      s.options.Reconciler,
-			RedisConnection: s.options.Redis,
-			Running:         false,
-			Lock:            &sync.Mutex{},
+	// lookup and creation happen atomically so that concurrent events never create duplicate jobs
+	s.lock.Lock()
+	leaderCtx := s.ctx
+	job, ok := s.jobs[namespacedNameString]
+	if !ok {
+		job = &ConfigMapSynchronizationJob{
+			Name:       namespacedNameString,
+			DataHash:   "",
+			Reconciler: s.options.Reconciler,
+			Backend:    s.options.Backend,
+			KeyNaming:  s.options.KeyNaming,
+			Recorder:   s.options.Recorder,
+			Sharding:   s.options.Sharding,
+			Cluster:    s.options.Cluster,
+			Running:    false,
+			Lock:       &sync.Mutex{},
+			SyncLock:   &sync.Mutex{},
 		}
-		s.lock.Lock()
 		s.jobs[namespacedNameString] = job
-		s.lock.Unlock()
-		job.WriteRedisConfigMap(context.Background())
-		job.Start()
 	}
+	s.lock.Unlock()
+
+	// pushing an outdated version would revert newer data in redis, e.g. pulled from another cluster
+	if ok && job.isOutdated(event.Element) {
+		log.Debug().Str("name", namespacedNameString).Str("resourceVersion", event.Element.ResourceVersion).Msg("ignoring outdated configmap version written by a pull")
+		return
+	}
+	job.SetConfigMap(event.Element)
+
+	if leaderCtx == nil {
+		log.Debug().Str("name", namespacedNameString).Msg("job registered, waiting for leadership")
+		return
+	}
+	if !s.isResponsible(namespacedNameString) {
+		log.Trace().Str("name", namespacedNameString).Msg("job registered, owned by another shard")
+		return
+	}
+	s.activateJob(ctx, leaderCtx, job)
 }
 
-func (s *ConfigMapSynchronizer) handleConfigMapDeleted(event *repository.RepositoryEvent[corev1.ConfigMap]) {
+// handleConfigMapRemoved stops the job of a deleted or released ConfigMap. The key policies were applied
+// by Finalize or Release before the ConfigMap was removed from the repository.
+func (s *ConfigMapSynchronizer) handleConfigMapRemoved(event *repository.RepositoryEvent[corev1.ConfigMap]) {
 	namespacedNameString := util.GetNamespacedNameString(event.Name)
-	if job, ok := s.jobs[namespacedNameString]; ok {
-		job.Stop()
-		s.lock.Lock()
-		delete(s.jobs, namespacedNameString)
-		s.lock.Unlock()
+
+	s.lock.Lock()
+	job, ok := s.jobs[namespacedNameString]
+	delete(s.jobs, namespacedNameString)
+	s.lock.Unlock()
+
+	if ok {
+		job.Remove()
+		s.deactivateJob(namespacedNameString, job)
+		// wait for an in-flight pull, it may write the key if it finds it missing
+		job.SyncLock.Lock()
+		job.SyncLock.Unlock()
 	} else {
-		log.Warn().Str("name", namespacedNameString).Msg("job not found")
+		// the job may have been removed by Finalize or Release already
+		log.Debug().Str("name", namespacedNameString).Msg("job not found")
 	}
 }
 
-func (j *ConfigMapSynchronizationJob) Start() {
+// isResponsible returns true if this replica synchronizes the given ConfigMap
+func (s *ConfigMapSynchronizer) isResponsible(namespacedNameString string) bool {
+	return s.options.Sharding == nil || s.options.Sharding.Owns(namespacedNameString)
+}
+
+// activateJob pushes the current ConfigMap state to redis and starts polling
+func (s *ConfigMapSynchronizer) activateJob(ctx context.Context, leaderCtx context.Context, job *ConfigMapSynchronizationJob) {
+	s.lock.Lock()
+	if s.ctx == nil {
+		s.lock.Unlock()
+		return
+	}
+	workCtx := s.workCtx
+	s.inFlight.Add(1)
+	s.lock.Unlock()
+	defer s.inFlight.Done()
+
+	// the write must survive cancellation of the caller's context during shutdown
+	writeCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	stopCancelOnShutdown := context.AfterFunc(workCtx, cancel)
+	defer stopCancelOnShutdown()
+
+	job.SyncLock.Lock()
+	if !job.IsRemoved() && job.acquireLease(writeCtx) {
+		job.WriteRedisConfigMap(writeCtx)
+	}
+	job.SyncLock.Unlock()
+	job.Start(leaderCtx, workCtx, s.inFlight)
+}
+
+// deactivateJob stops polling and hands the job over to other shards
+func (s *ConfigMapSynchronizer) deactivateJob(namespacedNameString string, job *ConfigMapSynchronizationJob) {
+	job.Stop()
+	s.releaseLease(namespacedNameString)
+}
+
+func (s *ConfigMapSynchronizer) releaseLease(namespacedNameString string) {
+	if s.options.Sharding == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := s.options.Sharding.ReleaseLease(ctx, namespacedNameString)
+	if err != nil {
+		log.Error().Err(err).Str("name", namespacedNameString).Msg("unable to release shard lease")
+	}
+}
+
+// rebalance starts jobs that were assigned to this replica and stops jobs that moved to other replicas
+func (s *ConfigMapSynchronizer) rebalance() {
+	s.lock.Lock()
+	leaderCtx := s.ctx
+	jobs := make(map[string]*ConfigMapSynchronizationJob, len(s.jobs))
+	for name, job := range s.jobs {
+		jobs[name] = job
+	}
+	s.lock.Unlock()
+
+	if leaderCtx == nil {
+		return
+	}
+
+	for name, job := range jobs {
+		job.Lock.Lock()
+		running := job.Running
+		job.Lock.Unlock()
+
+		responsible := s.isResponsible(name)
+		if responsible && !running {
+			log.Debug().Str("name", name).Msg("job assigned to this shard")
+			s.activateJob(leaderCtx, leaderCtx, job)
+		} else if !responsible && running {
+			log.Debug().Str("name", name).Msg("job moved to another shard")
+			s.deactivateJob(name, job)
+		}
+	}
+}
+
+// Start pulls the ConfigMap's data until the job is stopped or ctx is cancelled. Watched keys are pulled on
+// changes, all others are polled. Pull iterations use workCtx and are tracked by the wait group so that
+// an in-flight iteration can complete on shutdown.
+func (j *ConfigMapSynchronizationJob) Start(ctx context.Context, workCtx context.Context, inFlight *sync.WaitGroup) {
 	j.Lock.Lock()
 	defer j.Lock.Unlock()
-	if j.Running {
+	if j.Running || j.removed {
 		return
 	}
 	j.Running = true
-	go j.run()
+	j.lastProgress.Store(time.Now().UnixNano())
+	ctx, j.cancel = context.WithCancel(ctx)
+	inFlight.Add(1)
+	go func() {
+		defer inFlight.Done()
+		j.run(ctx, workCtx)
+	}()
+}
+
+// SetConfigMap replaces the job's ConfigMap with a copy of the given one and marks it for writing to redis
+func (j *ConfigMapSynchronizationJob) SetConfigMap(configMap *corev1.ConfigMap) {
+	j.SyncLock.Lock()
+	defer j.SyncLock.Unlock()
+	j.ConfigMap = configMap.DeepCopy()
+	j.dirty.Store(true)
+
+	var err error
+	j.pushFilter, j.pullFilter, err = parseFieldFilters(j.ConfigMap)
+	if err != nil {
+		log.Warn().Err(err).Str("name", j.Name).Msg("invalid field filter, synchronizing no fields")
+		j.pushFilter, j.pullFilter = selectNone, selectNone
+		j.recordEvent(corev1.EventTypeWarning, "InvalidFieldFilter", "%v, synchronizing no fields", err)
+	}
+
+	j.transform, err = transform.Parse(j.ConfigMap.Annotations[controller.TransformAnnotation])
+	if err != nil {
+		log.Warn().Err(err).Str("name", j.Name).Msg("invalid transform, synchronizing no fields")
+		j.pushFilter, j.pullFilter = selectNone, selectNone
+		j.recordEvent(corev1.EventTypeWarning, "InvalidTransform", "%v, synchronizing no fields", err)
+	}
+
+	j.storage, err = configMapBackend(j.ConfigMap, j.Backend)
+	if err != nil {
+		log.Warn().Err(err).Str("name", j.Name).Msg("invalid storage layout, synchronizing no fields")
+		j.storage = j.Backend
+		j.pushFilter, j.pullFilter = selectNone, selectNone
+		j.recordEvent(corev1.EventTypeWarning, "InvalidStorageLayout", "%v, synchronizing no fields", err)
+	}
+
+	j.keys, err = j.KeyNaming.Keys(j.ConfigMap)
+	if err != nil {
+		log.Warn().Err(err).Str("name", j.Name).Msg("invalid redis key, synchronizing nothing")
+		j.recordEvent(corev1.EventTypeWarning, "InvalidKey", "%v, synchronizing nothing", err)
+	}
+
+	_, err = j.KeyNaming.Scope(j.ConfigMap)
+	if err != nil {
+		log.Warn().Err(err).Str("name", j.Name).Msg("invalid key scope, synchronizing no fields")
+		j.pushFilter, j.pullFilter = selectNone, selectNone
+		j.recordEvent(corev1.EventTypeWarning, "InvalidKeyScope", "%v, synchronizing no fields", err)
+	}
+}
+
+// isOutdated returns true if the ConfigMap is an older version written by a pull of the job.
+// Informer events of such versions may arrive after the job pulled again.
+func (j *ConfigMapSynchronizationJob) isOutdated(configMap *corev1.ConfigMap) bool {
+	j.SyncLock.Lock()
+	defer j.SyncLock.Unlock()
+	version := configMap.ResourceVersion
+	return version != "" && j.ConfigMap != nil && version != j.ConfigMap.ResourceVersion && slices.Contains(j.pulledVersions, version)
+}
+
+// recordEvent records a kubernetes event on the job's ConfigMap if a recorder is configured
+func (j *ConfigMapSynchronizationJob) recordEvent(eventType string, reason string, messageFmt string, args ...interface{}) {
+	if j.Recorder != nil {
+		j.Recorder.Eventf(j.ConfigMap, eventType, reason, messageFmt, args...)
+	}
+}
+
+// Remove stops the job for good
+func (j *ConfigMapSynchronizationJob) Remove() {
+	j.Lock.Lock()
+	j.removed = true
+	j.Lock.Unlock()
+	j.Stop()
+}
+
+func (j *ConfigMapSynchronizationJob) IsRemoved() bool {
+	j.Lock.Lock()
+	defer j.Lock.Unlock()
+	return j.removed
 }
 
 func (j *ConfigMapSynchronizationJob) Stop() {
 	j.Lock.Lock()
 	defer j.Lock.Unlock()
 	j.Running = false
+	j.lastProgress.Store(0)
+	if j.cancel != nil {
+		j.cancel()
+		j.cancel = nil
+	}
 }
 
-func (j *ConfigMapSynchronizationJob) run() {
-	namespacedNameString := util.GetConfigMapNamespacedNameString(j.ConfigMap)
+func (j *ConfigMapSynchronizationJob) run(ctx context.Context, workCtx context.Context) {
+	watch := &keyWatch{}
+	defer watch.stop()
 
 	for {
-		j.Lock.Lock()
-		running := j.Running
-		j.Lock.Unlock()
-		if !running {
+		if ctx.Err() != nil {
+			return
+		}
+
+		j.SyncLock.Lock()
+		// the job may have been stopped while waiting for the lock
+		if ctx.Err() != nil {
+			j.SyncLock.Unlock()
+			return
+		}
+		// watching before pulling does not miss changes in between
+		var changes <-chan struct{}
+		if len(j.keys) > 0 {
+			changes = watch.update(ctx, j.storage, j.keys[0])
+		}
+		if j.acquireLease(workCtx) {
+			err := j.pullRedisConfigMap(workCtx)
+			if err != nil && workCtx.Err() == nil {
+				log.Error().Err(err).Str("name", j.Name).Msg("unable to pull configmap from redis")
+			}
+		}
+		j.SyncLock.Unlock()
+		j.lastProgress.Store(time.Now().UnixNano())
+
+		interval := pollInterval
+		if changes != nil {
+			interval = resyncInterval
+		}
+		select {
+		case <-ctx.Done():
 			return
+		case _, ok := <-changes:
+			if ok {
+				continue
+			}
+			// the watch broke, it is restarted after a poll interval
+			watch.stop()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(pollInterval):
+			}
+		case <-time.After(interval):
 		}
+	}
+}
+
+// keyWatch keeps a backend watch on the primary key of a job
+type keyWatch struct {
+	storage backend.Backend
+	key     string
+	changes <-chan struct{}
+	cancel  context.CancelFunc
+}
 
-		ctx := context.Background()
+// update watches the key unless it is watched already. It returns nil if the backend can not watch the key.
+func (w *keyWatch) update(ctx context.Context, storage backend.Backend, key string) <-chan struct{} {
+	if w.cancel != nil && w.storage == storage && w.key == key {
+		return w.changes
+	}
+	w.stop()
 
-		err := j.pullRedisConfigMap(ctx)
+	watchCtx, cancel := context.WithCancel(ctx)
+	changes, err := storage.Watch(watchCtx, key)
+	if err != nil || changes == nil {
+		cancel()
 		if err != nil {
-			log.Error().Err(err).Str("name", namespacedNameString).Msg("unable to pull configmap from redis")
+			log.Warn().Err(err).Str("key", key).Msg("unable to watch key, polling instead")
 		}
+		return nil
+	}
+	w.storage, w.key, w.changes, w.cancel = storage, key, changes, cancel
+	return changes
+}
+
+func (w *keyWatch) stop() {
+	if w.cancel != nil {
+		w.cancel()
+	}
+	w.storage, w.key, w.changes, w.cancel = nil, "", nil, nil
+}
+
+// acquireLease makes sure no other shard synchronizes the ConfigMap at the same time.
+// Without sharding the job always holds the lease.
+func (j *ConfigMapSynchronizationJob) acquireLease(ctx context.Context) bool {
+	if j.Sharding == nil {
+		return true
+	}
 
-		time.Sleep(1 * time.Second)
+	acquired, err := j.Sharding.AcquireLease(ctx, j.Name)
+	if err != nil {
+		log.Error().Err(err).Str("name", j.Name).Msg("unable to acquire shard lease")
+		return false
+	}
+	if !acquired {
+		log.Debug().Str("name", j.Name).Msg("shard lease held by another replica")
 	}
+	return acquired
 }
@@ -0,0 +1,445 @@
+package configmap
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+	"github.com/mxcd/configmap-controller/internal/controller"
+	"github.com/mxcd/configmap-controller/internal/redis"
+	"github.com/mxcd/configmap-controller/internal/repository"
+	"github.com/mxcd/configmap-controller/internal/sharding"
+)
+
+func newTestRedisConnection(t *testing.T) (*miniredis.Miniredis, *redis.RedisConnection) {
+	redisServer := miniredis.RunT(t)
+	redisPort, err := strconv.Atoi(redisServer.Port())
+	require.NoError(t, err)
+	redisConnection, err := redis.NewRedisConnection(&redis.RedisConnectionOptions{
+		Host: redisServer.Host(),
+		Port: redisPort,
+	})
+	require.NoError(t, err)
+	t.Cleanup(redisConnection.Close)
+	return redisServer, redisConnection
+}
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, backend.Backend) {
+	redisServer, redisConnection := newTestRedisConnection(t)
+	return redisServer, redis.NewRedisBackend(&redis.RedisBackendOptions{Redis: redisConnection})
+}
+
+func newTestConfigMap(name string, data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        name,
+			Annotations: map[string]string{controller.ManagedAnnotation: "true"},
+		},
+		Data: data,
+	}
+}
+
+func newTestReconciler(configMaps ...*corev1.ConfigMap) *controller.ConfigMapReconciler {
+	builder := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme)
+	for _, configMap := range configMaps {
+		builder = builder.WithObjects(configMap)
+	}
+	return &controller.ConfigMapReconciler{
+		Client:     builder.Build(),
+		Scheme:     clientgoscheme.Scheme,
+		Repository: repository.NewConfigMapRepository(),
+	}
+}
+
+// startSynchronizer runs the synchronizer as if leadership was acquired and returns a function
+// that simulates the loss of leadership and waits for the synchronizer to stop
+func startSynchronizer(t *testing.T, synchronizer *ConfigMapSynchronizer) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(t, synchronizer.Start(ctx))
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		synchronizer.lock.Lock()
+		defer synchronizer.lock.Unlock()
+		return synchronizer.ctx != nil
+	}, time.Second, 10*time.Millisecond)
+
+	stopped := false
+	stop := func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+func isJobRunning(synchronizer *ConfigMapSynchronizer, name string) bool {
+	synchronizer.lock.Lock()
+	job, ok := synchronizer.jobs[name]
+	synchronizer.lock.Unlock()
+	if !ok {
+		return false
+	}
+	job.Lock.Lock()
+	defer job.Lock.Unlock()
+	return job.Running
+}
+
+func TestSynchronizerLeaderHandover(t *testing.T) {
+	redisServer, redisBackend := newTestRedis(t)
+	configMap := newTestConfigMap("handover", map[string]string{"foo": "bar"})
+	reconciler := newTestReconciler(configMap)
+	name := types.NamespacedName{Namespace: "default", Name: "handover"}
+
+	newReplica := func() *ConfigMapSynchronizer {
+		synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+			Backend:    redisBackend,
+			Reconciler: reconciler,
+		})
+		assert.True(t, synchronizer.NeedLeaderElection())
+		synchronizer.Handle(context.Background(), &repository.RepositoryEvent[corev1.ConfigMap]{
+			Type:    repository.RepositoryEventUpdated,
+			Name:    name,
+			Element: configMap.DeepCopy(),
+		})
+		return synchronizer
+	}
+	replicaA := newReplica()
+	replicaB := newReplica()
+
+	// no replica is leading yet
+	assert.False(t, redisServer.Exists("default/handover"))
+	assert.False(t, isJobRunning(replicaA, "default/handover"))
+	assert.False(t, isJobRunning(replicaB, "default/handover"))
+
+	// replica A acquires leadership
+	stopReplicaA := startSynchronizer(t, replicaA)
+	assert.True(t, isJobRunning(replicaA, "default/handover"))
+	assert.False(t, isJobRunning(replicaB, "default/handover"))
+	assert.Equal(t, "bar", redisServer.HGet("default/handover", "foo"))
+
+	// replica A loses leadership, replica B takes over
+	stopReplicaA()
+	assert.False(t, isJobRunning(replicaA, "default/handover"))
+	assert.NoError(t, replicaA.CheckProgress(0))
+
+	startSynchronizer(t, replicaB)
+	assert.True(t, isJobRunning(replicaB, "default/handover"))
+
+	redisServer.HSet("default/handover", "foo", "baz")
+	assert.Eventually(t, func() bool {
+		updatedConfigMap := &corev1.ConfigMap{}
+		require.NoError(t, reconciler.Get(context.Background(), name, updatedConfigMap))
+		return updatedConfigMap.Data["foo"] == "baz"
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.False(t, isJobRunning(replicaA, "default/handover"))
+}
+
+func TestSynchronizerSharding(t *testing.T) {
+	_, redisConnection := newTestRedisConnection(t)
+	redisBackend := redis.NewRedisBackend(&redis.RedisBackendOptions{Redis: redisConnection})
+
+	configMaps := []*corev1.ConfigMap{}
+	for i := 0; i < 20; i++ {
+		configMaps = append(configMaps, newTestConfigMap(fmt.Sprintf("sharded-%d", i), map[string]string{"index": strconv.Itoa(i)}))
+	}
+	reconciler := newTestReconciler(configMaps...)
+
+	type replica struct {
+		synchronizer *ConfigMapSynchronizer
+		stop         func()
+	}
+	newReplica := func(replicaID string) *replica {
+		shardManager := sharding.NewShardManager(&sharding.ShardManagerOptions{
+			Redis:             redisConnection,
+			ReplicaID:         replicaID,
+			HeartbeatInterval: 50 * time.Millisecond,
+			MemberTTL:         500 * time.Millisecond,
+		})
+		synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+			Backend:    redisBackend,
+			Reconciler: reconciler,
+			Sharding:   shardManager,
+		})
+		assert.False(t, synchronizer.NeedLeaderElection())
+		for _, configMap := range configMaps {
+			synchronizer.Handle(context.Background(), &repository.RepositoryEvent[corev1.ConfigMap]{
+				Type:    repository.RepositoryEventUpdated,
+				Name:    types.NamespacedName{Namespace: configMap.Namespace, Name: configMap.Name},
+				Element: configMap.DeepCopy(),
+			})
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			assert.NoError(t, shardManager.Start(ctx))
+			done <- struct{}{}
+		}()
+		stopSynchronizer := startSynchronizer(t, synchronizer)
+		stop := func() {
+			stopSynchronizer()
+			cancel()
+			<-done
+		}
+		return &replica{synchronizer: synchronizer, stop: stop}
+	}
+
+	// every configmap is synchronized by exactly one replica
+	owners := func(replicas ...*replica) map[string]int {
+		result := map[string]int{}
+		for _, configMap := range configMaps {
+			name := "default/" + configMap.Name
+			for _, r := range replicas {
+				if isJobRunning(r.synchronizer, name) {
+					result[name]++
+				}
+			}
+		}
+		return result
+	}
+	balanced := func(replicas ...*replica) bool {
+		result := owners(replicas...)
+		if len(result) != len(configMaps) {
+			return false
+		}
+		for _, count := range result {
+			if count != 1 {
+				return false
+			}
+		}
+		return true
+	}
+
+	replicaA := newReplica("replica-a")
+	replicaB := newReplica("replica-b")
+	require.Eventually(t, func() bool { return balanced(replicaA, replicaB) }, 5*time.Second, 20*time.Millisecond)
+
+	runningOnA := 0
+	for _, configMap := range configMaps {
+		if isJobRunning(replicaA.synchronizer, "default/"+configMap.Name) {
+			runningOnA++
+		}
+	}
+	assert.Greater(t, runningOnA, 0)
+	assert.Less(t, runningOnA, len(configMaps))
+
+	// replica A leaves, replica B takes over its shard
+	replicaA.stop()
+	require.Eventually(t, func() bool { return balanced(replicaB) }, 5*time.Second, 20*time.Millisecond)
+	assert.NoError(t, replicaA.synchronizer.CheckProgress(0))
+	replicaB.stop()
+}
+
+func newBlockingReconciler(configMap *corev1.ConfigMap, update func(ctx context.Context) error) *controller.ConfigMapReconciler {
+	return &controller.ConfigMapReconciler{
+		Client: fake.NewClientBuilder().
+			WithScheme(clientgoscheme.Scheme).
+			WithObjects(configMap).
+			WithInterceptorFuncs(interceptor.Funcs{
+				Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+					if err := update(ctx); err != nil {
+						return err
+					}
+					return c.Update(ctx, obj, opts...)
+				},
+			}).
+			Build(),
+		Scheme: clientgoscheme.Scheme,
+	}
+}
+
+func TestSynchronizerShutdownDrainsInFlightWrites(t *testing.T) {
+	redisServer, redisBackend := newTestRedis(t)
+	configMap := newTestConfigMap("drain", map[string]string{"foo": "bar"})
+
+	updateStarted := make(chan struct{})
+	var startOnce sync.Once
+	reconciler := newBlockingReconciler(configMap, func(ctx context.Context) error {
+		startOnce.Do(func() { close(updateStarted) })
+		time.Sleep(300 * time.Millisecond)
+		return ctx.Err()
+	})
+
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:             redisBackend,
+		Reconciler:          reconciler,
+		ShutdownGracePeriod: 5 * time.Second,
+	})
+	stop := startSynchronizer(t, synchronizer)
+	synchronizer.Handle(context.Background(), &repository.RepositoryEvent[corev1.ConfigMap]{
+		Type:    repository.RepositoryEventUpdated,
+		Name:    types.NamespacedName{Namespace: "default", Name: "drain"},
+		Element: configMap.DeepCopy(),
+	})
+
+	redisServer.HSet("default/drain", "foo", "baz")
+	select {
+	case <-updateStarted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("kubernetes update not started")
+	}
+
+	// shutdown while the kubernetes update is in flight
+	stop()
+	assert.False(t, isJobRunning(synchronizer, "default/drain"))
+
+	updatedConfigMap := &corev1.ConfigMap{}
+	require.NoError(t, reconciler.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "drain"}, updatedConfigMap))
+	assert.Equal(t, "baz", updatedConfigMap.Data["foo"])
+}
+
+func TestSynchronizerShutdownCancelsWritesAfterGracePeriod(t *testing.T) {
+	redisServer, redisBackend := newTestRedis(t)
+	configMap := newTestConfigMap("stuck", map[string]string{"foo": "bar"})
+
+	updateStarted := make(chan struct{})
+	var startOnce sync.Once
+	var cancelled atomic.Bool
+	reconciler := newBlockingReconciler(configMap, func(ctx context.Context) error {
+		startOnce.Do(func() { close(updateStarted) })
+		<-ctx.Done()
+		cancelled.Store(true)
+		return ctx.Err()
+	})
+
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:             redisBackend,
+		Reconciler:          reconciler,
+		ShutdownGracePeriod: 200 * time.Millisecond,
+	})
+	stop := startSynchronizer(t, synchronizer)
+	synchronizer.Handle(context.Background(), &repository.RepositoryEvent[corev1.ConfigMap]{
+		Type:    repository.RepositoryEventUpdated,
+		Name:    types.NamespacedName{Namespace: "default", Name: "stuck"},
+		Element: configMap.DeepCopy(),
+	})
+
+	redisServer.HSet("default/stuck", "foo", "baz")
+	select {
+	case <-updateStarted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("kubernetes update not started")
+	}
+
+	stopStarted := time.Now()
+	stop()
+	assert.Less(t, time.Since(stopStarted), 2*time.Second)
+	assert.True(t, cancelled.Load())
+}
+
+func TestSynchronizerShutdownFlushesPendingState(t *testing.T) {
+	redisServer, redisBackend := newTestRedis(t)
+	configMap := newTestConfigMap("flush", map[string]string{"foo": "bar"})
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:             redisBackend,
+		Reconciler:          newTestReconciler(configMap),
+		ShutdownGracePeriod: 5 * time.Second,
+	})
+	stop := startSynchronizer(t, synchronizer)
+
+	// redis is unavailable while the update is handled
+	redisServer.SetError("LOADING")
+	synchronizer.Handle(context.Background(), &repository.RepositoryEvent[corev1.ConfigMap]{
+		Type:    repository.RepositoryEventUpdated,
+		Name:    types.NamespacedName{Namespace: "default", Name: "flush"},
+		Element: configMap.DeepCopy(),
+	})
+	assert.True(t, synchronizer.getJobs()["default/flush"].dirty.Load())
+	redisServer.SetError("")
+
+	stop()
+	assert.Equal(t, "bar", redisServer.HGet("default/flush", "foo"))
+	assert.False(t, synchronizer.getJobs()["default/flush"].dirty.Load())
+}
+
+func TestSynchronizerConcurrentEvents(t *testing.T) {
+	redisServer, redisBackend := newTestRedis(t)
+
+	configMaps := []*corev1.ConfigMap{}
+	for i := 0; i < 5; i++ {
+		configMaps = append(configMaps, newTestConfigMap(fmt.Sprintf("concurrent-%d", i), map[string]string{"foo": "bar"}))
+	}
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:             redisBackend,
+		Reconciler:          newTestReconciler(configMaps...),
+		ShutdownGracePeriod: 5 * time.Second,
+	})
+	stop := startSynchronizer(t, synchronizer)
+
+	event := func(eventType repository.RepositoryEventType, configMap *corev1.ConfigMap) *repository.RepositoryEvent[corev1.ConfigMap] {
+		return &repository.RepositoryEvent[corev1.ConfigMap]{
+			Type:    eventType,
+			Name:    types.NamespacedName{Namespace: configMap.Namespace, Name: configMap.Name},
+			Element: configMap,
+		}
+	}
+
+	// hammer the synchronizer with interleaved events for the same keys
+	waitGroup := sync.WaitGroup{}
+	for worker := 0; worker < 16; worker++ {
+		waitGroup.Add(1)
+		go func(worker int) {
+			defer waitGroup.Done()
+			for i := 0; i < 50; i++ {
+				configMap := configMaps[(worker+i)%len(configMaps)].DeepCopy()
+				configMap.Data["worker"] = strconv.Itoa(worker)
+				if (worker+i)%3 == 0 {
+					synchronizer.Handle(context.Background(), event(repository.RepositoryEventDeleted, configMap))
+				} else {
+					synchronizer.Handle(context.Background(), event(repository.RepositoryEventUpdated, configMap))
+				}
+				if i%10 == 0 {
+					synchronizer.rebalance()
+					assert.NoError(t, synchronizer.CheckProgress(time.Minute))
+				}
+			}
+		}(worker)
+	}
+	waitGroup.Wait()
+
+	// settle on a final state: every configmap exists exactly once and is synchronized
+	for _, configMap := range configMaps {
+		synchronizer.Handle(context.Background(), event(repository.RepositoryEventUpdated, configMap.DeepCopy()))
+	}
+	jobs := synchronizer.getJobs()
+	assert.Len(t, jobs, len(configMaps))
+	for _, configMap := range configMaps {
+		name := "default/" + configMap.Name
+		assert.True(t, isJobRunning(synchronizer, name))
+		assert.Equal(t, "bar", redisServer.HGet(name, "foo"))
+		assert.Equal(t, "", redisServer.HGet(name, "worker"))
+	}
+
+	// removing all configmaps must not leave orphaned job goroutines behind
+	for _, configMap := range configMaps {
+		synchronizer.Handle(context.Background(), event(repository.RepositoryEventDeleted, configMap.DeepCopy()))
+	}
+	assert.Empty(t, synchronizer.getJobs())
+	assert.True(t, waitTimeout(synchronizer.inFlight, 5*time.Second))
+
+	stop()
+}
@@ -0,0 +1,114 @@
+package configmap
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// findSpan returns the last span with the given name, restricted to children of parent if set
+func findSpan(spans tracetest.SpanStubs, name string, parent *tracetest.SpanStub) *tracetest.SpanStub {
+	var found *tracetest.SpanStub
+	for i := range spans {
+		if spans[i].Name != name {
+			continue
+		}
+		if parent != nil && spans[i].Parent.SpanID() != parent.SpanContext.SpanID() {
+			continue
+		}
+		found = &spans[i]
+	}
+	return found
+}
+
+var (
+	testSpanExporter     *tracetest.InMemoryExporter
+	setupTestTracingOnce sync.Once
+)
+
+// setupTestTracing installs an in-memory exporter. The global tracer provider can only be
+// delegated once, so the exporter is shared between test runs and reset instead.
+func setupTestTracing() *tracetest.InMemoryExporter {
+	setupTestTracingOnce.Do(func() {
+		testSpanExporter = tracetest.NewInMemoryExporter()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(testSpanExporter)))
+	})
+	testSpanExporter.Reset()
+	return testSpanExporter
+}
+
+func TestTracingFollowsConfigMapChange(t *testing.T) {
+	exporter := setupTestTracing()
+
+	redisServer, redisBackend := newTestRedis(t)
+	reconciler := newTestReconciler(newTestConfigMap("traced", map[string]string{"foo": "bar"}))
+
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:    redisBackend,
+		Reconciler: reconciler,
+	})
+	stopSynchronizer := startSynchronizer(t, synchronizer)
+	reconciler.Repository.AddListener(synchronizer, nil)
+
+	// reconcile => notify => listener => redis write
+	name := types.NamespacedName{Namespace: "default", Name: "traced"}
+	_, err := reconciler.Reconcile(context.Background(), ctrl.Request{NamespacedName: name})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return findSpan(exporter.GetSpans(), "ConfigMapSynchronizationJob.WriteRedisConfigMap", nil) != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	spans := exporter.GetSpans()
+	reconcileSpan := findSpan(spans, "ConfigMapReconciler.Reconcile", nil)
+	require.NotNil(t, reconcileSpan)
+	notifySpan := findSpan(spans, "Repository.Notify", reconcileSpan)
+	require.NotNil(t, notifySpan)
+	handleSpan := findSpan(spans, "RepositoryEventListener.Handle", notifySpan)
+	require.NotNil(t, handleSpan)
+	writeSpan := findSpan(spans, "ConfigMapSynchronizationJob.WriteRedisConfigMap", handleSpan)
+	require.NotNil(t, writeSpan)
+	require.NotNil(t, findSpan(spans, "evalsha", writeSpan))
+	assert.Equal(t, reconcileSpan.SpanContext.TraceID(), writeSpan.SpanContext.TraceID())
+
+	// redis poll => detected diff => kubernetes update
+	stopSynchronizer()
+	exporter.Reset()
+	redisServer.HSet("default/traced", "foo", "baz")
+
+	storedConfigMap := &corev1.ConfigMap{}
+	require.NoError(t, reconciler.Get(context.Background(), name, storedConfigMap))
+	job := &ConfigMapSynchronizationJob{
+		Name:       "default/traced",
+		ConfigMap:  storedConfigMap,
+		DataHash:   generateConfigMapDataHash(map[string]string{"foo": "bar"}),
+		Backend:    redisBackend,
+		Reconciler: reconciler,
+		storage:    redisBackend,
+		keys:       []string{"default/traced"},
+	}
+	require.NoError(t, job.pullRedisConfigMap(context.Background()))
+
+	spans = exporter.GetSpans()
+	updateSpan := findSpan(spans, "ConfigMapReconciler.Update", nil)
+	require.NotNil(t, updateSpan)
+	pollSpan := findSpan(spans, "ConfigMapSynchronizationJob.pullRedisConfigMap", nil)
+	require.NotNil(t, pollSpan)
+	assert.Equal(t, pollSpan.SpanContext.SpanID(), updateSpan.Parent.SpanID())
+	require.Len(t, pollSpan.Events, 1)
+	assert.Equal(t, "configmap data changed", pollSpan.Events[0].Name)
+	require.NotNil(t, findSpan(spans, "hgetall", pollSpan))
+
+	updatedConfigMap := &corev1.ConfigMap{}
+	require.NoError(t, reconciler.Get(context.Background(), name, updatedConfigMap))
+	assert.Equal(t, "baz", updatedConfigMap.Data["foo"])
+}
@@ -0,0 +1,111 @@
+package configmap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/mxcd/configmap-controller/internal/controller"
+)
+
+func TestSynchronizerTransform(t *testing.T) {
+	redisServer, redisBackend := newTestRedis(t)
+	configMap := newTestConfigMap("transformed", map[string]string{
+		"APP_FEATURE_CHECKOUT_ENABLED": "true",
+		"APP_LOG_LEVEL":                "info",
+		"LOCAL":                        "l",
+	})
+	configMap.Annotations[controller.TransformAnnotation] = "prefix:APP_; case:dotted"
+	configMap.Annotations[controller.PushIncludeAnnotation] = "APP_*"
+	reconciler := newTestReconciler(configMap)
+
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:    redisBackend,
+		Reconciler: reconciler,
+	})
+	startSynchronizer(t, synchronizer)
+	handleUpdate(synchronizer, configMap)
+
+	assert.Equal(t, "true", redisServer.HGet("default/transformed", "feature.checkout.enabled"))
+	assert.Equal(t, "info", redisServer.HGet("default/transformed", "log.level"))
+	assert.Empty(t, redisServer.HGet("default/transformed", "APP_LOG_LEVEL"))
+
+	// the pull converges to the same state, nothing changes
+	job := synchronizer.getJobs()["default/transformed"]
+	job.SyncLock.Lock()
+	defer job.SyncLock.Unlock()
+	require.NoError(t, job.pullRedisConfigMap(context.Background()))
+	assert.Equal(t, configMap.Data, job.ConfigMap.Data)
+
+	redisServer.HSet("default/transformed", "log.level", "debug")
+	redisServer.HSet("default/transformed", "feature.search.enabled", "false")
+	require.NoError(t, job.pullRedisConfigMap(context.Background()))
+
+	updatedConfigMap := &corev1.ConfigMap{}
+	require.NoError(t, reconciler.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "transformed"}, updatedConfigMap))
+	assert.Equal(t, map[string]string{
+		"APP_FEATURE_CHECKOUT_ENABLED": "true",
+		"APP_FEATURE_SEARCH_ENABLED":   "false",
+		"APP_LOG_LEVEL":                "debug",
+		"LOCAL":                        "l",
+	}, updatedConfigMap.Data)
+}
+
+func TestSynchronizerTransformFailure(t *testing.T) {
+	redisServer, redisBackend := newTestRedis(t)
+	configMap := newTestConfigMap("untransformable", map[string]string{"OTHER": "x"})
+	configMap.Annotations[controller.TransformAnnotation] = "prefix:APP_"
+	reconciler := newTestReconciler(configMap)
+	recorder := record.NewFakeRecorder(10)
+
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:    redisBackend,
+		Reconciler: reconciler,
+		Recorder:   recorder,
+	})
+	handleUpdate(synchronizer, configMap)
+
+	job := synchronizer.getJobs()["default/untransformable"]
+	job.SyncLock.Lock()
+	assert.Error(t, job.WriteRedisConfigMap(context.Background()))
+	job.SyncLock.Unlock()
+	assert.False(t, redisServer.Exists("default/untransformable"))
+	assert.Contains(t, <-recorder.Events, "TransformFailed")
+
+	invalid := newTestConfigMap("invalid", map[string]string{"FOO": "x"})
+	invalid.Annotations[controller.TransformAnnotation] = "case:camel"
+	handleUpdate(synchronizer, invalid)
+	assert.Contains(t, <-recorder.Events, "InvalidTransform")
+}
+
+func TestSynchronizerFlatten(t *testing.T) {
+	redisServer, redisBackend := newTestRedis(t)
+	configMap := newTestConfigMap("flattened", map[string]string{
+		"application.yaml": "# settings\nserver:\n  port: 8080 # http\n",
+	})
+	configMap.Annotations[controller.TransformAnnotation] = "flatten:application.yaml"
+	reconciler := newTestReconciler(configMap)
+
+	synchronizer := NewConfigMapSynchronizer(&ConfigMapSynchronizerOptions{
+		Backend:    redisBackend,
+		Reconciler: reconciler,
+	})
+	startSynchronizer(t, synchronizer)
+	handleUpdate(synchronizer, configMap)
+	assert.Equal(t, "8080", redisServer.HGet("default/flattened", "server.port"))
+
+	job := synchronizer.getJobs()["default/flattened"]
+	job.SyncLock.Lock()
+	defer job.SyncLock.Unlock()
+	require.NoError(t, job.pullRedisConfigMap(context.Background()))
+	assert.Equal(t, configMap.Data, job.ConfigMap.Data)
+
+	redisServer.HSet("default/flattened", "server.port", "9090")
+	require.NoError(t, job.pullRedisConfigMap(context.Background()))
+	assert.Equal(t, "# settings\nserver:\n  port: 9090 # http\n", job.ConfigMap.Data["application.yaml"])
+}
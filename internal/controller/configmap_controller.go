@@ -2,63 +2,274 @@ package controller
 
 import (
 	"context"
+	goerrors "errors"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 
 	"github.com/mxcd/configmap-controller/internal/repository"
 	"github.com/mxcd/configmap-controller/internal/util"
 )
 
+var tracer = otel.Tracer("github.com/mxcd/configmap-controller/internal/controller")
+
+const (
+	ManagedAnnotation = "configmap-controller.mxcd.de/managed"
+	// keeps deleted ConfigMaps around until their redis key was cleaned up
+	Finalizer = "configmap-controller.mxcd.de/cleanup"
+	// keep, delete or expire:<duration>, see backend.ParseKeyPolicy
+	DeletionPolicyAnnotation = "configmap-controller.mxcd.de/deletion-policy"
+	// binds the ConfigMap to the given comma separated redis keys instead of the templated key. Keys
+	// starting with redis.ControllerKeyPrefix are reserved for the bookkeeping and rejected.
+	RedisKeyAnnotation = "configmap-controller.mxcd.de/redis-key"
+	// comma separated glob or "regex:" patterns of the fields written to redis, commas in patterns are escaped as "\,"
+	PushIncludeAnnotation = "configmap-controller.mxcd.de/push-include"
+	PushExcludeAnnotation = "configmap-controller.mxcd.de/push-exclude"
+	// comma separated glob or "regex:" patterns of the fields applied from redis, see PushIncludeAnnotation
+	PullIncludeAnnotation = "configmap-controller.mxcd.de/pull-include"
+	PullExcludeAnnotation = "configmap-controller.mxcd.de/pull-exclude"
+	// semicolon separated transform steps between ConfigMap keys and redis fields, see transform.Parse.
+	// Field filters match the ConfigMap keys.
+	TransformAnnotation = "configmap-controller.mxcd.de/transform"
+	// hash, json or redisjson, overrides the default storage layout of the redis keys
+	StorageLayoutAnnotation = "configmap-controller.mxcd.de/storage-layout"
+	// shared or cluster, overrides the default scope of the templated redis key
+	KeyScopeAnnotation = "configmap-controller.mxcd.de/key-scope"
+
+	notResponsibleRequeueDelay = 5 * time.Second
+)
+
+// ErrNotResponsible is returned by a ConfigMapFinalizer if another replica has to finalize the ConfigMap
+var ErrNotResponsible = goerrors.New("not responsible for configmap")
+
+// ConfigMapFinalizer cleans up the external state of a deleted ConfigMap
+type ConfigMapFinalizer interface {
+	Finalize(ctx context.Context, configMap *corev1.ConfigMap) error
+}
+
+// ConfigMapReleaser cleans up the external state of a ConfigMap that is no longer managed
+type ConfigMapReleaser interface {
+	Release(ctx context.Context, configMap *corev1.ConfigMap) error
+}
+
 type ConfigMapReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// receives the state of all managed ConfigMaps
+	Repository *repository.ConfigMapRepository
+	// optional, runs before the finalizer is removed from a deleted ConfigMap
+	Finalizer ConfigMapFinalizer
+	// optional, runs before the finalizer is removed from a ConfigMap that is no longer managed
+	Releaser ConfigMapReleaser
+	// optional, uncached reader for caches restricted by a label selector. ConfigMaps that lost
+	// the label vanish from the cache but still exist and have to be released.
+	APIReader client.Reader
 }
 
 func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	ctx, span := tracer.Start(ctx, "ConfigMapReconciler.Reconcile")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("k8s.namespace.name", req.Namespace),
+		attribute.String("k8s.configmap.name", req.Name),
+	)
+
 	log.Trace().Str("name", util.GetNamespacedNameString(req.NamespacedName)).Msg("reconciling configmap")
 
 	configMap := &corev1.ConfigMap{}
 	err := r.Get(ctx, req.NamespacedName, configMap)
 	if err != nil {
 		if errors.IsNotFound(err) {
-			log.Debug().Str("name", util.GetNamespacedNameString(req.NamespacedName)).Msg("configmap deleted")
-			repository.GetConfigMapRepository().RemoveConfigMap(ctx, req.NamespacedName)
-			return ctrl.Result{}, nil
+			return r.reconcileMissing(ctx, req)
 		}
 		log.Error().Err(err).Msg("unable to fetch configmap")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "unable to fetch configmap")
 		return ctrl.Result{}, err
 	}
 
-	if !hasControlAnnotation(configMap) {
-		log.Trace().Str("name", util.GetNamespacedNameString(req.NamespacedName)).Msg("configmap not managed")
-		return ctrl.Result{}, nil
+	if !isManaged(configMap) {
+		// the managed annotation may have been removed from a known ConfigMap
+		return r.release(ctx, configMap)
 	}
 
 	if configMap.GetDeletionTimestamp() != nil {
 		log.Debug().Str("name", util.GetNamespacedNameString(req.NamespacedName)).Msg("configmap deleted")
-		repository.GetConfigMapRepository().RemoveConfigMap(ctx, req.NamespacedName)
-	} else {
-		log.Debug().Str("name", util.GetNamespacedNameString(req.NamespacedName)).Msg("configmap updated")
-		repository.GetConfigMapRepository().SetConfigMap(ctx, req.NamespacedName, configMap)
+		if !controllerutil.ContainsFinalizer(configMap, Finalizer) {
+			r.Repository.Remove(ctx, req.NamespacedName)
+			return ctrl.Result{}, nil
+		}
+
+		// the finalizer stops the synchronization before the key policy applies, removing the
+		// ConfigMap first would let the deleted event race with the policy
+		if r.Finalizer != nil {
+			err = r.Finalizer.Finalize(ctx, configMap)
+			if goerrors.Is(err, ErrNotResponsible) {
+				log.Debug().Str("name", util.GetNamespacedNameString(req.NamespacedName)).Msg("configmap finalized by another replica")
+				r.Repository.Remove(ctx, req.NamespacedName)
+				return ctrl.Result{RequeueAfter: notResponsibleRequeueDelay}, nil
+			}
+			if err != nil {
+				log.Error().Err(err).Str("name", util.GetNamespacedNameString(req.NamespacedName)).Msg("unable to finalize configmap")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, "unable to finalize configmap")
+				return ctrl.Result{}, err
+			}
+		}
+		r.Repository.Remove(ctx, req.NamespacedName)
+		return ctrl.Result{}, r.removeFinalizer(ctx, configMap)
+	}
+
+	if controllerutil.AddFinalizer(configMap, Finalizer) {
+		err = r.Update(ctx, configMap)
+		if err != nil {
+			log.Error().Err(err).Str("name", util.GetNamespacedNameString(req.NamespacedName)).Msg("unable to add finalizer")
+			return ctrl.Result{}, err
+		}
 	}
 
+	log.Debug().Str("name", util.GetNamespacedNameString(req.NamespacedName)).Msg("configmap updated")
+	r.Repository.Set(ctx, req.NamespacedName, configMap)
 	return ctrl.Result{}, nil
 }
 
+// reconcileMissing handles ConfigMaps that are not in the cache. With a label selector they may still exist.
+func (r *ConfigMapReconciler) reconcileMissing(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	if r.APIReader != nil {
+		configMap := &corev1.ConfigMap{}
+		err := r.APIReader.Get(ctx, req.NamespacedName, configMap)
+		if err == nil {
+			log.Debug().Str("name", util.GetNamespacedNameString(req.NamespacedName)).Msg("configmap no longer matches the label selector")
+			return r.release(ctx, configMap)
+		}
+		if !errors.IsNotFound(err) {
+			log.Error().Err(err).Str("name", util.GetNamespacedNameString(req.NamespacedName)).Msg("unable to fetch uncached configmap")
+			return ctrl.Result{}, err
+		}
+	}
+
+	log.Debug().Str("name", util.GetNamespacedNameString(req.NamespacedName)).Msg("configmap deleted")
+	r.Repository.Remove(ctx, req.NamespacedName)
+	return ctrl.Result{}, nil
+}
+
+// release stops the synchronization of a ConfigMap that is no longer managed, applies the release policy
+// and removes the finalizer. ConfigMaps with finalizer but unknown to the repository were released while
+// the controller was down.
+func (r *ConfigMapReconciler) release(ctx context.Context, configMap *corev1.ConfigMap) (ctrl.Result, error) {
+	name := client.ObjectKeyFromObject(configMap)
+	known, err := r.Repository.Get(ctx, name)
+	if err != nil && !controllerutil.ContainsFinalizer(configMap, Finalizer) {
+		log.Trace().Str("name", util.GetNamespacedNameString(name)).Msg("configmap not managed")
+		return ctrl.Result{}, nil
+	}
+
+	log.Info().Str("name", util.GetNamespacedNameString(name)).Msg("configmap no longer managed, releasing")
+	if r.Releaser != nil {
+		// the last managed state tells which keys were synchronized
+		released := configMap
+		if known != nil {
+			released = known
+		}
+		err = r.Releaser.Release(ctx, released)
+		if goerrors.Is(err, ErrNotResponsible) {
+			log.Debug().Str("name", util.GetNamespacedNameString(name)).Msg("configmap released by another replica")
+			r.Repository.Release(ctx, name)
+			return ctrl.Result{RequeueAfter: notResponsibleRequeueDelay}, nil
+		}
+		if err != nil {
+			log.Error().Err(err).Str("name", util.GetNamespacedNameString(name)).Msg("unable to release configmap")
+			return ctrl.Result{}, err
+		}
+	}
+	r.Repository.Release(ctx, name)
+	return ctrl.Result{}, r.removeFinalizer(ctx, configMap)
+}
+
+// UnselectedReleaser is a manager.Runnable that releases the ConfigMaps that left the label selector of
+// the cache while the controller was down, see ConfigMapReconciler.ReleaseUnselected
+type UnselectedReleaser struct {
+	Reconciler *ConfigMapReconciler
+	Selector   labels.Selector
+	// runs on the leader only, set like the Releaser's leader election
+	LeaderElection bool
+}
+
+func (u *UnselectedReleaser) Start(ctx context.Context) error {
+	return u.Reconciler.ReleaseUnselected(ctx, u.Selector)
+}
+
+func (u *UnselectedReleaser) NeedLeaderElection() bool {
+	return u.LeaderElection
+}
+
+// ReleaseUnselected releases the ConfigMaps that carry the finalizer but no longer match the label selector
+// of the cache, the cache never reports them. ConfigMaps of other replicas are retried until they were
+// released or the context ends.
+func (r *ConfigMapReconciler) ReleaseUnselected(ctx context.Context, selector labels.Selector) error {
+	for {
+		pending, err := r.releaseUnselected(ctx, selector)
+		if err != nil || !pending {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(notResponsibleRequeueDelay):
+		}
+	}
+}
+
+// releaseUnselected releases the unselected ConfigMaps once, it returns true if some are left to another replica
+func (r *ConfigMapReconciler) releaseUnselected(ctx context.Context, selector labels.Selector) (bool, error) {
+	configMaps := &corev1.ConfigMapList{}
+	err := r.APIReader.List(ctx, configMaps)
+	if err != nil {
+		return false, err
+	}
+	pending := false
+	for i := range configMaps.Items {
+		configMap := &configMaps.Items[i]
+		if selector.Matches(labels.Set(configMap.Labels)) || !controllerutil.ContainsFinalizer(configMap, Finalizer) {
+			continue
+		}
+		log.Info().Str("name", util.GetConfigMapNamespacedNameString(configMap)).Msg("configmap no longer matches the label selector, releasing")
+		result, err := r.release(ctx, configMap)
+		if err != nil {
+			return false, err
+		}
+		pending = pending || result.RequeueAfter > 0
+	}
+	return pending, nil
+}
+
+func (r *ConfigMapReconciler) removeFinalizer(ctx context.Context, configMap *corev1.ConfigMap) error {
+	if !controllerutil.RemoveFinalizer(configMap, Finalizer) {
+		return nil
+	}
+	err := r.Update(ctx, configMap)
+	if err != nil && !errors.IsNotFound(err) {
+		log.Error().Err(err).Str("name", util.GetConfigMapNamespacedNameString(configMap)).Msg("unable to remove finalizer")
+		return err
+	}
+	return nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *ConfigMapReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.ConfigMap{}).
+		For(&corev1.ConfigMap{}, builder.WithPredicates(ManagedPredicate())).
 		Complete(r)
 }
-
-func hasControlAnnotation(configMap *corev1.ConfigMap) bool {
-	_, ok := configMap.Annotations["configmap-controller.mxcd.de/managed"]
-	return ok
-}
@@ -0,0 +1,275 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/mxcd/configmap-controller/internal/repository"
+)
+
+func newTestConfigMap(name string, annotations map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Annotations: annotations},
+	}
+}
+
+func newTestReconciler(configMaps ...*corev1.ConfigMap) *ConfigMapReconciler {
+	builder := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme)
+	for _, configMap := range configMaps {
+		builder = builder.WithObjects(configMap)
+	}
+	return &ConfigMapReconciler{
+		Client:     builder.Build(),
+		Scheme:     clientgoscheme.Scheme,
+		Repository: repository.NewConfigMapRepository(),
+	}
+}
+
+func TestManagedPredicate(t *testing.T) {
+	managed := newTestConfigMap("managed", map[string]string{ManagedAnnotation: "true"})
+	unmanaged := newTestConfigMap("unmanaged", nil)
+	predicate := ManagedPredicate()
+
+	assert.True(t, predicate.Create(event.CreateEvent{Object: managed}))
+	assert.False(t, predicate.Create(event.CreateEvent{Object: unmanaged}))
+	assert.True(t, predicate.Delete(event.DeleteEvent{Object: managed}))
+	assert.False(t, predicate.Generic(event.GenericEvent{Object: unmanaged}))
+
+	// removing or adding the annotation must reach the reconciler
+	assert.True(t, predicate.Update(event.UpdateEvent{ObjectOld: managed, ObjectNew: unmanaged}))
+	assert.True(t, predicate.Update(event.UpdateEvent{ObjectOld: unmanaged, ObjectNew: managed}))
+	assert.False(t, predicate.Update(event.UpdateEvent{ObjectOld: unmanaged, ObjectNew: unmanaged}))
+
+	// the finalizer of a ConfigMap that lost the annotation must still be removed
+	finalized := newTestConfigMap("finalized", nil)
+	finalized.Finalizers = []string{Finalizer}
+	finalized.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	assert.True(t, predicate.Create(event.CreateEvent{Object: finalized}))
+	assert.True(t, predicate.Update(event.UpdateEvent{ObjectOld: finalized, ObjectNew: finalized}))
+	assert.True(t, predicate.Delete(event.DeleteEvent{Object: finalized}))
+	assert.True(t, predicate.Generic(event.GenericEvent{Object: finalized}))
+}
+
+func TestReconcileRemovesFinalizerOfDeletedUnmanagedConfigMap(t *testing.T) {
+	ctx := context.Background()
+	configMap := newTestConfigMap("deleted", nil)
+	configMap.Finalizers = []string{Finalizer}
+	configMap.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	reconciler := newTestReconciler(configMap)
+	name := types.NamespacedName{Namespace: "default", Name: "deleted"}
+
+	_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: name})
+	require.NoError(t, err)
+	// removing the last finalizer completes the deletion
+	assert.True(t, apierrors.IsNotFound(reconciler.Get(ctx, name, configMap)))
+}
+
+func TestReconcileDetectsRemovedAnnotation(t *testing.T) {
+	ctx := context.Background()
+	configMap := newTestConfigMap("released", map[string]string{ManagedAnnotation: "true"})
+	reconciler := newTestReconciler(configMap)
+	name := types.NamespacedName{Namespace: "default", Name: "released"}
+
+	_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: name})
+	require.NoError(t, err)
+	_, err = reconciler.Repository.Get(ctx, name)
+	require.NoError(t, err)
+
+	require.NoError(t, reconciler.Get(ctx, name, configMap))
+	configMap.Annotations = nil
+	require.NoError(t, reconciler.Update(ctx, configMap))
+
+	_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: name})
+	require.NoError(t, err)
+	_, err = reconciler.Repository.Get(ctx, name)
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+}
+
+type testReleaser struct {
+	err      error
+	released []*corev1.ConfigMap
+}
+
+func (r *testReleaser) Release(ctx context.Context, configMap *corev1.ConfigMap) error {
+	r.released = append(r.released, configMap.DeepCopy())
+	return r.err
+}
+
+func TestReconcileReleaseRequeuesIfNotResponsible(t *testing.T) {
+	ctx := context.Background()
+	configMap := newTestConfigMap("released", map[string]string{ManagedAnnotation: "true", "keep": "me"})
+	reconciler := newTestReconciler(configMap)
+	releaser := &testReleaser{err: ErrNotResponsible}
+	reconciler.Releaser = releaser
+	name := types.NamespacedName{Namespace: "default", Name: "released"}
+
+	_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: name})
+	require.NoError(t, err)
+	require.NoError(t, reconciler.Get(ctx, name, configMap))
+	configMap.Annotations = nil
+	require.NoError(t, reconciler.Update(ctx, configMap))
+
+	result, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: name})
+	require.NoError(t, err)
+	assert.NotZero(t, result.RequeueAfter)
+	require.NoError(t, reconciler.Get(ctx, name, configMap))
+	assert.Contains(t, configMap.Finalizers, Finalizer)
+	// the last managed state is released
+	require.Len(t, releaser.released, 1)
+	assert.Equal(t, "me", releaser.released[0].Annotations["keep"])
+
+	// after a restart the repository no longer knows the ConfigMap, the finalizer tells it was managed
+	_, err = reconciler.Repository.Get(ctx, name)
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+	releaser.err = nil
+	result, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: name})
+	require.NoError(t, err)
+	assert.Zero(t, result.RequeueAfter)
+	require.Len(t, releaser.released, 2)
+	assert.Empty(t, releaser.released[1].Annotations)
+	require.NoError(t, reconciler.Get(ctx, name, configMap))
+	assert.Empty(t, configMap.Finalizers)
+
+	// ConfigMaps without finalizer were never managed
+	_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: name})
+	require.NoError(t, err)
+	assert.Len(t, releaser.released, 2)
+}
+
+func TestReconcileReleasesConfigMapOutsideLabelSelector(t *testing.T) {
+	ctx := context.Background()
+	configMap := newTestConfigMap("unlabelled", map[string]string{ManagedAnnotation: "true"})
+	reconciler := newTestReconciler(configMap)
+	name := types.NamespacedName{Namespace: "default", Name: "unlabelled"}
+
+	_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: name})
+	require.NoError(t, err)
+	_, err = reconciler.Repository.Get(ctx, name)
+	require.NoError(t, err)
+
+	// the ConfigMap lost its label, the restricted cache no longer sees it
+	apiClient := reconciler.Client
+	reconciler.APIReader = apiClient
+	reconciler.Client = interceptor.NewClient(apiClient.(client.WithWatch), interceptor.Funcs{
+		Get: func(ctx context.Context, _ client.WithWatch, key client.ObjectKey, obj client.Object, _ ...client.GetOption) error {
+			return apierrors.NewNotFound(corev1.Resource("configmaps"), key.Name)
+		},
+	})
+
+	_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: name})
+	require.NoError(t, err)
+	_, err = reconciler.Repository.Get(ctx, name)
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+	// a later deletion must not wait for a controller that can no longer see the ConfigMap
+	require.NoError(t, apiClient.Get(ctx, name, configMap))
+	assert.Empty(t, configMap.Finalizers)
+
+	// deleted ConfigMaps are removed
+	require.NoError(t, apiClient.Delete(ctx, configMap))
+	_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: name})
+	require.NoError(t, err)
+}
+
+func TestReleaseUnselected(t *testing.T) {
+	ctx := context.Background()
+	selected := newTestConfigMap("selected", map[string]string{ManagedAnnotation: "true"})
+	selected.Labels = map[string]string{"sync": "true"}
+	selected.Finalizers = []string{Finalizer}
+	unselected := newTestConfigMap("unselected", map[string]string{ManagedAnnotation: "true"})
+	unselected.Finalizers = []string{Finalizer}
+	deleted := newTestConfigMap("deleted", nil)
+	deleted.Finalizers = []string{Finalizer}
+	deleted.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	reconciler := newTestReconciler(selected, unselected, deleted)
+	reconciler.APIReader = reconciler.Client
+
+	require.NoError(t, reconciler.ReleaseUnselected(ctx, labels.SelectorFromSet(labels.Set{"sync": "true"})))
+	configMap := &corev1.ConfigMap{}
+	require.NoError(t, reconciler.Get(ctx, client.ObjectKeyFromObject(selected), configMap))
+	assert.Equal(t, []string{Finalizer}, configMap.Finalizers)
+	require.NoError(t, reconciler.Get(ctx, client.ObjectKeyFromObject(unselected), configMap))
+	assert.Empty(t, configMap.Finalizers)
+	assert.True(t, apierrors.IsNotFound(reconciler.Get(ctx, client.ObjectKeyFromObject(deleted), configMap)))
+}
+
+type testFinalizer struct {
+	err       error
+	finalized []string
+	// records if the ConfigMap was still in the repository when it was finalized
+	repository *repository.ConfigMapRepository
+	tracked    []bool
+}
+
+func (f *testFinalizer) Finalize(ctx context.Context, configMap *corev1.ConfigMap) error {
+	f.finalized = append(f.finalized, configMap.Name)
+	if f.repository != nil {
+		_, err := f.repository.Get(ctx, client.ObjectKeyFromObject(configMap))
+		f.tracked = append(f.tracked, err == nil)
+	}
+	return f.err
+}
+
+func TestReconcileFinalizesDeletedConfigMap(t *testing.T) {
+	ctx := context.Background()
+	reconciler := newTestReconciler(newTestConfigMap("deleted", map[string]string{ManagedAnnotation: "true"}))
+	finalizer := &testFinalizer{err: ErrNotResponsible, repository: reconciler.Repository}
+	reconciler.Finalizer = finalizer
+	name := types.NamespacedName{Namespace: "default", Name: "deleted"}
+
+	_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: name})
+	require.NoError(t, err)
+	configMap := &corev1.ConfigMap{}
+	require.NoError(t, reconciler.Get(ctx, name, configMap))
+	assert.Contains(t, configMap.Finalizers, Finalizer)
+
+	// the finalizer keeps the ConfigMap until it was finalized
+	require.NoError(t, reconciler.Delete(ctx, configMap))
+	result, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: name})
+	require.NoError(t, err)
+	assert.NotZero(t, result.RequeueAfter)
+	require.NoError(t, reconciler.Get(ctx, name, configMap))
+	_, err = reconciler.Repository.Get(ctx, name)
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+
+	finalizer.err = errors.New("redis unavailable")
+	_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: name})
+	assert.Error(t, err)
+	require.NoError(t, reconciler.Get(ctx, name, configMap))
+
+	finalizer.err = nil
+	_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: name})
+	require.NoError(t, err)
+	assert.True(t, apierrors.IsNotFound(reconciler.Get(ctx, name, configMap)))
+	assert.Equal(t, []string{"deleted", "deleted", "deleted"}, finalizer.finalized)
+	// the synchronization stops before the ConfigMap is removed from the repository
+	assert.Equal(t, []bool{true, false, false}, finalizer.tracked)
+}
+
+func TestReconcileRemovesFinalizerOfUnmanagedConfigMap(t *testing.T) {
+	ctx := context.Background()
+	configMap := newTestConfigMap("unmanaged", nil)
+	configMap.Finalizers = []string{Finalizer}
+	reconciler := newTestReconciler(configMap)
+	name := types.NamespacedName{Namespace: "default", Name: "unmanaged"}
+
+	_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: name})
+	require.NoError(t, err)
+	require.NoError(t, reconciler.Get(ctx, name, configMap))
+	assert.Empty(t, configMap.Finalizers)
+}
@@ -0,0 +1,41 @@
+package controller
+
+import (
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// ManagedPredicate only passes events of managed objects. Updates are passed if either the old or
+// the new object is managed so that the removal of the managed annotation reaches the reconciler.
+// Objects carrying the finalizer always pass, it has to be removed even if the annotation was
+// removed while the controller was down.
+func ManagedPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return isRelevant(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return isRelevant(e.ObjectOld) || isRelevant(e.ObjectNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return isRelevant(e.Object)
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return isRelevant(e.Object)
+		},
+	}
+}
+
+func isRelevant(object client.Object) bool {
+	return isManaged(object) || (object != nil && controllerutil.ContainsFinalizer(object, Finalizer))
+}
+
+func isManaged(object client.Object) bool {
+	if object == nil {
+		return false
+	}
+	_, ok := object.GetAnnotations()[ManagedAnnotation]
+	return ok
+}
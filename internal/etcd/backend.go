@@ -0,0 +1,429 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+)
+
+const (
+	// the metadata key of every written key holds its layout and the field owners
+	metaKeyBase = "/configmap-controller/meta"
+	// etcd's default limit of operations per transaction
+	maxTxnOps = 128
+	// writes are retried when another writer changed the key in the meantime
+	maxWriteAttempts = 5
+	listBatchSize    = 500
+)
+
+const (
+	// FieldsLayout stores every field in its own etcd key below the key
+	FieldsLayout = "fields"
+	// JSONLayout stores all fields as one json document in the key
+	JSONLayout = "json"
+)
+
+type EtcdBackendOptions struct {
+	Etcd *EtcdConnection
+	// prepended to every key, should start with a slash
+	Prefix string
+	// FieldsLayout or JSONLayout, empty uses FieldsLayout
+	StorageLayout string
+}
+
+// EtcdBackend stores keys in etcd. Writes are transactions that only succeed if the key's revisions did not
+// change since it was read. Keys are watched, a watch breaks if the cluster loses its leader.
+type EtcdBackend struct {
+	connection *EtcdConnection
+	prefix     string
+	layout     string
+}
+
+func NewEtcdBackend(options *EtcdBackendOptions) (*EtcdBackend, error) {
+	layout, err := parseStorageLayout(options.StorageLayout)
+	if err != nil {
+		return nil, err
+	}
+	return &EtcdBackend{connection: options.Etcd, prefix: options.Prefix, layout: layout}, nil
+}
+
+func parseStorageLayout(name string) (string, error) {
+	switch name {
+	case "", FieldsLayout:
+		return FieldsLayout, nil
+	case JSONLayout:
+		return JSONLayout, nil
+	}
+	return "", fmt.Errorf("unknown etcd storage layout %q, expected fields or json", name)
+}
+
+// WithLayout implements backend.LayoutBackend
+func (b *EtcdBackend) WithLayout(name string) (backend.Backend, error) {
+	layout, err := parseStorageLayout(name)
+	if err != nil {
+		return nil, err
+	}
+	return &EtcdBackend{connection: b.connection, prefix: b.prefix, layout: layout}, nil
+}
+
+type metadata struct {
+	Layout string            `json:"layout"`
+	Owners map[string]string `json:"owners,omitempty"`
+}
+
+// snapshot is a consistent read of a key in both layouts
+type snapshot struct {
+	meta         *metadata
+	metaRevision int64
+	metaKey      *mvccpb.KeyValue
+	// etcd keys of the fields layout by field
+	fields   map[string]*mvccpb.KeyValue
+	document *mvccpb.KeyValue
+}
+
+func (b *EtcdBackend) metaKey(key string) string {
+	return metaKeyBase + b.prefix + key
+}
+
+func (b *EtcdBackend) documentKey(key string) string {
+	return b.prefix + key
+}
+
+func (b *EtcdBackend) fieldsPrefix(key string) string {
+	return b.prefix + key + "/"
+}
+
+// fieldKey escapes slashes in the field, the fields of a key never reach into the fields of a nested key
+func (b *EtcdBackend) fieldKey(key string, field string) string {
+	return b.fieldsPrefix(key) + url.PathEscape(field)
+}
+
+func (b *EtcdBackend) read(ctx context.Context, key string) (*snapshot, error) {
+	response, err := b.connection.Client.Txn(ctx).Then(
+		clientv3.OpGet(b.metaKey(key)),
+		clientv3.OpGet(b.fieldsPrefix(key), clientv3.WithPrefix()),
+		clientv3.OpGet(b.documentKey(key)),
+	).Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &snapshot{fields: map[string]*mvccpb.KeyValue{}}
+	if kvs := response.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 {
+		snapshot.metaKey = kvs[0]
+		snapshot.metaRevision = kvs[0].ModRevision
+		snapshot.meta = &metadata{}
+		err = json.Unmarshal(kvs[0].Value, snapshot.meta)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata of key %q: %w", key, err)
+		}
+	}
+	for _, kv := range response.Responses[1].GetResponseRange().Kvs {
+		escapedField := strings.TrimPrefix(string(kv.Key), b.fieldsPrefix(key))
+		field, err := url.PathUnescape(escapedField)
+		if err != nil || strings.Contains(escapedField, "/") {
+			// a field of a nested key or written by someone else
+			continue
+		}
+		snapshot.fields[field] = kv
+	}
+	if kvs := response.Responses[2].GetResponseRange().Kvs; len(kvs) > 0 {
+		snapshot.document = kvs[0]
+	}
+	return snapshot, nil
+}
+
+// layout returns the layout the key was written in, the given layout if it was never written
+func (s *snapshot) layout(layout string) string {
+	if s.meta != nil && s.meta.Layout != "" {
+		return s.meta.Layout
+	}
+	return layout
+}
+
+// entry returns the fields of the layout, nil if the key was never written
+func (s *snapshot) entry(layout string) (*backend.Entry, error) {
+	entry := &backend.Entry{Data: map[string]string{}, Owners: map[string]string{}}
+	if s.meta != nil {
+		maps.Copy(entry.Owners, s.meta.Owners)
+	}
+
+	switch layout {
+	case FieldsLayout:
+		if s.meta == nil && len(s.fields) == 0 {
+			return nil, nil
+		}
+		for field, kv := range s.fields {
+			entry.Data[field] = string(kv.Value)
+		}
+	case JSONLayout:
+		if s.meta == nil && s.document == nil {
+			return nil, nil
+		}
+		if s.document != nil {
+			data, err := backend.DecodeJSONFields(s.document.Value)
+			if err != nil {
+				return nil, err
+			}
+			entry.Data = data
+		}
+	}
+	return entry, nil
+}
+
+// Get reads the key in the layout it was written in
+func (b *EtcdBackend) Get(ctx context.Context, key string) (*backend.Entry, error) {
+	snapshot, err := b.read(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot.entry(snapshot.layout(b.layout))
+}
+
+// Put reads the key in the layout it was written in and stores it in the backend's layout
+
+func (b *EtcdBackend) Put(ctx context.Context, key string, owner string, data map[string]string, protected []string) ([]string, error) {
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		snapshot, err := b.read(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := snapshot.entry(snapshot.layout(b.layout))
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			entry = &backend.Entry{Data: map[string]string{}, Owners: map[string]string{}}
+		}
+
+		conflicts := backend.ApplyPut(entry, owner, data, protected)
+		written, err := b.write(ctx, key, snapshot, b.layout, entry)
+		if err != nil {
+			return nil, err
+		}
+		if written {
+			slices.Sort(conflicts)
+			return conflicts, nil
+		}
+	}
+	return nil, fmt.Errorf("etcd key %q changed concurrently, giving up after %d attempts", key, maxWriteAttempts)
+}
+
+// write stores the entry in the layout in a single transaction. A key written in the other layout loses its
+// etcd keys of that layout. It returns false if the key changed since the snapshot was read.
+func (b *EtcdBackend) write(ctx context.Context, key string, snapshot *snapshot, layout string, entry *backend.Entry) (bool, error) {
+	compares := []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(b.metaKey(key)), "=", snapshot.metaRevision)}
+	ops := []clientv3.Op{}
+	previousLayout := snapshot.layout(layout)
+
+	var documentRevision int64
+	if snapshot.document != nil {
+		documentRevision = snapshot.document.ModRevision
+	}
+
+	switch layout {
+	case FieldsLayout:
+		for field, kv := range snapshot.fields {
+			if _, ok := entry.Data[field]; !ok {
+				ops = append(ops, clientv3.OpDelete(string(kv.Key)))
+			}
+		}
+		for field, value := range entry.Data {
+			if kv, ok := snapshot.fields[field]; !ok || string(kv.Value) != value {
+				ops = append(ops, clientv3.OpPut(b.fieldKey(key, field), value))
+			}
+		}
+		if previousLayout == JSONLayout && snapshot.document != nil {
+			compares = append(compares, clientv3.Compare(clientv3.ModRevision(b.documentKey(key)), "=", documentRevision))
+			ops = append(ops, clientv3.OpDelete(b.documentKey(key)))
+		}
+	case JSONLayout:
+		if previousLayout == FieldsLayout {
+			for _, kv := range snapshot.fields {
+				ops = append(ops, clientv3.OpDelete(string(kv.Key)))
+			}
+		}
+		// concurrent changes of the document by applications are not overwritten
+		compares = append(compares, clientv3.Compare(clientv3.ModRevision(b.documentKey(key)), "=", documentRevision))
+		document, err := json.Marshal(entry.Data)
+		if err != nil {
+			return false, err
+		}
+		if snapshot.document == nil || string(snapshot.document.Value) != string(document) {
+			ops = append(ops, clientv3.OpPut(b.documentKey(key), string(document)))
+		}
+	}
+
+	meta, err := json.Marshal(&metadata{Layout: layout, Owners: entry.Owners})
+	if err != nil {
+		return false, err
+	}
+	if snapshot.metaKey == nil || string(snapshot.metaKey.Value) != string(meta) {
+		ops = append(ops, clientv3.OpPut(b.metaKey(key), string(meta)))
+	}
+
+	if len(ops) == 0 {
+		return true, nil
+	}
+	// a write split into several transactions could be left half done by a concurrent writer
+	if len(ops) > maxTxnOps {
+		return false, fmt.Errorf("writing etcd key %q takes %d operations, more than the %d of a transaction, use the json layout", key, len(ops), maxTxnOps)
+	}
+	response, err := b.connection.Client.Txn(ctx).If(compares...).Then(ops...).Commit()
+	if err != nil {
+		return false, err
+	}
+	return response.Succeeded, nil
+}
+
+func (b *EtcdBackend) Delete(ctx context.Context, key string, owner string, policy *backend.KeyPolicy) error {
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		snapshot, err := b.read(ctx, key)
+		if err != nil {
+			return err
+		}
+		layout := snapshot.layout(b.layout)
+		entry, err := snapshot.entry(layout)
+		if err != nil || entry == nil {
+			return err
+		}
+
+		owners := maps.Clone(entry.Owners)
+		if backend.ReleaseFields(owners, owner) {
+			return b.applyKeyPolicy(ctx, key, snapshot, policy)
+		}
+		if !slices.Contains(slices.Collect(maps.Values(entry.Owners)), owner) {
+			return nil
+		}
+
+		if policy.Action == backend.KeyPolicyDelete {
+			// putting no fields removes all fields of the owner
+			backend.ApplyPut(entry, owner, map[string]string{}, nil)
+		} else if policy.Action == backend.KeyPolicyExpire {
+			log.Warn().Str("name", owner).Str("key", key).Msg("shared etcd key can not expire, keeping fields")
+		}
+		maps.DeleteFunc(entry.Owners, func(_ string, fieldOwner string) bool {
+			return fieldOwner == owner
+		})
+
+		written, err := b.write(ctx, key, snapshot, layout, entry)
+		if err != nil || written {
+			return err
+		}
+	}
+	return fmt.Errorf("etcd key %q changed concurrently, giving up after %d attempts", key, maxWriteAttempts)
+}
+
+// applyKeyPolicy keeps, deletes or expires all etcd keys of the key. Kept keys lose their metadata,
+// expiring keys are attached to a lease and keep their time to live.
+func (b *EtcdBackend) applyKeyPolicy(ctx context.Context, key string, snapshot *snapshot, policy *backend.KeyPolicy) error {
+	kvs := slices.Collect(maps.Values(snapshot.fields))
+	if snapshot.document != nil {
+		kvs = append(kvs, snapshot.document)
+	}
+	if snapshot.metaKey != nil {
+		kvs = append(kvs, snapshot.metaKey)
+	}
+
+	ops := []clientv3.Op{}
+	switch policy.Action {
+	case backend.KeyPolicyDelete:
+		for _, kv := range kvs {
+			ops = append(ops, clientv3.OpDelete(string(kv.Key)))
+		}
+	case backend.KeyPolicyExpire:
+		for _, kv := range kvs {
+			if kv.Lease != 0 {
+				return nil
+			}
+		}
+		lease, err := b.connection.Client.Grant(ctx, int64(math.Ceil(policy.TTL.Seconds())))
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			ops = append(ops, clientv3.OpPut(string(kv.Key), "", clientv3.WithIgnoreValue(), clientv3.WithLease(lease.ID)))
+		}
+	default:
+		if snapshot.metaKey != nil {
+			ops = append(ops, clientv3.OpDelete(b.metaKey(key)))
+		}
+	}
+
+	for len(ops) > 0 {
+		part := ops[:min(len(ops), maxTxnOps)]
+		ops = ops[len(part):]
+		_, err := b.connection.Client.Txn(ctx).Then(part...).Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Watch watches the etcd keys of the key in the backend's layout
+func (b *EtcdBackend) Watch(ctx context.Context, key string) (<-chan struct{}, error) {
+	var responses clientv3.WatchChan
+	if b.layout == FieldsLayout {
+		responses = b.connection.Client.Watch(clientv3.WithRequireLeader(ctx), b.fieldsPrefix(key), clientv3.WithPrefix())
+	} else {
+		responses = b.connection.Client.Watch(clientv3.WithRequireLeader(ctx), b.documentKey(key))
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer close(changes)
+		for response := range responses {
+			if err := response.Err(); err != nil {
+				log.Debug().Err(err).Str("key", key).Msg("etcd watch closed")
+				return
+			}
+			if len(response.Events) == 0 {
+				continue
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// List returns the keys with metadata, keys never written by the controller are not listed
+func (b *EtcdBackend) List(ctx context.Context, pattern string) ([]string, error) {
+	metaPrefix := b.metaKey("")
+	rangeEnd := clientv3.GetPrefixRangeEnd(metaPrefix)
+	matches := backend.PatternMatcher(pattern)
+	keys := []string{}
+	start := metaPrefix
+	for {
+		response, err := b.connection.Client.Get(ctx, start,
+			clientv3.WithRange(rangeEnd), clientv3.WithKeysOnly(), clientv3.WithLimit(listBatchSize),
+			clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range response.Kvs {
+			key := strings.TrimPrefix(string(kv.Key), metaPrefix)
+			if matches(key) {
+				keys = append(keys, key)
+			}
+		}
+		if !response.More || len(response.Kvs) == 0 {
+			return keys, nil
+		}
+		start = string(response.Kvs[len(response.Kvs)-1].Key) + "\x00"
+	}
+}
@@ -0,0 +1,291 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+	"github.com/mxcd/configmap-controller/internal/configmap"
+	"github.com/mxcd/configmap-controller/internal/controller"
+	"github.com/mxcd/configmap-controller/internal/repository"
+)
+
+func freeURL(t *testing.T) url.URL {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return url.URL{Scheme: "http", Host: listener.Addr().String()}
+}
+
+// newTestEtcd starts an embedded single member etcd cluster
+func newTestEtcd(t *testing.T) *EtcdConnection {
+	config := embed.NewConfig()
+	config.Dir = t.TempDir()
+	config.LogLevel = "error"
+	clientURL, peerURL := freeURL(t), freeURL(t)
+	config.ListenClientUrls = []url.URL{clientURL}
+	config.AdvertiseClientUrls = []url.URL{clientURL}
+	config.ListenPeerUrls = []url.URL{peerURL}
+	config.AdvertisePeerUrls = []url.URL{peerURL}
+	config.InitialCluster = fmt.Sprintf("%s=%s", config.Name, peerURL.String())
+
+	server, err := embed.StartEtcd(config)
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("embedded etcd did not start")
+	}
+
+	connection, err := NewEtcdConnection(&EtcdConnectionOptions{
+		Endpoints:   []string{clientURL.String()},
+		DialTimeout: 5 * time.Second,
+	})
+	require.NoError(t, err)
+	t.Cleanup(connection.Close)
+	return connection
+}
+
+func newTestEtcdBackend(t *testing.T, connection *EtcdConnection, layout string) *EtcdBackend {
+	etcdBackend, err := NewEtcdBackend(&EtcdBackendOptions{Etcd: connection, Prefix: "/config/", StorageLayout: layout})
+	require.NoError(t, err)
+	return etcdBackend
+}
+
+func TestEtcdBackendLayouts(t *testing.T) {
+	connection := newTestEtcd(t)
+	ctx := context.Background()
+
+	for _, layout := range []string{FieldsLayout, JSONLayout} {
+		t.Run(layout, func(t *testing.T) {
+			etcdBackend := newTestEtcdBackend(t, connection, layout)
+			key := "default/" + layout
+
+			entry, err := etcdBackend.Get(ctx, key)
+			require.NoError(t, err)
+			assert.Nil(t, entry)
+
+			conflicts, err := etcdBackend.Put(ctx, key, "default/first", map[string]string{"a": "1", "shared": "first", "path/field": "x"}, nil)
+			require.NoError(t, err)
+			assert.Empty(t, conflicts)
+			conflicts, err = etcdBackend.Put(ctx, key, "default/second", map[string]string{"b": "2", "shared": "second"}, nil)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"shared"}, conflicts)
+
+			// stale fields of the owner are removed, protected ones are kept
+			_, err = etcdBackend.Put(ctx, key, "default/first", map[string]string{"a": "3"}, []string{"shared"})
+			require.NoError(t, err)
+			entry, err = etcdBackend.Get(ctx, key)
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{"a": "3", "b": "2", "shared": "first"}, entry.Data)
+			assert.Equal(t, map[string]string{"a": "default/first", "b": "default/second", "shared": "default/first"}, entry.Owners)
+
+			// an empty ConfigMap is known to exist
+			_, err = etcdBackend.Put(ctx, key+"-empty", "default/empty", map[string]string{}, nil)
+			require.NoError(t, err)
+			entry, err = etcdBackend.Get(ctx, key+"-empty")
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{}, entry.Data)
+		})
+	}
+
+	response, err := connection.Client.Get(ctx, "/config/default/fields/a")
+	require.NoError(t, err)
+	require.Len(t, response.Kvs, 1)
+	assert.Equal(t, "3", string(response.Kvs[0].Value))
+	response, err = connection.Client.Get(ctx, "/config/default/json")
+	require.NoError(t, err)
+	require.Len(t, response.Kvs, 1)
+	assert.Equal(t, `{"a":"3","b":"2","shared":"first"}`, string(response.Kvs[0].Value))
+}
+
+func TestEtcdBackendLargeWrite(t *testing.T) {
+	connection := newTestEtcd(t)
+	ctx := context.Background()
+
+	data := map[string]string{}
+	for i := 0; i < 3*maxTxnOps; i++ {
+		data[fmt.Sprintf("field-%d", i)] = "value"
+	}
+	// a write is never split into several transactions
+	etcdBackend := newTestEtcdBackend(t, connection, FieldsLayout)
+	_, err := etcdBackend.Put(ctx, "default/large", "default/large", data, nil)
+	assert.ErrorContains(t, err, "json layout")
+	entry, err := etcdBackend.Get(ctx, "default/large")
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+
+	etcdBackend = newTestEtcdBackend(t, connection, JSONLayout)
+	_, err = etcdBackend.Put(ctx, "default/large", "default/large", data, nil)
+	require.NoError(t, err)
+	entry, err = etcdBackend.Get(ctx, "default/large")
+	require.NoError(t, err)
+	assert.Equal(t, data, entry.Data)
+}
+
+func TestEtcdBackendLayoutChange(t *testing.T) {
+	connection := newTestEtcd(t)
+	ctx := context.Background()
+	fieldsBackend := newTestEtcdBackend(t, connection, FieldsLayout)
+	jsonBackend := newTestEtcdBackend(t, connection, JSONLayout)
+
+	_, err := jsonBackend.Put(ctx, "default/app", "default/app", map[string]string{"a": "1"}, nil)
+	require.NoError(t, err)
+	// keys are read in the layout they were written in
+	entry, err := fieldsBackend.Get(ctx, "default/app")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "1"}, entry.Data)
+
+	// a write moves the key into the backend's layout
+	_, err = fieldsBackend.Put(ctx, "default/app", "default/app", map[string]string{"a": "1", "b": "2"}, nil)
+	require.NoError(t, err)
+	response, err := connection.Client.Get(ctx, "/config/default/app")
+	require.NoError(t, err)
+	assert.Empty(t, response.Kvs)
+	entry, err = jsonBackend.Get(ctx, "default/app")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, entry.Data)
+
+	_, err = jsonBackend.Put(ctx, "default/app", "default/app", map[string]string{"a": "3"}, nil)
+	require.NoError(t, err)
+	response, err = connection.Client.Get(ctx, "/config/default/app/", clientv3.WithPrefix())
+	require.NoError(t, err)
+	assert.Empty(t, response.Kvs)
+	entry, err = fieldsBackend.Get(ctx, "default/app")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "3"}, entry.Data)
+}
+
+func TestEtcdBackendDelete(t *testing.T) {
+	connection := newTestEtcd(t)
+	etcdBackend := newTestEtcdBackend(t, connection, FieldsLayout)
+	ctx := context.Background()
+
+	_, err := etcdBackend.Put(ctx, "shared", "default/first", map[string]string{"a": "1"}, nil)
+	require.NoError(t, err)
+	_, err = etcdBackend.Put(ctx, "shared", "default/second", map[string]string{"b": "2"}, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, etcdBackend.Delete(ctx, "shared", "default/second", &backend.KeyPolicy{Action: backend.KeyPolicyDelete}))
+	entry, err := etcdBackend.Get(ctx, "shared")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "1"}, entry.Data)
+	assert.Equal(t, map[string]string{"a": "default/first"}, entry.Owners)
+
+	require.NoError(t, etcdBackend.Delete(ctx, "shared", "default/first", &backend.KeyPolicy{Action: backend.KeyPolicyExpire, TTL: time.Hour}))
+	response, err := connection.Client.Get(ctx, "/config/shared/a")
+	require.NoError(t, err)
+	require.Len(t, response.Kvs, 1)
+	lease := clientv3.LeaseID(response.Kvs[0].Lease)
+	require.NotZero(t, lease)
+	ttl, err := connection.Client.TimeToLive(ctx, lease)
+	require.NoError(t, err)
+	assert.InDelta(t, time.Hour.Seconds(), float64(ttl.TTL), 5)
+
+	// an expiring key keeps its lease, the delete policy of the garbage collector removes it
+	require.NoError(t, etcdBackend.Delete(ctx, "shared", "", &backend.KeyPolicy{Action: backend.KeyPolicyExpire, TTL: time.Minute}))
+	response, err = connection.Client.Get(ctx, "/config/shared/a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(lease), response.Kvs[0].Lease)
+
+	keys, err := etcdBackend.List(ctx, "*")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"shared"}, keys)
+
+	require.NoError(t, etcdBackend.Delete(ctx, "shared", "", &backend.KeyPolicy{Action: backend.KeyPolicyDelete}))
+	entry, err = etcdBackend.Get(ctx, "shared")
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+	keys, err = etcdBackend.List(ctx, "*")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestEtcdBackendWatch(t *testing.T) {
+	connection := newTestEtcd(t)
+	etcdBackend := newTestEtcdBackend(t, connection, FieldsLayout)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	changes, err := etcdBackend.Watch(ctx, "default/app")
+	require.NoError(t, err)
+	_, err = connection.Client.Put(context.Background(), "/config/default/app/foo", "bar")
+	require.NoError(t, err)
+
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change notification")
+	}
+
+	cancel()
+	assert.Eventually(t, func() bool {
+		_, ok := <-changes
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSynchronizerEtcd(t *testing.T) {
+	etcdBackend := newTestEtcdBackend(t, newTestEtcd(t), FieldsLayout)
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "app",
+			Annotations: map[string]string{controller.ManagedAnnotation: "true"},
+		},
+		Data: map[string]string{"foo": "bar"},
+	}
+	reconciler := &controller.ConfigMapReconciler{
+		Client:     fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(configMap).Build(),
+		Scheme:     clientgoscheme.Scheme,
+		Repository: repository.NewConfigMapRepository(),
+	}
+	synchronizer := configmap.NewConfigMapSynchronizer(&configmap.ConfigMapSynchronizerOptions{
+		Backend:    etcdBackend,
+		Reconciler: reconciler,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(t, synchronizer.Start(ctx))
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	// events are handled once the synchronizer runs
+	assert.Eventually(t, func() bool {
+		synchronizer.Handle(context.Background(), &repository.RepositoryEvent[corev1.ConfigMap]{
+			Type:    repository.RepositoryEventUpdated,
+			Name:    client.ObjectKeyFromObject(configMap),
+			Element: configMap.DeepCopy(),
+		})
+		entry, err := etcdBackend.Get(context.Background(), "default/app")
+		return err == nil && entry != nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	_, err := etcdBackend.connection.Client.Put(context.Background(), "/config/default/app/foo", "baz")
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		stored := &corev1.ConfigMap{}
+		require.NoError(t, reconciler.Get(context.Background(), client.ObjectKeyFromObject(configMap), stored))
+		return stored.Data["foo"] == "baz"
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,45 @@
+package etcd
+
+import (
+	"context"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+type EtcdConnection struct {
+	Client *clientv3.Client
+}
+
+type EtcdConnectionOptions struct {
+	Endpoints   []string
+	Username    string
+	Password    string
+	DialTimeout time.Duration
+}
+
+func NewEtcdConnection(options *EtcdConnectionOptions) (*EtcdConnection, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   options.Endpoints,
+		Username:    options.Username,
+		Password:    options.Password,
+		DialTimeout: options.DialTimeout,
+		// errors are returned to the caller and logged there
+		Logger: zap.NewNop(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &EtcdConnection{Client: client}, nil
+}
+
+func (c *EtcdConnection) Close() {
+	c.Client.Close()
+}
+
+// Ping checks that the cluster answers a read. It fails if the cluster has no leader.
+func (c *EtcdConnection) Ping(ctx context.Context) error {
+	_, err := c.Client.Get(ctx, "health", clientv3.WithCountOnly())
+	return err
+}
@@ -0,0 +1,431 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+)
+
+// metadata of the written keys is kept below the directory in files named like the key
+const metaDirectory = ".configmap-controller"
+
+type FileBackendOptions struct {
+	// keys are stored as files below the directory, e.g. default/app.yaml
+	Directory string
+	// YAMLFormat or EnvFormat, empty uses YAMLFormat
+	Format string
+}
+
+// FileBackend stores every key in a file, e.g. in a mounted volume or a git checkout. Files are replaced
+// atomically and watched with fsnotify. Writes are serialized within the process only, an edit racing with
+// a write of the controller may be lost.
+type FileBackend struct {
+	directory string
+	format    string
+
+	lock *sync.Mutex
+	// watches the directories of the watched keys, nil if nothing is watched
+	watcher *fsnotify.Watcher
+	// watchers by file path
+	watchers map[string]map[chan struct{}]bool
+	// number of watchers by directory
+	directories map[string]int
+}
+
+type metadata struct {
+	Owners    map[string]string `json:"owners,omitempty"`
+	ExpiresAt *time.Time        `json:"expiresAt,omitempty"`
+}
+
+func NewFileBackend(options *FileBackendOptions) (*FileBackend, error) {
+	format, err := parseFormat(options.Format)
+	if err != nil {
+		return nil, err
+	}
+	return &FileBackend{
+		directory:   filepath.Clean(options.Directory),
+		format:      format,
+		lock:        &sync.Mutex{},
+		watchers:    make(map[string]map[chan struct{}]bool),
+		directories: make(map[string]int),
+	}, nil
+}
+
+// validateKey rejects keys that would reach outside of the directory or into the metadata
+func validateKey(key string) error {
+	if !filepath.IsLocal(key) || strings.HasPrefix(filepath.ToSlash(filepath.Clean(key)), metaDirectory+"/") {
+		return fmt.Errorf("key %q can not be stored as a file", key)
+	}
+	return nil
+}
+
+func (b *FileBackend) path(key string) string {
+	return filepath.Join(b.directory, filepath.FromSlash(key)+"."+b.format)
+}
+
+func (b *FileBackend) metaPath(key string) string {
+	return filepath.Join(b.directory, metaDirectory, filepath.FromSlash(key)+".json")
+}
+
+// load reads the fields and metadata of the key, nil if it does not exist. Expired keys are removed.
+// The caller must hold lock.
+func (b *FileBackend) load(key string) (*backend.Entry, *metadata, error) {
+	err := validateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta := &metadata{}
+	metaContent, err := os.ReadFile(b.metaPath(key))
+	hasMeta := err == nil
+	if hasMeta {
+		err = json.Unmarshal(metaContent, meta)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid metadata of key %q: %w", key, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+	if meta.ExpiresAt != nil && time.Now().After(*meta.ExpiresAt) {
+		return nil, nil, b.remove(key)
+	}
+
+	content, err := os.ReadFile(b.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		if !hasMeta {
+			return nil, nil, nil
+		}
+		content = []byte{}
+	} else if err != nil {
+		return nil, nil, err
+	}
+	data, err := decode(b.format, content)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid file %s: %w", b.path(key), err)
+	}
+
+	entry := &backend.Entry{Data: data, Owners: map[string]string{}}
+	maps.Copy(entry.Owners, meta.Owners)
+	return entry, meta, nil
+}
+
+// store writes the fields if they changed and the metadata. The caller must hold lock.
+func (b *FileBackend) store(key string, previous map[string]string, entry *backend.Entry, meta *metadata) error {
+	if previous == nil || !maps.Equal(previous, entry.Data) {
+		content, err := encode(b.format, entry.Data)
+		if err != nil {
+			return err
+		}
+		err = writeFile(b.path(key), content)
+		if err != nil {
+			return err
+		}
+	}
+	meta.Owners = entry.Owners
+	metaContent, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeFile(b.metaPath(key), metaContent)
+}
+
+// writeFile replaces the file atomically, readers and watchers never see a partial file
+func writeFile(path string, content []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(content)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(temp.Name(), 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// remove deletes the file and the metadata of the key. The caller must hold lock.
+func (b *FileBackend) remove(key string) error {
+	for _, path := range []string{b.path(key), b.metaPath(key)} {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *FileBackend) Get(_ context.Context, key string) (*backend.Entry, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entry, _, err := b.load(key)
+	return entry, err
+}
+
+func (b *FileBackend) Put(_ context.Context, key string, owner string, data map[string]string, protected []string) ([]string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entry, meta, err := b.load(key)
+	if err != nil {
+		return nil, err
+	}
+	var previous map[string]string
+	if entry == nil {
+		entry = &backend.Entry{Data: map[string]string{}, Owners: map[string]string{}}
+		meta = &metadata{}
+	} else {
+		previous = maps.Clone(entry.Data)
+	}
+
+	conflicts := backend.ApplyPut(entry, owner, data, protected)
+	slices.Sort(conflicts)
+	return conflicts, b.store(key, previous, entry, meta)
+}
+
+func (b *FileBackend) Delete(_ context.Context, key string, owner string, policy *backend.KeyPolicy) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entry, meta, err := b.load(key)
+	if err != nil || entry == nil {
+		return err
+	}
+
+	owners := maps.Clone(entry.Owners)
+	if backend.ReleaseFields(owners, owner) {
+		switch policy.Action {
+		case backend.KeyPolicyDelete:
+			return b.remove(key)
+		case backend.KeyPolicyExpire:
+			// an expiring key keeps its time to live
+			if meta.ExpiresAt == nil {
+				expiresAt := time.Now().Add(policy.TTL)
+				meta.ExpiresAt = &expiresAt
+			}
+			entry.Owners = map[string]string{}
+			return b.store(key, entry.Data, entry, meta)
+		default:
+			err = os.Remove(b.metaPath(key))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			return nil
+		}
+	}
+	if !slices.Contains(slices.Collect(maps.Values(entry.Owners)), owner) {
+		return nil
+	}
+
+	previous := maps.Clone(entry.Data)
+	if policy.Action == backend.KeyPolicyDelete {
+		// putting no fields removes all fields of the owner
+		backend.ApplyPut(entry, owner, map[string]string{}, nil)
+	} else if policy.Action == backend.KeyPolicyExpire {
+		log.Warn().Str("name", owner).Str("key", key).Msg("shared file can not expire, keeping fields")
+	}
+	entry.Owners = owners
+	return b.store(key, previous, entry, meta)
+}
+
+// Watch watches the directory of the key's file, one fsnotify watcher is shared by all watches.
+// The watch is closed if the directory is removed.
+func (b *FileBackend) Watch(ctx context.Context, key string) (<-chan struct{}, error) {
+	err := validateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	path := b.path(key)
+	directory := filepath.Dir(path)
+	err = os.MkdirAll(directory, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.watcher == nil {
+		b.watcher, err = fsnotify.NewWatcher()
+		if err != nil {
+			return nil, err
+		}
+		go b.receive(b.watcher)
+	}
+	if b.directories[directory] == 0 {
+		err = b.watcher.Add(directory)
+		if err != nil {
+			if len(b.watchers) == 0 {
+				b.closeWatcher()
+			}
+			return nil, err
+		}
+	}
+	b.directories[directory]++
+
+	changes := make(chan struct{}, 1)
+	if b.watchers[path] == nil {
+		b.watchers[path] = make(map[chan struct{}]bool)
+	}
+	b.watchers[path][changes] = true
+
+	context.AfterFunc(ctx, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		b.unwatch(path, changes)
+	})
+	return changes, nil
+}
+
+// unwatch closes a watch unless it was closed already. The caller must hold lock.
+func (b *FileBackend) unwatch(path string, changes chan struct{}) {
+	if !b.watchers[path][changes] {
+		return
+	}
+	delete(b.watchers[path], changes)
+	if len(b.watchers[path]) == 0 {
+		delete(b.watchers, path)
+	}
+	close(changes)
+
+	directory := filepath.Dir(path)
+	b.directories[directory]--
+	if b.directories[directory] <= 0 {
+		delete(b.directories, directory)
+		// fails if the directory was removed, its watch is gone already
+		_ = b.watcher.Remove(directory)
+	}
+	if len(b.watchers) == 0 {
+		b.closeWatcher()
+	}
+}
+
+// closeWatcher stops the fsnotify watcher. The caller must hold lock.
+func (b *FileBackend) closeWatcher() {
+	b.watcher.Close()
+	b.watcher = nil
+}
+
+// receive dispatches the events of the watcher until it is closed
+func (b *FileBackend) receive(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			b.lock.Lock()
+			if b.watcher == watcher {
+				b.dispatch(event)
+			}
+			b.lock.Unlock()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			// events may have been lost, every watched key is pulled
+			log.Warn().Err(err).Msg("file watch error")
+			b.lock.Lock()
+			if b.watcher == watcher {
+				for path := range b.watchers {
+					b.notify(path)
+				}
+			}
+			b.lock.Unlock()
+		}
+	}
+}
+
+// dispatch notifies the watchers of a changed file. The caller must hold lock.
+func (b *FileBackend) dispatch(event fsnotify.Event) {
+	path := filepath.Clean(event.Name)
+	if b.directories[path] > 0 && event.Has(fsnotify.Remove|fsnotify.Rename) {
+		// a removed directory is no longer watched, its watches are closed and set up again
+		for watchedPath, watchers := range b.watchers {
+			if filepath.Dir(watchedPath) == path {
+				for changes := range watchers {
+					b.unwatch(watchedPath, changes)
+				}
+			}
+		}
+		return
+	}
+	if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) {
+		return
+	}
+	b.notify(path)
+}
+
+// notify wakes up the watchers of the file without blocking. The caller must hold lock.
+func (b *FileBackend) notify(path string) {
+	for changes := range b.watchers[path] {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// List returns the keys with metadata, files never written by the controller are not listed.
+// Expired keys are removed.
+func (b *FileBackend) List(_ context.Context, pattern string) ([]string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	metaRoot := filepath.Join(b.directory, metaDirectory)
+	matches := backend.PatternMatcher(pattern)
+	keys := []string{}
+	err := filepath.WalkDir(metaRoot, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path == metaRoot {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(path, ".json") || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+		relative, err := filepath.Rel(metaRoot, strings.TrimSuffix(path, ".json"))
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relative)
+		if !matches(key) {
+			return nil
+		}
+		stored, _, err := b.load(key)
+		if err != nil {
+			// one broken file does not hide the other keys
+			log.Warn().Err(err).Str("key", key).Msg("unable to read file key")
+			return nil
+		}
+		if stored != nil {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
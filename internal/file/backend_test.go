@@ -0,0 +1,203 @@
+package file
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+	"github.com/mxcd/configmap-controller/internal/configmap"
+	"github.com/mxcd/configmap-controller/internal/controller"
+	"github.com/mxcd/configmap-controller/internal/repository"
+)
+
+func newTestFileBackend(t *testing.T, format string) (*FileBackend, string) {
+	directory := t.TempDir()
+	fileBackend, err := NewFileBackend(&FileBackendOptions{Directory: directory, Format: format})
+	require.NoError(t, err)
+	return fileBackend, directory
+}
+
+func TestFileBackendOwnership(t *testing.T) {
+	for _, format := range []string{YAMLFormat, EnvFormat} {
+		t.Run(format, func(t *testing.T) {
+			fileBackend, directory := newTestFileBackend(t, format)
+			ctx := context.Background()
+
+			entry, err := fileBackend.Get(ctx, "default/app")
+			require.NoError(t, err)
+			assert.Nil(t, entry)
+
+			conflicts, err := fileBackend.Put(ctx, "default/app", "default/first", map[string]string{"a": "1", "shared": "first"}, nil)
+			require.NoError(t, err)
+			assert.Empty(t, conflicts)
+			conflicts, err = fileBackend.Put(ctx, "default/app", "default/second", map[string]string{"b": "2", "shared": "second"}, nil)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"shared"}, conflicts)
+
+			// stale fields of the owner are removed, protected ones are kept
+			_, err = fileBackend.Put(ctx, "default/app", "default/first", map[string]string{"a": "3"}, []string{"shared"})
+			require.NoError(t, err)
+			entry, err = fileBackend.Get(ctx, "default/app")
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{"a": "3", "b": "2", "shared": "first"}, entry.Data)
+			assert.Equal(t, map[string]string{"a": "default/first", "b": "default/second", "shared": "default/first"}, entry.Owners)
+
+			content, err := os.ReadFile(filepath.Join(directory, "default", "app."+format))
+			require.NoError(t, err)
+			if format == EnvFormat {
+				assert.Equal(t, "a=\"3\"\nb=\"2\"\nshared=\"first\"\n", string(content))
+			} else {
+				assert.Equal(t, "a: \"3\"\nb: \"2\"\nshared: first\n", string(content))
+			}
+
+			// an empty ConfigMap is known to exist
+			_, err = fileBackend.Put(ctx, "default/empty", "default/empty", map[string]string{}, nil)
+			require.NoError(t, err)
+			entry, err = fileBackend.Get(ctx, "default/empty")
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{}, entry.Data)
+		})
+	}
+}
+
+func TestFileBackendDelete(t *testing.T) {
+	fileBackend, directory := newTestFileBackend(t, YAMLFormat)
+	ctx := context.Background()
+
+	_, err := fileBackend.Put(ctx, "shared", "default/first", map[string]string{"a": "1"}, nil)
+	require.NoError(t, err)
+	_, err = fileBackend.Put(ctx, "shared", "default/second", map[string]string{"b": "2"}, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, fileBackend.Delete(ctx, "shared", "default/second", &backend.KeyPolicy{Action: backend.KeyPolicyDelete}))
+	entry, err := fileBackend.Get(ctx, "shared")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "1"}, entry.Data)
+	assert.Equal(t, map[string]string{"a": "default/first"}, entry.Owners)
+
+	require.NoError(t, fileBackend.Delete(ctx, "shared", "default/first", &backend.KeyPolicy{Action: backend.KeyPolicyExpire, TTL: 100 * time.Millisecond}))
+	// files of other applications are not listed
+	require.NoError(t, os.WriteFile(filepath.Join(directory, "unrelated.yaml"), []byte("a: 1\n"), 0o644))
+	keys, err := fileBackend.List(ctx, "*")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"shared"}, keys)
+
+	// expired keys are removed
+	time.Sleep(150 * time.Millisecond)
+	keys, err = fileBackend.List(ctx, "*")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	assert.NoFileExists(t, filepath.Join(directory, "shared.yaml"))
+
+	// kept keys lose their metadata only
+	_, err = fileBackend.Put(ctx, "default/app", "default/app", map[string]string{"a": "1"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, fileBackend.Delete(ctx, "default/app", "default/app", &backend.KeyPolicy{Action: backend.KeyPolicyKeep}))
+	assert.FileExists(t, filepath.Join(directory, "default", "app.yaml"))
+	keys, err = fileBackend.List(ctx, "*/*")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	_, err = fileBackend.Get(ctx, "../outside")
+	assert.Error(t, err)
+	_, err = fileBackend.Get(ctx, ".configmap-controller/app")
+	assert.Error(t, err)
+}
+
+func TestFileBackendWatch(t *testing.T) {
+	fileBackend, directory := newTestFileBackend(t, YAMLFormat)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	changes, err := fileBackend.Watch(ctx, "default/app")
+	require.NoError(t, err)
+	other, err := fileBackend.Watch(ctx, "default/other")
+	require.NoError(t, err)
+	// an edit in the checkout
+	require.NoError(t, os.WriteFile(filepath.Join(directory, "default", "app.yaml"), []byte("foo: bar\n"), 0o644))
+
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change notification")
+	}
+	select {
+	case <-other:
+		t.Fatal("unexpected change notification")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// watches of a removed directory are closed
+	require.NoError(t, os.RemoveAll(filepath.Join(directory, "default")))
+	assert.Eventually(t, func() bool {
+		_, ok := <-other
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.Eventually(t, func() bool {
+		fileBackend.lock.Lock()
+		defer fileBackend.lock.Unlock()
+		return fileBackend.watcher == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSynchronizerFile(t *testing.T) {
+	fileBackend, directory := newTestFileBackend(t, EnvFormat)
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "app",
+			Annotations: map[string]string{controller.ManagedAnnotation: "true"},
+		},
+		Data: map[string]string{"foo": "bar"},
+	}
+	reconciler := &controller.ConfigMapReconciler{
+		Client:     fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(configMap).Build(),
+		Scheme:     clientgoscheme.Scheme,
+		Repository: repository.NewConfigMapRepository(),
+	}
+	synchronizer := configmap.NewConfigMapSynchronizer(&configmap.ConfigMapSynchronizerOptions{
+		Backend:    fileBackend,
+		Reconciler: reconciler,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(t, synchronizer.Start(ctx))
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	// events are handled once the synchronizer runs
+	assert.Eventually(t, func() bool {
+		synchronizer.Handle(context.Background(), &repository.RepositoryEvent[corev1.ConfigMap]{
+			Type:    repository.RepositoryEventUpdated,
+			Name:    client.ObjectKeyFromObject(configMap),
+			Element: configMap.DeepCopy(),
+		})
+		entry, err := fileBackend.Get(context.Background(), "default/app")
+		return err == nil && entry != nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	require.NoError(t, os.WriteFile(filepath.Join(directory, "default", "app.env"), []byte("foo=baz\n"), 0o644))
+	assert.Eventually(t, func() bool {
+		stored := &corev1.ConfigMap{}
+		require.NoError(t, reconciler.Get(context.Background(), client.ObjectKeyFromObject(configMap), stored))
+		return stored.Data["foo"] == "baz"
+	}, 5*time.Second, 10*time.Millisecond)
+}
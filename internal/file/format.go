@@ -0,0 +1,143 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// YAMLFormat stores the fields as a flat yaml mapping
+	YAMLFormat = "yaml"
+	// EnvFormat stores the fields as KEY="value" lines
+	EnvFormat = "env"
+)
+
+func parseFormat(name string) (string, error) {
+	switch name {
+	case "", YAMLFormat:
+		return YAMLFormat, nil
+	case EnvFormat:
+		return EnvFormat, nil
+	}
+	return "", fmt.Errorf("unknown file format %q, expected yaml or env", name)
+}
+
+func encode(format string, data map[string]string) ([]byte, error) {
+	if format == EnvFormat {
+		return encodeEnv(data), nil
+	}
+	if len(data) == 0 {
+		return []byte{}, nil
+	}
+	return yaml.Marshal(data)
+}
+
+func decode(format string, content []byte) (map[string]string, error) {
+	if format == EnvFormat {
+		return decodeEnv(content)
+	}
+	data := map[string]string{}
+	err := yaml.Unmarshal(content, &data)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		// a file with an explicit null
+		data = map[string]string{}
+	}
+	return data, nil
+}
+
+var envEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+
+// encodeEnv writes the fields sorted and double quoted, values round trip unchanged
+func encodeEnv(data map[string]string) []byte {
+	builder := &strings.Builder{}
+	for _, field := range slices.Sorted(maps.Keys(data)) {
+		fmt.Fprintf(builder, "%s=\"%s\"\n", field, envEscaper.Replace(data[field]))
+	}
+	return []byte(builder.String())
+}
+
+// decodeEnv parses KEY=value lines. Blank lines, comments and an export prefix are allowed. Values are
+// unquoted, single quoted without escapes or double quoted with escapes and may span lines.
+func decodeEnv(content []byte) (map[string]string, error) {
+	data := map[string]string{}
+	rest := strings.ReplaceAll(string(content), "\r\n", "\n")
+	for rest != "" {
+		var line string
+		line, rest, _ = strings.Cut(rest, "\n")
+		line = strings.TrimLeft(line, " \t")
+		if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		field, value, found := strings.Cut(line, "=")
+		field = strings.TrimSpace(field)
+		if !found || field == "" {
+			return nil, fmt.Errorf("invalid line %q, expected KEY=value", strings.TrimSpace(line))
+		}
+		value = strings.TrimLeft(value, " \t")
+
+		var err error
+		switch {
+		case strings.HasPrefix(value, `"`):
+			value, rest, err = unquoteEnv(value[1:] + "\n" + rest)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of %s: %w", field, err)
+			}
+		case strings.HasPrefix(value, "'"):
+			end := strings.Index(value[1:], "'")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid value of %s: unterminated quoted value", field)
+			}
+			value = value[1 : end+1]
+		default:
+			if comment := strings.Index(value, " #"); comment >= 0 {
+				value = value[:comment]
+			}
+			value = strings.TrimSpace(value)
+		}
+		data[field] = value
+	}
+	return data, nil
+}
+
+// unquoteEnv reads a double quoted value up to its closing quote and returns it and the lines after it
+func unquoteEnv(s string) (string, string, error) {
+	value := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			tail, rest, _ := strings.Cut(s[i+1:], "\n")
+			if tail = strings.TrimSpace(tail); tail != "" && !strings.HasPrefix(tail, "#") {
+				return "", "", fmt.Errorf("unexpected %q after quoted value", tail)
+			}
+			return value.String(), rest, nil
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", "", errors.New("unterminated quoted value")
+			}
+			switch s[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case 'r':
+				value.WriteByte('\r')
+			case 't':
+				value.WriteByte('\t')
+			default:
+				value.WriteByte(s[i])
+			}
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return "", "", errors.New("unterminated quoted value")
+}
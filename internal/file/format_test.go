@@ -0,0 +1,68 @@
+package file
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatRoundTrip(t *testing.T) {
+	data := map[string]string{
+		"port":       "007",
+		"multi-line": "a\nb\r\n",
+		"quotes":     `say "hi" \ bye`,
+		"empty":      "",
+		"dollar":     "$HOME #1",
+		"app.yaml":   "key: value\n",
+	}
+	for _, format := range []string{YAMLFormat, EnvFormat} {
+		t.Run(format, func(t *testing.T) {
+			content, err := encode(format, data)
+			require.NoError(t, err)
+			decoded, err := decode(format, content)
+			require.NoError(t, err)
+			assert.Equal(t, data, decoded)
+
+			content, err = encode(format, map[string]string{})
+			require.NoError(t, err)
+			decoded, err = decode(format, content)
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{}, decoded)
+		})
+	}
+}
+
+func TestDecodeEnv(t *testing.T) {
+	data, err := decodeEnv([]byte(`# comment
+export A=1
+B = plain value # comment
+C='single "quoted" \n'
+
+D="multi
+line" # comment
+E="tab\tnew\nline"
+`))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"A": "1",
+		"B": "plain value",
+		"C": `single "quoted" \n`,
+		"D": "multi\nline",
+		"E": "tab\tnew\nline",
+	}, data)
+
+	for _, content := range []string{"A", `A="open`, "A='open", `A="x" y`, "=1"} {
+		_, err = decodeEnv([]byte(content))
+		assert.Error(t, err, content)
+	}
+}
+
+func TestDecodeYAML(t *testing.T) {
+	data, err := decode(YAMLFormat, []byte("port: 8080\nenabled: true\n"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"port": "8080", "enabled": "true"}, data)
+
+	_, err = decode(YAMLFormat, []byte("nested:\n  a: 1\n"))
+	assert.Error(t, err)
+}
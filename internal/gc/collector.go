@@ -0,0 +1,163 @@
+package gc
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+	"github.com/mxcd/configmap-controller/internal/configmap"
+	"github.com/mxcd/configmap-controller/internal/sharding"
+)
+
+type OrphanCollectorOptions struct {
+	Backend backend.Backend
+	// used to list the existing ConfigMaps, usually the informer cache
+	Reader client.Reader
+	// derives the keys of the existing ConfigMaps and the key pattern to scan
+	KeyNaming *configmap.KeyNaming
+	Interval  time.Duration
+	// time a key has to stay orphaned before the policy is applied
+	GracePeriod time.Duration
+	// applied to orphaned keys. Keeping the keys only reports them.
+	Policy *backend.KeyPolicy
+	// logs the keys that would be removed instead of removing them
+	DryRun bool
+	// optional, restricts the collection to the keys of this replica's shard
+	Sharding *sharding.ShardManager
+}
+
+// OrphanCollector periodically lists the backend's ConfigMap keys whose ConfigMap no longer exists.
+// Only keys written by the controller that trace back to a ConfigMap through the key template are
+// collected, keys outside of the template, like keys bound by annotation, are never collected.
+type OrphanCollector struct {
+	options *OrphanCollectorOptions
+	// time each orphaned key was first seen
+	orphans map[string]time.Time
+}
+
+func NewOrphanCollector(options *OrphanCollectorOptions) *OrphanCollector {
+	return &OrphanCollector{
+		options: options,
+		orphans: make(map[string]time.Time),
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable. In sharding mode every replica collects its own shard.
+func (c *OrphanCollector) NeedLeaderElection() bool {
+	return c.options.Sharding == nil
+}
+
+// Start implements manager.Runnable. It collects until the context is cancelled.
+func (c *OrphanCollector) Start(ctx context.Context) error {
+	log.Info().Dur("interval", c.options.Interval).Str("policy", c.options.Policy.String()).Bool("dryRun", c.options.DryRun).Msg("starting orphaned redis key collector")
+
+	for {
+		err := c.Collect(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Error().Err(err).Msg("unable to collect orphaned redis keys")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(c.options.Interval):
+		}
+	}
+}
+
+// Collect runs a single garbage collection pass
+func (c *OrphanCollector) Collect(ctx context.Context) error {
+	// ConfigMaps created during the scan may show up as orphans, the grace period protects their keys
+	configMaps := &corev1.ConfigMapList{}
+	err := c.options.Reader.List(ctx, configMaps)
+	if err != nil {
+		return err
+	}
+	knownKeys := make(map[string]bool, len(configMaps.Items))
+	for i := range configMaps.Items {
+		// ConfigMaps with invalid keys are not synchronized, they have no keys
+		keys, _ := c.options.KeyNaming.Keys(&configMaps.Items[i])
+		for _, key := range keys {
+			knownKeys[key] = true
+		}
+	}
+
+	orphans := make(map[string]time.Time)
+	now := time.Now()
+	keys := []string{}
+	for _, pattern := range c.options.KeyNaming.Patterns() {
+		patternKeys, err := c.options.Backend.List(ctx, pattern)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, patternKeys...)
+	}
+
+	for _, key := range keys {
+		// the patterns of shared and cluster scoped keys may overlap
+		if _, ok := orphans[key]; ok || knownKeys[key] {
+			continue
+		}
+		// keys of other clusters sharing the backend are never orphans of this cluster
+		if c.options.KeyNaming.IsForeign(key) {
+			continue
+		}
+		// the pattern may match keys that were not built by the template, e.g. annotated keys
+		namespacedName, ok := c.options.KeyNaming.NamespacedName(key)
+		if !ok || !c.isResponsible(namespacedName) {
+			continue
+		}
+
+		firstSeen, ok := c.orphans[key]
+		if !ok {
+			firstSeen = now
+			log.Debug().Str("key", key).Msg("found orphaned redis key")
+		}
+		orphans[key] = firstSeen
+	}
+
+	// keys that were adopted or removed in the meantime start over
+	c.orphans = orphans
+	orphanedKeys.Set(float64(len(orphans)))
+
+	for key, firstSeen := range orphans {
+		if now.Sub(firstSeen) < c.options.GracePeriod {
+			continue
+		}
+		c.remove(ctx, key)
+	}
+	return nil
+}
+
+// isResponsible returns true if this replica collects the keys of the ConfigMap. Keys are sharded by the
+// namespaced name of their ConfigMap like the synchronizer does, the replica that would synchronize a
+// ConfigMap collects its keys.
+func (c *OrphanCollector) isResponsible(namespacedName string) bool {
+	return c.options.Sharding == nil || c.options.Sharding.Owns(namespacedName)
+}
+
+func (c *OrphanCollector) remove(ctx context.Context, key string) {
+	policy := c.options.Policy
+	if policy.Action == backend.KeyPolicyKeep {
+		return
+	}
+	if c.options.DryRun {
+		log.Info().Str("key", key).Str("policy", policy.String()).Msg("dry run, would remove orphaned redis key")
+		return
+	}
+	// the policy applies to the whole key regardless of its owners, an expiring key keeps its time to live
+	err := c.options.Backend.Delete(ctx, key, "", policy)
+	if err != nil {
+		log.Error().Err(err).Str("key", key).Str("policy", policy.String()).Msg("unable to remove orphaned redis key")
+		return
+	}
+	log.Info().Str("key", key).Str("policy", policy.String()).Msg("removed orphaned redis key")
+	removedKeys.WithLabelValues(string(policy.Action)).Inc()
+	if policy.Action == backend.KeyPolicyDelete {
+		delete(c.orphans, key)
+	}
+}
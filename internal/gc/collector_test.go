@@ -0,0 +1,253 @@
+package gc
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+	"github.com/mxcd/configmap-controller/internal/configmap"
+	"github.com/mxcd/configmap-controller/internal/redis"
+	"github.com/mxcd/configmap-controller/internal/sharding"
+)
+
+// writeKey writes a key like the controller does, with its metadata hash
+func writeKey(redisServer *miniredis.Miniredis, key string) {
+	redisServer.HSet(key, "foo", "bar")
+	redisServer.HSet(redis.MetaKey(key), "layout", "hash")
+}
+
+func newTestCollector(t *testing.T, policy string, gracePeriod time.Duration, dryRun bool) (*miniredis.Miniredis, *OrphanCollector) {
+	redisServer := miniredis.RunT(t)
+	redisPort, err := strconv.Atoi(redisServer.Port())
+	require.NoError(t, err)
+	redisConnection, err := redis.NewRedisConnection(&redis.RedisConnectionOptions{
+		Host: redisServer.Host(),
+		Port: redisPort,
+	})
+	require.NoError(t, err)
+	t.Cleanup(redisConnection.Close)
+
+	keyPolicy, err := backend.ParseKeyPolicy(policy)
+	require.NoError(t, err)
+
+	reader := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "existing"},
+	}).Build()
+
+	writeKey(redisServer, "default/existing")
+	writeKey(redisServer, "default/orphaned")
+	// keys of other applications and the controller's own bookkeeping are never touched
+	redisServer.HSet("unrelated", "foo", "bar")
+	redisServer.Set("configmap-controller:lease:default/orphaned", "replica")
+
+	return redisServer, NewOrphanCollector(&OrphanCollectorOptions{
+		Backend:     redis.NewRedisBackend(&redis.RedisBackendOptions{Redis: redisConnection}),
+		Reader:      reader,
+		GracePeriod: gracePeriod,
+		Policy:      keyPolicy,
+		DryRun:      dryRun,
+	})
+}
+
+func TestOrphanCollectorDeletesOrphans(t *testing.T) {
+	redisServer, collector := newTestCollector(t, "delete", 0, false)
+
+	require.NoError(t, collector.Collect(context.Background()))
+	assert.Equal(t, float64(1), testutil.ToFloat64(orphanedKeys))
+	assert.False(t, redisServer.Exists("default/orphaned"))
+	assert.True(t, redisServer.Exists("default/existing"))
+	assert.True(t, redisServer.Exists("unrelated"))
+	assert.True(t, redisServer.Exists("configmap-controller:lease:default/orphaned"))
+
+	require.NoError(t, collector.Collect(context.Background()))
+	assert.Equal(t, float64(0), testutil.ToFloat64(orphanedKeys))
+}
+
+func TestOrphanCollectorWaitsForGracePeriod(t *testing.T) {
+	redisServer, collector := newTestCollector(t, "expire:1h", time.Hour, false)
+
+	require.NoError(t, collector.Collect(context.Background()))
+	assert.Equal(t, float64(1), testutil.ToFloat64(orphanedKeys))
+	assert.Zero(t, redisServer.TTL("default/orphaned"))
+
+	// pretend the key was found an hour ago
+	collector.orphans["default/orphaned"] = time.Now().Add(-time.Hour)
+	require.NoError(t, collector.Collect(context.Background()))
+	assert.Equal(t, time.Hour, redisServer.TTL("default/orphaned"))
+	assert.Zero(t, redisServer.TTL("default/existing"))
+}
+
+func TestOrphanCollectorDryRun(t *testing.T) {
+	redisServer, collector := newTestCollector(t, "delete", 0, true)
+
+	require.NoError(t, collector.Collect(context.Background()))
+	assert.Equal(t, float64(1), testutil.ToFloat64(orphanedKeys))
+	assert.True(t, redisServer.Exists("default/orphaned"))
+}
+
+func TestOrphanCollectorUsesKeyTemplate(t *testing.T) {
+	redisServer, collector := newTestCollector(t, "delete", 0, false)
+	keyNaming, err := configmap.NewKeyNaming(&configmap.KeyNamingOptions{
+		Prefix:   "cfg:",
+		Template: "{{.Cluster}}:{{.Namespace}}:{{.Name}}",
+		Cluster:  "prod",
+	})
+	require.NoError(t, err)
+	collector.options.KeyNaming = keyNaming
+
+	writeKey(redisServer, "cfg:prod:default:existing")
+	writeKey(redisServer, "cfg:prod:default:orphaned")
+	writeKey(redisServer, "cfg:staging:default:orphaned")
+
+	require.NoError(t, collector.Collect(context.Background()))
+	assert.True(t, redisServer.Exists("cfg:prod:default:existing"))
+	assert.False(t, redisServer.Exists("cfg:prod:default:orphaned"))
+	// keys of other clusters and of the default template are out of scope
+	assert.True(t, redisServer.Exists("cfg:staging:default:orphaned"))
+	assert.True(t, redisServer.Exists("default/orphaned"))
+}
+
+func TestOrphanCollectorMultiCluster(t *testing.T) {
+	redisServer, collector := newTestCollector(t, "delete", 0, false)
+	keyNaming, err := configmap.NewKeyNaming(&configmap.KeyNamingOptions{
+		Cluster:      "prod",
+		Scope:        configmap.ClusterScope,
+		MultiCluster: true,
+	})
+	require.NoError(t, err)
+	collector.options.KeyNaming = keyNaming
+
+	writeKey(redisServer, "prod/default/existing")
+	writeKey(redisServer, "prod/default/orphaned")
+	writeKey(redisServer, "staging/default/orphaned")
+
+	require.NoError(t, collector.Collect(context.Background()))
+	assert.True(t, redisServer.Exists("prod/default/existing"))
+	assert.False(t, redisServer.Exists("prod/default/orphaned"))
+	// shared keys may belong to ConfigMaps of other clusters
+	assert.True(t, redisServer.Exists("default/orphaned"))
+	assert.True(t, redisServer.Exists("staging/default/orphaned"))
+}
+
+func TestOrphanCollectorKeepsKeysOfOtherClusters(t *testing.T) {
+	redisServer, collector := newTestCollector(t, "delete", 0, false)
+	keyNaming, err := configmap.NewKeyNaming(&configmap.KeyNamingOptions{
+		Cluster: "prod",
+		Scope:   configmap.ClusterScope,
+	})
+	require.NoError(t, err)
+	collector.options.KeyNaming = keyNaming
+
+	writeKey(redisServer, "prod/default/orphaned")
+	writeKey(redisServer, "staging/default/existing")
+	writeKey(redisServer, "staging/default/orphaned")
+
+	require.NoError(t, collector.Collect(context.Background()))
+	assert.False(t, redisServer.Exists("prod/default/orphaned"))
+	assert.False(t, redisServer.Exists("default/orphaned"))
+	// the shared pattern */* matches the keys of the staging cluster as well
+	assert.True(t, redisServer.Exists("staging/default/existing"))
+	assert.True(t, redisServer.Exists("staging/default/orphaned"))
+
+	// a cluster without name only collects shared keys
+	collector.options.KeyNaming = nil
+	writeKey(redisServer, "default/orphaned")
+	require.NoError(t, collector.Collect(context.Background()))
+	assert.False(t, redisServer.Exists("default/orphaned"))
+	assert.True(t, redisServer.Exists("staging/default/orphaned"))
+}
+
+func TestOrphanCollectorSharding(t *testing.T) {
+	redisServer, collector := newTestCollector(t, "delete", 0, false)
+	keyNaming, err := configmap.NewKeyNaming(&configmap.KeyNamingOptions{Template: "cfg:{{.Namespace}}:{{.Name}}"})
+	require.NoError(t, err)
+	collector.options.KeyNaming = keyNaming
+
+	redisPort, err := strconv.Atoi(redisServer.Port())
+	require.NoError(t, err)
+	redisConnection, err := redis.NewRedisConnection(&redis.RedisConnectionOptions{
+		Host: redisServer.Host(),
+		Port: redisPort,
+	})
+	require.NoError(t, err)
+	t.Cleanup(redisConnection.Close)
+
+	newShardManager := func(replicaID string) *sharding.ShardManager {
+		shardManager := sharding.NewShardManager(&sharding.ShardManagerOptions{
+			Redis:             redisConnection,
+			ReplicaID:         replicaID,
+			HeartbeatInterval: 50 * time.Millisecond,
+			MemberTTL:         500 * time.Millisecond,
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			assert.NoError(t, shardManager.Start(ctx))
+			close(done)
+		}()
+		t.Cleanup(func() {
+			cancel()
+			<-done
+		})
+		return shardManager
+	}
+	replicaA, replicaB := newShardManager("replica-a"), newShardManager("replica-b")
+
+	names := []string{}
+	for i := 0; i < 20; i++ {
+		names = append(names, fmt.Sprintf("default/orphaned-%d", i))
+		writeKey(redisServer, fmt.Sprintf("cfg:default:orphaned-%d", i))
+	}
+	require.Eventually(t, func() bool {
+		ownedByA := 0
+		for _, name := range names {
+			if replicaA.Owns(name) == replicaB.Owns(name) {
+				return false
+			}
+			if replicaA.Owns(name) {
+				ownedByA++
+			}
+		}
+		return ownedByA > 0 && ownedByA < len(names)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the replica synchronizing a ConfigMap collects its key
+	collector.options.Sharding = replicaA
+	require.NoError(t, collector.Collect(context.Background()))
+	for i, name := range names {
+		assert.Equal(t, replicaA.Owns(name), !redisServer.Exists(fmt.Sprintf("cfg:default:orphaned-%d", i)), name)
+	}
+
+	collector.options.Sharding = replicaB
+	require.NoError(t, collector.Collect(context.Background()))
+	for i := range names {
+		assert.False(t, redisServer.Exists(fmt.Sprintf("cfg:default:orphaned-%d", i)))
+	}
+}
+
+func TestOrphanCollectorKeepsForeignKeys(t *testing.T) {
+	redisServer, collector := newTestCollector(t, "delete", 0, false)
+
+	// application keys sharing the database match the pattern */* as well
+	redisServer.HSet("team/app-config", "foo", "bar")
+	// the ConfigMap bound to the key by annotation is gone, the key does not trace back to a ConfigMap
+	writeKey(redisServer, "legacy/App_Settings")
+
+	require.NoError(t, collector.Collect(context.Background()))
+	assert.False(t, redisServer.Exists("default/orphaned"))
+	assert.True(t, redisServer.Exists("team/app-config"))
+	assert.True(t, redisServer.Exists("legacy/App_Settings"))
+	assert.True(t, redisServer.Exists("unrelated"))
+}
@@ -0,0 +1,22 @@
+package gc
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	orphanedKeys = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "configmap_controller_orphaned_redis_keys",
+		Help: "Number of redis keys without ConfigMap found by the last garbage collection run",
+	})
+
+	removedKeys = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "configmap_controller_orphaned_redis_keys_removed_total",
+		Help: "Number of orphaned redis keys deleted or expired by the garbage collector",
+	}, []string{"action"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(orphanedKeys, removedKeys)
+}
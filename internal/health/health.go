@@ -0,0 +1,49 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// ProgressReporter is implemented by components running a loop that is expected to make steady progress
+type ProgressReporter interface {
+	CheckProgress(threshold time.Duration) error
+}
+
+// Pinger is implemented by the connections to redis and the storage backends
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// NewPingChecker reports ready as long as the connection answers a ping within the given timeout
+func NewPingChecker(connection Pinger, timeout time.Duration) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		return connection.Ping(ctx)
+	}
+}
+
+// NewCacheSyncChecker reports ready once the informer cache has synced
+func NewCacheSyncChecker(informerCache cache.Cache, timeout time.Duration) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		if !informerCache.WaitForCacheSync(ctx) {
+			return errors.New("informer cache not synced")
+		}
+		return nil
+	}
+}
+
+// NewProgressChecker reports alive as long as the reporter made progress within the given threshold
+func NewProgressChecker(reporter ProgressReporter, threshold time.Duration) healthz.Checker {
+	return func(_ *http.Request) error {
+		return reporter.CheckProgress(threshold)
+	}
+}
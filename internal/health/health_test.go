@@ -0,0 +1,92 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+
+	"github.com/mxcd/configmap-controller/internal/redis"
+)
+
+type progressReporterFunc func(threshold time.Duration) error
+
+func (f progressReporterFunc) CheckProgress(threshold time.Duration) error {
+	return f(threshold)
+}
+
+// fakeCache only implements WaitForCacheSync, the checker uses nothing else
+type fakeCache struct {
+	cache.Cache
+	waitForCacheSync func(ctx context.Context) bool
+}
+
+func (c *fakeCache) WaitForCacheSync(ctx context.Context) bool {
+	return c.waitForCacheSync(ctx)
+}
+
+func TestPingChecker(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	redisPort, err := strconv.Atoi(redisServer.Port())
+	require.NoError(t, err)
+	redisConnection, err := redis.NewRedisConnection(&redis.RedisConnectionOptions{
+		Host: redisServer.Host(),
+		Port: redisPort,
+	})
+	require.NoError(t, err)
+	defer redisConnection.Close()
+
+	checker := NewPingChecker(redisConnection, time.Second)
+	assert.NoError(t, checker(httptest.NewRequest("GET", "/readyz", nil)))
+
+	redisServer.Close()
+	assert.Error(t, checker(httptest.NewRequest("GET", "/readyz", nil)))
+}
+
+func TestProgressChecker(t *testing.T) {
+	var lastThreshold time.Duration
+	stalled := false
+	checker := NewProgressChecker(progressReporterFunc(func(threshold time.Duration) error {
+		lastThreshold = threshold
+		if stalled {
+			return errors.New("stalled")
+		}
+		return nil
+	}), 30*time.Second)
+
+	assert.NoError(t, checker(httptest.NewRequest("GET", "/healthz", nil)))
+	assert.Equal(t, 30*time.Second, lastThreshold)
+
+	stalled = true
+	assert.Error(t, checker(httptest.NewRequest("GET", "/healthz", nil)))
+}
+
+func TestCacheSyncChecker(t *testing.T) {
+	synced := false
+	checker := NewCacheSyncChecker(&fakeCache{waitForCacheSync: func(ctx context.Context) bool {
+		return synced
+	}}, time.Second)
+
+	assert.Error(t, checker(httptest.NewRequest("GET", "/readyz", nil)))
+
+	synced = true
+	assert.NoError(t, checker(httptest.NewRequest("GET", "/readyz", nil)))
+}
+
+func TestCacheSyncCheckerTimeout(t *testing.T) {
+	checker := NewCacheSyncChecker(&fakeCache{waitForCacheSync: func(ctx context.Context) bool {
+		<-ctx.Done()
+		return false
+	}}, 50*time.Millisecond)
+
+	start := time.Now()
+	assert.Error(t, checker(httptest.NewRequest("GET", "/readyz", nil)))
+	assert.Less(t, time.Since(start), time.Second)
+}
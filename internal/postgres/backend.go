@@ -0,0 +1,394 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/log"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+)
+
+type PostgresBackendOptions struct {
+	Postgres *PostgresConnection
+	// name of the data table, the metadata table gets the suffix _meta. Empty uses configmap_data.
+	Table string
+	// watch keys with LISTEN, otherwise they are polled
+	Listen bool
+}
+
+// PostgresBackend stores every field of a key as a row (namespace, name, key, value, revision, updated_at).
+// Keys are split into namespace and name at the first slash, keys without a slash have an empty namespace.
+// Writes are transactions locking the key's metadata row. Keys are watched through LISTEN/NOTIFY triggers on
+// the data table. Expiring keys are hidden once expired and removed by List.
+type PostgresBackend struct {
+	connection *PostgresConnection
+	table      string
+	listen     bool
+
+	lock *sync.Mutex
+	// stops the listening connection, nil if it is not running
+	stopListening context.CancelFunc
+	watchers      map[string]map[chan struct{}]bool
+}
+
+func NewPostgresBackend(options *PostgresBackendOptions) (*PostgresBackend, error) {
+	table := options.Table
+	if table == "" {
+		table = "configmap_data"
+	}
+	err := validateTable(table)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresBackend{
+		connection: options.Postgres,
+		table:      table,
+		listen:     options.Listen,
+		lock:       &sync.Mutex{},
+		watchers:   make(map[string]map[chan struct{}]bool),
+	}, nil
+}
+
+// splitKey returns the namespace and name columns of a key
+func splitKey(key string) (string, string) {
+	namespace, name, found := strings.Cut(key, "/")
+	if !found {
+		return "", key
+	}
+	return namespace, name
+}
+
+func joinKey(namespace string, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+// stored is a key read within a transaction
+type stored struct {
+	entry *backend.Entry
+	// the key has a metadata row and it expired
+	expired bool
+}
+
+// read reads the metadata and the rows of a key, locking them for the rest of the transaction if lock is set
+func (b *PostgresBackend) read(ctx context.Context, tx pgx.Tx, namespace string, name string, lock bool) (*stored, error) {
+	suffix := ""
+	if lock {
+		suffix = " FOR UPDATE"
+	}
+
+	entry := &backend.Entry{Data: map[string]string{}, Owners: map[string]string{}}
+	hasMeta, expired := true, false
+	err := tx.QueryRow(ctx,
+		"SELECT owners, coalesce(expires_at <= now(), false) FROM "+b.table+"_meta WHERE namespace = $1 AND name = $2"+suffix,
+		namespace, name).Scan(&entry.Owners, &expired)
+	if errors.Is(err, pgx.ErrNoRows) {
+		hasMeta = false
+	} else if err != nil {
+		return nil, err
+	}
+	if expired {
+		return &stored{expired: true}, nil
+	}
+
+	rows, err := tx.Query(ctx,
+		"SELECT key, value FROM "+b.table+" WHERE namespace = $1 AND name = $2"+suffix,
+		namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	var field, value string
+	_, err = pgx.ForEachRow(rows, []any{&field, &value}, func() error {
+		entry.Data[field] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !hasMeta && len(entry.Data) == 0 {
+		return &stored{}, nil
+	}
+	return &stored{entry: entry}, nil
+}
+
+func (b *PostgresBackend) Get(ctx context.Context, key string) (*backend.Entry, error) {
+	namespace, name := splitKey(key)
+	var entry *backend.Entry
+	err := pgx.BeginTxFunc(ctx, b.connection.Pool, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+		stored, err := b.read(ctx, tx, namespace, name, false)
+		if err != nil {
+			return err
+		}
+		entry = stored.entry
+		return nil
+	})
+	return entry, err
+}
+
+func (b *PostgresBackend) Put(ctx context.Context, key string, owner string, data map[string]string, protected []string) ([]string, error) {
+	namespace, name := splitKey(key)
+	var conflicts []string
+	err := pgx.BeginFunc(ctx, b.connection.Pool, func(tx pgx.Tx) error {
+		// the metadata row serializes the writers of the key
+		_, err := tx.Exec(ctx,
+			"INSERT INTO "+b.table+"_meta (namespace, name) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			namespace, name)
+		if err != nil {
+			return err
+		}
+		stored, err := b.read(ctx, tx, namespace, name, true)
+		if err != nil {
+			return err
+		}
+		if stored.expired {
+			// an expired key is written anew
+			err = b.purge(ctx, tx, namespace, name)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, "INSERT INTO "+b.table+"_meta (namespace, name) VALUES ($1, $2)", namespace, name)
+			if err != nil {
+				return err
+			}
+			stored.entry = &backend.Entry{Data: map[string]string{}, Owners: map[string]string{}}
+		}
+
+		previous := maps.Clone(stored.entry.Data)
+		conflicts = backend.ApplyPut(stored.entry, owner, data, protected)
+		return b.write(ctx, tx, namespace, name, previous, stored.entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(conflicts)
+	return conflicts, nil
+}
+
+// write stores the changes of the entry's fields since previous and the owners
+func (b *PostgresBackend) write(ctx context.Context, tx pgx.Tx, namespace string, name string, previous map[string]string, entry *backend.Entry) error {
+	removed := []string{}
+	for field := range previous {
+		if _, ok := entry.Data[field]; !ok {
+			removed = append(removed, field)
+		}
+	}
+	changedFields, changedValues := []string{}, []string{}
+	for field, value := range entry.Data {
+		if previousValue, ok := previous[field]; !ok || previousValue != value {
+			changedFields = append(changedFields, field)
+			changedValues = append(changedValues, value)
+		}
+	}
+
+	if len(removed) > 0 {
+		_, err := tx.Exec(ctx,
+			"DELETE FROM "+b.table+" WHERE namespace = $1 AND name = $2 AND key = ANY($3)",
+			namespace, name, removed)
+		if err != nil {
+			return err
+		}
+	}
+	if len(changedFields) > 0 {
+		_, err := tx.Exec(ctx,
+			"INSERT INTO "+b.table+" (namespace, name, key, value) SELECT $1, $2, unnest($3::text[]), unnest($4::text[]) "+
+				"ON CONFLICT (namespace, name, key) DO UPDATE SET value = EXCLUDED.value WHERE "+b.table+".value <> EXCLUDED.value",
+			namespace, name, changedFields, changedValues)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(ctx,
+		"UPDATE "+b.table+"_meta SET owners = $3 WHERE namespace = $1 AND name = $2",
+		namespace, name, entry.Owners)
+	return err
+}
+
+// purge removes the rows and the metadata of a key
+func (b *PostgresBackend) purge(ctx context.Context, tx pgx.Tx, namespace string, name string) error {
+	_, err := tx.Exec(ctx, "DELETE FROM "+b.table+" WHERE namespace = $1 AND name = $2", namespace, name)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, "DELETE FROM "+b.table+"_meta WHERE namespace = $1 AND name = $2", namespace, name)
+	return err
+}
+
+func (b *PostgresBackend) Delete(ctx context.Context, key string, owner string, policy *backend.KeyPolicy) error {
+	namespace, name := splitKey(key)
+	return pgx.BeginFunc(ctx, b.connection.Pool, func(tx pgx.Tx) error {
+		stored, err := b.read(ctx, tx, namespace, name, true)
+		if err != nil {
+			return err
+		}
+		if stored.expired {
+			return b.purge(ctx, tx, namespace, name)
+		}
+		entry := stored.entry
+		if entry == nil {
+			return nil
+		}
+
+		owners := maps.Clone(entry.Owners)
+		if backend.ReleaseFields(owners, owner) {
+			return b.applyKeyPolicy(ctx, tx, namespace, name, policy)
+		}
+		if !slices.Contains(slices.Collect(maps.Values(entry.Owners)), owner) {
+			return nil
+		}
+
+		previous := maps.Clone(entry.Data)
+		if policy.Action == backend.KeyPolicyDelete {
+			// putting no fields removes all fields of the owner
+			backend.ApplyPut(entry, owner, map[string]string{}, nil)
+		} else if policy.Action == backend.KeyPolicyExpire {
+			log.Warn().Str("name", owner).Str("key", key).Msg("shared postgres key can not expire, keeping fields")
+		}
+		entry.Owners = owners
+		return b.write(ctx, tx, namespace, name, previous, entry)
+	})
+}
+
+// applyKeyPolicy keeps, deletes or expires the rows of a key. Kept keys lose their metadata,
+// expiring keys keep their time to live.
+func (b *PostgresBackend) applyKeyPolicy(ctx context.Context, tx pgx.Tx, namespace string, name string, policy *backend.KeyPolicy) error {
+	var err error
+	switch policy.Action {
+	case backend.KeyPolicyDelete:
+		err = b.purge(ctx, tx, namespace, name)
+	case backend.KeyPolicyExpire:
+		_, err = tx.Exec(ctx,
+			"INSERT INTO "+b.table+"_meta (namespace, name, expires_at) VALUES ($1, $2, now() + make_interval(secs => $3)) "+
+				"ON CONFLICT (namespace, name) DO UPDATE SET owners = '{}', "+
+				"expires_at = coalesce("+b.table+"_meta.expires_at, EXCLUDED.expires_at)",
+			namespace, name, policy.TTL.Seconds())
+	default:
+		_, err = tx.Exec(ctx, "DELETE FROM "+b.table+"_meta WHERE namespace = $1 AND name = $2", namespace, name)
+	}
+	return err
+}
+
+// Watch registers the key with the listening connection, which is started by the first watch. All watches
+// are closed if the connection breaks. It returns nil if listening is disabled.
+func (b *PostgresBackend) Watch(ctx context.Context, key string) (<-chan struct{}, error) {
+	if !b.listen {
+		return nil, nil
+	}
+	key = joinKey(splitKey(key))
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.stopListening == nil {
+		conn, err := b.connection.connect(ctx)
+		if err != nil {
+			return nil, err
+		}
+		_, err = conn.Exec(ctx, "LISTEN "+b.table)
+		if err != nil {
+			conn.Close(context.Background())
+			return nil, err
+		}
+		listenCtx, cancel := context.WithCancel(context.Background())
+		b.stopListening = cancel
+		go b.receive(listenCtx, conn)
+	}
+
+	changes := make(chan struct{}, 1)
+	if b.watchers[key] == nil {
+		b.watchers[key] = make(map[chan struct{}]bool)
+	}
+	b.watchers[key][changes] = true
+
+	context.AfterFunc(ctx, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if !b.watchers[key][changes] {
+			// closed by a broken connection
+			return
+		}
+		delete(b.watchers[key], changes)
+		if len(b.watchers[key]) == 0 {
+			delete(b.watchers, key)
+		}
+		close(changes)
+		if len(b.watchers) == 0 {
+			b.stopListening()
+			b.stopListening = nil
+		}
+	})
+	return changes, nil
+}
+
+// receive dispatches the notifications of the listening connection until ctx is cancelled or it breaks
+func (b *PostgresBackend) receive(ctx context.Context, conn *pgx.Conn) {
+	defer conn.Close(context.Background())
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		b.lock.Lock()
+		if ctx.Err() != nil {
+			b.lock.Unlock()
+			return
+		}
+		if err != nil {
+			log.Warn().Err(err).Msg("postgres listen connection broken, closing watches")
+			for _, watchers := range b.watchers {
+				for changes := range watchers {
+					close(changes)
+				}
+			}
+			b.watchers = make(map[string]map[chan struct{}]bool)
+			b.stopListening()
+			b.stopListening = nil
+			b.lock.Unlock()
+			return
+		}
+		for changes := range b.watchers[notification.Payload] {
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+		b.lock.Unlock()
+	}
+}
+
+// List returns the keys with metadata, keys never written by the controller are not listed.
+// Expired keys are removed first.
+func (b *PostgresBackend) List(ctx context.Context, pattern string) ([]string, error) {
+	matches := backend.PatternMatcher(pattern)
+	keys := []string{}
+	err := pgx.BeginFunc(ctx, b.connection.Pool, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx,
+			"WITH expired AS (DELETE FROM "+b.table+"_meta WHERE expires_at <= now() RETURNING namespace, name) "+
+				"DELETE FROM "+b.table+" USING expired WHERE "+b.table+".namespace = expired.namespace AND "+b.table+".name = expired.name")
+		if err != nil {
+			return fmt.Errorf("unable to remove expired keys: %w", err)
+		}
+
+		rows, err := tx.Query(ctx, "SELECT namespace, name FROM "+b.table+"_meta ORDER BY namespace, name")
+		if err != nil {
+			return err
+		}
+		var namespace, name string
+		_, err = pgx.ForEachRow(rows, []any{&namespace, &name}, func() error {
+			if key := joinKey(namespace, name); matches(key) {
+				keys = append(keys, key)
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
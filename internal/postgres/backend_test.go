@@ -0,0 +1,231 @@
+package postgres
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+)
+
+// testURL is the database of the tests, an embedded postgres unless POSTGRES_TEST_URL is set.
+// It stays empty if there is no database, skipReason tells why.
+var (
+	testURL    string
+	skipReason = "no postgres in short mode"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	flag.Parse()
+	testURL = os.Getenv("POSTGRES_TEST_URL")
+	if testURL != "" || testing.Short() {
+		return m.Run()
+	}
+
+	url, stop, err := startEmbeddedPostgres()
+	if err != nil {
+		// e.g. offline, the binaries can not be downloaded. The tests that need a database are skipped.
+		skipReason = fmt.Sprintf("unable to start embedded postgres, set POSTGRES_TEST_URL: %v", err)
+		fmt.Fprintln(os.Stderr, skipReason)
+		return m.Run()
+	}
+	defer stop()
+
+	testURL = url
+	return m.Run()
+}
+
+// startEmbeddedPostgres starts a postgres on a free port and returns its URL and a function stopping it
+func startEmbeddedPostgres() (string, func(), error) {
+	// the binaries are downloaded once and cached in the user's home directory
+	runtimePath, err := os.MkdirTemp("", "configmap-controller-postgres")
+	if err != nil {
+		return "", nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.RemoveAll(runtimePath)
+		return "", nil, err
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	postgresConfig := embeddedpostgres.DefaultConfig().
+		Version(embeddedpostgres.V16).
+		Port(uint32(port)).
+		RuntimePath(runtimePath).
+		Logger(io.Discard)
+	database := embeddedpostgres.NewDatabase(postgresConfig)
+	err = database.Start()
+	if err != nil {
+		os.RemoveAll(runtimePath)
+		return "", nil, err
+	}
+
+	stop := func() {
+		database.Stop()
+		os.RemoveAll(runtimePath)
+	}
+	return postgresConfig.GetConnectionURL() + "?sslmode=disable", stop, nil
+}
+
+// newTestPostgres creates a table of its own for the test. Tests without a database are skipped.
+func newTestPostgres(t *testing.T) *PostgresBackend {
+	if testURL == "" {
+		t.Skip(skipReason)
+	}
+	connection, err := NewPostgresConnection(&PostgresConnectionOptions{URL: testURL})
+	require.NoError(t, err)
+	t.Cleanup(connection.Close)
+
+	table := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	postgresBackend, err := NewPostgresBackend(&PostgresBackendOptions{Postgres: connection, Table: table, Listen: true})
+	require.NoError(t, err)
+	require.NoError(t, postgresBackend.CreateSchema(context.Background()))
+	t.Cleanup(func() {
+		_, err := connection.Pool.Exec(context.Background(), fmt.Sprintf(
+			"DROP TABLE %[1]s, %[1]s_meta; DROP SEQUENCE %[1]s_revision; DROP FUNCTION %[1]s_revision, %[1]s_notify", table))
+		assert.NoError(t, err)
+	})
+	return postgresBackend
+}
+
+func TestSplitKey(t *testing.T) {
+	namespace, name := splitKey("default/app")
+	assert.Equal(t, "default", namespace)
+	assert.Equal(t, "app", name)
+	assert.Equal(t, "default/app", joinKey(namespace, name))
+
+	namespace, name = splitKey("prod/default/app")
+	assert.Equal(t, "prod", namespace)
+	assert.Equal(t, "default/app", name)
+
+	namespace, name = splitKey("app")
+	assert.Equal(t, "", namespace)
+	assert.Equal(t, "app", joinKey(namespace, name))
+}
+
+func TestNewPostgresBackendTable(t *testing.T) {
+	postgresBackend, err := NewPostgresBackend(&PostgresBackendOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "configmap_data", postgresBackend.table)
+
+	for _, table := range []string{"ConfigMaps", "config; DROP TABLE x", "1config", strings.Repeat("a", 51)} {
+		_, err = NewPostgresBackend(&PostgresBackendOptions{Table: table})
+		assert.Error(t, err, table)
+	}
+}
+
+func TestPostgresBackendOwnership(t *testing.T) {
+	postgresBackend := newTestPostgres(t)
+	ctx := context.Background()
+
+	entry, err := postgresBackend.Get(ctx, "default/app")
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+
+	conflicts, err := postgresBackend.Put(ctx, "default/app", "default/first", map[string]string{"a": "1", "shared": "first"}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, conflicts)
+	conflicts, err = postgresBackend.Put(ctx, "default/app", "default/second", map[string]string{"b": "2", "shared": "second"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"shared"}, conflicts)
+
+	// stale fields of the owner are removed, protected ones are kept
+	_, err = postgresBackend.Put(ctx, "default/app", "default/first", map[string]string{"a": "3"}, []string{"shared"})
+	require.NoError(t, err)
+	entry, err = postgresBackend.Get(ctx, "default/app")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "3", "b": "2", "shared": "first"}, entry.Data)
+	assert.Equal(t, map[string]string{"a": "default/first", "b": "default/second", "shared": "default/first"}, entry.Owners)
+
+	// every changed row gets a new revision
+	var revisionA, revisionB int64
+	err = postgresBackend.connection.Pool.QueryRow(ctx, fmt.Sprintf(
+		"SELECT (SELECT revision FROM %[1]s WHERE key = 'a'), (SELECT revision FROM %[1]s WHERE key = 'b')", postgresBackend.table),
+	).Scan(&revisionA, &revisionB)
+	require.NoError(t, err)
+	assert.Greater(t, revisionA, revisionB)
+
+	// an empty ConfigMap is known to exist
+	_, err = postgresBackend.Put(ctx, "default/empty", "default/empty", map[string]string{}, nil)
+	require.NoError(t, err)
+	entry, err = postgresBackend.Get(ctx, "default/empty")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{}, entry.Data)
+}
+
+func TestPostgresBackendDelete(t *testing.T) {
+	postgresBackend := newTestPostgres(t)
+	ctx := context.Background()
+
+	_, err := postgresBackend.Put(ctx, "shared", "default/first", map[string]string{"a": "1"}, nil)
+	require.NoError(t, err)
+	_, err = postgresBackend.Put(ctx, "shared", "default/second", map[string]string{"b": "2"}, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, postgresBackend.Delete(ctx, "shared", "default/second", &backend.KeyPolicy{Action: backend.KeyPolicyDelete}))
+	entry, err := postgresBackend.Get(ctx, "shared")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "1"}, entry.Data)
+	assert.Equal(t, map[string]string{"a": "default/first"}, entry.Owners)
+
+	require.NoError(t, postgresBackend.Delete(ctx, "shared", "default/first", &backend.KeyPolicy{Action: backend.KeyPolicyExpire, TTL: time.Second}))
+	keys, err := postgresBackend.List(ctx, "*")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"shared"}, keys)
+
+	// expired keys are hidden and removed by List
+	assert.Eventually(t, func() bool {
+		entry, err := postgresBackend.Get(ctx, "shared")
+		return err == nil && entry == nil
+	}, 5*time.Second, 100*time.Millisecond)
+	keys, err = postgresBackend.List(ctx, "*")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	var rows int
+	err = postgresBackend.connection.Pool.QueryRow(ctx, "SELECT count(*) FROM "+postgresBackend.table).Scan(&rows)
+	require.NoError(t, err)
+	assert.Zero(t, rows)
+}
+
+func TestPostgresBackendWatch(t *testing.T) {
+	postgresBackend := newTestPostgres(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	changes, err := postgresBackend.Watch(ctx, "default/app")
+	require.NoError(t, err)
+	// a row written by another application
+	_, err = postgresBackend.connection.Pool.Exec(context.Background(),
+		"INSERT INTO "+postgresBackend.table+" (namespace, name, key, value) VALUES ('default', 'app', 'foo', 'bar')")
+	require.NoError(t, err)
+
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change notification")
+	}
+
+	cancel()
+	assert.Eventually(t, func() bool {
+		_, ok := <-changes
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+	postgresBackend.lock.Lock()
+	defer postgresBackend.lock.Unlock()
+	assert.Nil(t, postgresBackend.stopListening)
+}
@@ -0,0 +1,84 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// table names are used unquoted in statements and as the notification channel
+var tablePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,49}$`)
+
+// schemaTemplate creates the data table, the metadata table of the controller and the triggers. Every
+// change of a row, also by other writers, gets a new revision and notifies the channel named like the table.
+const schemaTemplate = `
+CREATE SEQUENCE IF NOT EXISTS %[1]s_revision;
+
+CREATE TABLE IF NOT EXISTS %[1]s (
+	namespace  text        NOT NULL,
+	name       text        NOT NULL,
+	key        text        NOT NULL,
+	value      text        NOT NULL,
+	revision   bigint      NOT NULL,
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (namespace, name, key)
+);
+
+CREATE TABLE IF NOT EXISTS %[1]s_meta (
+	namespace  text        NOT NULL,
+	name       text        NOT NULL,
+	owners     jsonb       NOT NULL DEFAULT '{}',
+	expires_at timestamptz,
+	PRIMARY KEY (namespace, name)
+);
+
+CREATE OR REPLACE FUNCTION %[1]s_revision() RETURNS trigger AS $$
+BEGIN
+	NEW.revision := nextval('%[1]s_revision');
+	NEW.updated_at := now();
+	RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION %[1]s_notify() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP IN ('UPDATE', 'DELETE') THEN
+		PERFORM pg_notify('%[1]s', CASE WHEN OLD.namespace = '' THEN OLD.name ELSE OLD.namespace || '/' || OLD.name END);
+	END IF;
+	IF TG_OP IN ('INSERT', 'UPDATE') THEN
+		PERFORM pg_notify('%[1]s', CASE WHEN NEW.namespace = '' THEN NEW.name ELSE NEW.namespace || '/' || NEW.name END);
+	END IF;
+	RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS %[1]s_revision ON %[1]s;
+CREATE TRIGGER %[1]s_revision BEFORE INSERT OR UPDATE ON %[1]s
+	FOR EACH ROW EXECUTE FUNCTION %[1]s_revision();
+
+DROP TRIGGER IF EXISTS %[1]s_notify ON %[1]s;
+CREATE TRIGGER %[1]s_notify AFTER INSERT OR UPDATE OR DELETE ON %[1]s
+	FOR EACH ROW EXECUTE FUNCTION %[1]s_notify();
+`
+
+func validateTable(table string) error {
+	if !tablePattern.MatchString(table) {
+		return fmt.Errorf("invalid postgres table name %q, expected up to 50 lowercase letters, digits and underscores", table)
+	}
+	return nil
+}
+
+// CreateSchema creates or updates the tables and triggers of the backend. Replicas starting at the
+// same time are serialized by an advisory lock.
+func (b *PostgresBackend) CreateSchema(ctx context.Context) error {
+	return pgx.BeginFunc(ctx, b.connection.Pool, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", b.table)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, fmt.Sprintf(schemaTemplate, b.table))
+		return err
+	})
+}
@@ -0,0 +1,180 @@
+package redis
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+)
+
+const scanBatchSize = 500
+
+type RedisBackendOptions struct {
+	Redis *RedisConnection
+	// layout of the keys, nil uses HashLayout
+	StorageLayout StorageLayout
+}
+
+// RedisBackend stores every ConfigMap key in a redis key of its storage layout. Redis keys are polled.
+type RedisBackend struct {
+	connection *RedisConnection
+	layout     StorageLayout
+}
+
+func NewRedisBackend(options *RedisBackendOptions) *RedisBackend {
+	layout := options.StorageLayout
+	if layout == nil {
+		layout = HashLayout
+	}
+	return &RedisBackend{connection: options.Redis, layout: layout}
+}
+
+// WithLayout implements backend.LayoutBackend
+func (b *RedisBackend) WithLayout(name string) (backend.Backend, error) {
+	layout, err := ParseStorageLayout(name)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisBackend{connection: b.connection, layout: layout}, nil
+}
+
+func (b *RedisBackend) Get(ctx context.Context, key string) (*backend.Entry, error) {
+	data, err := b.layout.Read(ctx, b.connection.Client, key)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	owners, err := b.connection.Client.HGetAll(ctx, OwnersKey(key)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return &backend.Entry{Data: data, Owners: owners}, nil
+}
+
+func (b *RedisBackend) Put(ctx context.Context, key string, owner string, data map[string]string, protected []string) ([]string, error) {
+	return b.layout.Write(ctx, b.connection.Client, key, owner, data, protected)
+}
+
+func (b *RedisBackend) Delete(ctx context.Context, key string, owner string, policy *backend.KeyPolicy) error {
+	client := b.connection.Client
+	owners, err := client.HGetAll(ctx, OwnersKey(key)).Result()
+	if err != nil {
+		return err
+	}
+	ownFields := []string{}
+	for field, fieldOwner := range owners {
+		if fieldOwner == owner {
+			ownFields = append(ownFields, field)
+		}
+	}
+
+	if backend.ReleaseFields(owners, owner) {
+		err = b.applyKeyPolicy(ctx, key, policy)
+		if err != nil {
+			return err
+		}
+		for _, bookkeepingKey := range []string{OwnersKey(key), MetaKey(key)} {
+			if policy.Action == backend.KeyPolicyExpire {
+				err = b.applyKeyPolicy(ctx, bookkeepingKey, policy)
+			} else {
+				err = client.Del(ctx, bookkeepingKey).Err()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(ownFields) == 0 {
+		return nil
+	}
+	if policy.Action == backend.KeyPolicyDelete {
+		// writing no fields removes all fields of the owner
+		_, err = b.layout.Write(ctx, client, key, owner, map[string]string{}, nil)
+		if err != nil {
+			return err
+		}
+	} else if policy.Action == backend.KeyPolicyExpire {
+		log.Warn().Str("name", owner).Str("key", key).Msg("shared redis key can not expire, keeping fields")
+	}
+	return client.HDel(ctx, OwnersKey(key), ownFields...).Err()
+}
+
+// Watch implements backend.Backend, redis keys are polled
+func (b *RedisBackend) Watch(_ context.Context, _ string) (<-chan struct{}, error) {
+	return nil, nil
+}
+
+// List scans the keys of all storage layouts. Only keys with a metadata hash were written by the controller,
+// other keys sharing the database are left out.
+func (b *RedisBackend) List(ctx context.Context, pattern string) ([]string, error) {
+	keys := []string{}
+	for _, keyType := range storageLayoutTypes() {
+		var cursor uint64
+		for {
+			batch, nextCursor, err := b.connection.Client.ScanType(ctx, cursor, pattern, scanBatchSize, keyType).Result()
+			if err != nil {
+				return nil, err
+			}
+			batch = slices.DeleteFunc(batch, func(key string) bool {
+				return strings.HasPrefix(key, ControllerKeyPrefix)
+			})
+			written, err := b.withMetadata(ctx, batch)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, written...)
+
+			cursor = nextCursor
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return keys, nil
+}
+
+// withMetadata returns the keys that have a metadata hash
+func (b *RedisBackend) withMetadata(ctx context.Context, keys []string) ([]string, error) {
+	if len(keys) == 0 {
+		return keys, nil
+	}
+	pipeline := b.connection.Client.Pipeline()
+	results := make([]*goredis.IntCmd, len(keys))
+	for i, key := range keys {
+		results[i] = pipeline.Exists(ctx, MetaKey(key))
+	}
+	_, err := pipeline.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	written := []string{}
+	for i, key := range keys {
+		if results[i].Val() > 0 {
+			written = append(written, key)
+		}
+	}
+	return written, nil
+}
+
+// applyKeyPolicy keeps, deletes or expires the key according to the policy. An expiring key keeps its time to live.
+func (b *RedisBackend) applyKeyPolicy(ctx context.Context, key string, policy *backend.KeyPolicy) error {
+	client := b.connection.Client
+	switch policy.Action {
+	case backend.KeyPolicyDelete:
+		return client.Del(ctx, key).Err()
+	case backend.KeyPolicyExpire:
+		ttl, err := client.TTL(ctx, key).Result()
+		if err != nil || ttl > 0 {
+			return err
+		}
+		return client.Expire(ctx, key, policy.TTL).Err()
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,94 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *RedisConnection) {
+	redisServer := miniredis.RunT(t)
+	redisPort, err := strconv.Atoi(redisServer.Port())
+	require.NoError(t, err)
+	redisConnection, err := NewRedisConnection(&RedisConnectionOptions{
+		Host: redisServer.Host(),
+		Port: redisPort,
+	})
+	require.NoError(t, err)
+	t.Cleanup(redisConnection.Close)
+	return redisServer, redisConnection
+}
+
+func TestRedisBackendDelete(t *testing.T) {
+	redisServer, redisConnection := newTestRedis(t)
+	redisBackend := NewRedisBackend(&RedisBackendOptions{Redis: redisConnection})
+	ctx := context.Background()
+
+	_, err := redisBackend.Put(ctx, "shared", "default/first", map[string]string{"a": "1"}, nil)
+	require.NoError(t, err)
+	_, err = redisBackend.Put(ctx, "shared", "default/second", map[string]string{"b": "2"}, nil)
+	require.NoError(t, err)
+	_, err = redisBackend.Put(ctx, "single", "default/first", map[string]string{"a": "1"}, nil)
+	require.NoError(t, err)
+
+	// shared keys never expire
+	expire := &backend.KeyPolicy{Action: backend.KeyPolicyExpire, TTL: time.Hour}
+	require.NoError(t, redisBackend.Delete(ctx, "shared", "default/second", expire))
+	assert.Zero(t, redisServer.TTL("shared"))
+	assert.Equal(t, "2", redisServer.HGet("shared", "b"))
+	assert.Equal(t, "", redisServer.HGet(OwnersKey("shared"), "b"))
+
+	require.NoError(t, redisBackend.Delete(ctx, "single", "default/first", expire))
+	assert.Equal(t, time.Hour, redisServer.TTL("single"))
+	assert.Equal(t, time.Hour, redisServer.TTL(MetaKey("single")))
+	// an expiring key keeps its time to live
+	redisServer.FastForward(time.Minute)
+	require.NoError(t, redisBackend.Delete(ctx, "single", "", expire))
+	assert.Equal(t, 59*time.Minute, redisServer.TTL("single"))
+
+	_, err = redisBackend.Put(ctx, "shared", "default/second", map[string]string{"b": "2"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, redisBackend.Delete(ctx, "shared", "default/second", &backend.KeyPolicy{Action: backend.KeyPolicyDelete}))
+	assert.Equal(t, "", redisServer.HGet("shared", "b"))
+	assert.Equal(t, "1", redisServer.HGet("shared", "a"))
+
+	require.NoError(t, redisBackend.Delete(ctx, "shared", "", &backend.KeyPolicy{Action: backend.KeyPolicyDelete}))
+	assert.False(t, redisServer.Exists("shared"))
+	assert.False(t, redisServer.Exists(OwnersKey("shared")))
+	assert.False(t, redisServer.Exists(MetaKey("shared")))
+}
+
+func TestRedisBackendList(t *testing.T) {
+	redisServer, redisConnection := newTestRedis(t)
+	redisBackend := NewRedisBackend(&RedisBackendOptions{Redis: redisConnection})
+	jsonBackend, err := redisBackend.WithLayout("json")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	_, err = redisBackend.Put(ctx, "default/hash", "default/hash", map[string]string{"a": "1"}, nil)
+	require.NoError(t, err)
+	_, err = jsonBackend.Put(ctx, "default/json", "default/json", map[string]string{"a": "1"}, nil)
+	require.NoError(t, err)
+	redisServer.Set("configmap-controller:lease:default/hash", "replica")
+	redisServer.HSet("unrelated", "a", "1")
+	// keys of other applications have no metadata hash
+	redisServer.HSet("team/app-config", "a", "1")
+
+	keys, err := redisBackend.List(ctx, "*/*")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"default/hash", "default/json"}, keys)
+
+	entry, err := jsonBackend.Get(ctx, "default/json")
+	require.NoError(t, err)
+	assert.Equal(t, &backend.Entry{Data: map[string]string{"a": "1"}, Owners: map[string]string{"a": "default/json"}}, entry)
+
+	_, err = redisBackend.WithLayout("xml")
+	assert.Error(t, err)
+}
@@ -0,0 +1,75 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+)
+
+const (
+	// metadata field of the cluster whose push changed the key last
+	originField = "origin"
+	// prefix of the metadata fields holding the backend.ClusterStatus of each cluster
+	clusterFieldPrefix = "cluster:"
+)
+
+// the status is only recorded while the key exists, it must not resurrect a deleted key
+var recordSyncScript = goredis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+if ARGV[3] ~= '' then
+	redis.call('HSET', KEYS[1], '` + originField + `', ARGV[3])
+end
+return 1
+`)
+
+// RecordSync implements backend.ClusterBackend, the status is stored in the key's metadata hash
+func (b *RedisBackend) RecordSync(ctx context.Context, key string, cluster string, status *backend.ClusterStatus) error {
+	encoded, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	origin := ""
+	if status.Action == backend.SyncPush {
+		origin = cluster
+	}
+	return recordSyncScript.Run(ctx, b.connection.Client, []string{MetaKey(key)}, clusterFieldPrefix+cluster, encoded, origin).Err()
+}
+
+// Origin implements backend.ClusterBackend
+func (b *RedisBackend) Origin(ctx context.Context, key string) (string, error) {
+	origin, err := b.connection.Client.HGet(ctx, MetaKey(key), originField).Result()
+	if err == goredis.Nil {
+		return "", nil
+	}
+	return origin, err
+}
+
+// ClusterStatuses returns the status of each cluster that synchronized the key
+func (b *RedisBackend) ClusterStatuses(ctx context.Context, key string) (map[string]*backend.ClusterStatus, error) {
+	meta, err := b.connection.Client.HGetAll(ctx, MetaKey(key)).Result()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[string]*backend.ClusterStatus)
+	for field, value := range meta {
+		cluster, ok := strings.CutPrefix(field, clusterFieldPrefix)
+		if !ok {
+			continue
+		}
+		status := &backend.ClusterStatus{}
+		err = json.Unmarshal([]byte(value), status)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status of cluster %q: %w", cluster, err)
+		}
+		statuses[cluster] = status
+	}
+	return statuses, nil
+}
@@ -0,0 +1,45 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+)
+
+func TestRedisBackendRecordSync(t *testing.T) {
+	redisServer, redisConnection := newTestRedis(t)
+	redisBackend := NewRedisBackend(&RedisBackendOptions{Redis: redisConnection})
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	// nothing is recorded for missing keys
+	require.NoError(t, redisBackend.RecordSync(ctx, "default/app", "eu", &backend.ClusterStatus{Action: backend.SyncPush, Time: now}))
+	assert.False(t, redisServer.Exists(MetaKey("default/app")))
+
+	_, err := redisBackend.Put(ctx, "default/app", "default/app", map[string]string{"a": "1"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, redisBackend.RecordSync(ctx, "default/app", "eu", &backend.ClusterStatus{Action: backend.SyncPush, Hash: "01", Time: now}))
+	require.NoError(t, redisBackend.RecordSync(ctx, "default/app", "us", &backend.ClusterStatus{Action: backend.SyncPull, Hash: "01", Time: now}))
+
+	// a pull does not change the origin
+	origin, err := redisBackend.Origin(ctx, "default/app")
+	require.NoError(t, err)
+	assert.Equal(t, "eu", origin)
+	statuses, err := redisBackend.ClusterStatuses(ctx, "default/app")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*backend.ClusterStatus{
+		"eu": {Action: backend.SyncPush, Hash: "01", Time: now},
+		"us": {Action: backend.SyncPull, Hash: "01", Time: now},
+	}, statuses)
+	// the metadata still tells the layout
+	assert.Equal(t, "hash", redisServer.HGet(MetaKey("default/app"), "layout"))
+
+	origin, err = redisBackend.Origin(ctx, "default/other")
+	require.NoError(t, err)
+	assert.Empty(t, origin)
+}
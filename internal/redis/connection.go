@@ -1,12 +1,16 @@
 package redis
 
 import (
+	"context"
 	"fmt"
 
-	"github.com/mxcd/go-config/config"
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
 )
 
+// ControllerKeyPrefix is the prefix of all keys the controller uses for its own bookkeeping
+const ControllerKeyPrefix = "configmap-controller:"
+
 type RedisConnection struct {
 	Client *redis.Client
 }
@@ -20,25 +24,30 @@ type RedisConnectionOptions struct {
 }
 
 func NewRedisConnection(options *RedisConnectionOptions) (*RedisConnection, error) {
-	redisHost := config.Get().String("REDIS_HOST")
-	redisPort := config.Get().Int("REDIS_PORT")
-	redisPassword := config.Get().String("REDIS_PASSWORD")
-	redisDatabaseIndex := config.Get().Int("REDIS_DATABASE_INDEX")
-
-	redisAddress := fmt.Sprintf("%s:%d", redisHost, redisPort)
+	redisAddress := fmt.Sprintf("%s:%d", options.Host, options.Port)
 
 	redisConnection := &RedisConnection{
 		// TODO: add support for sentinel
-		// TODO: add support for OTEL
 		Client: redis.NewClient(&redis.Options{
 			Addr:     redisAddress,
-			Password: redisPassword,
-			DB:       redisDatabaseIndex,
+			Password: options.Password,
+			DB:       options.DatabaseIndex,
 		}),
 	}
+
+	err := redisotel.InstrumentTracing(redisConnection.Client)
+	if err != nil {
+		redisConnection.Close()
+		return nil, err
+	}
+
 	return redisConnection, nil
 }
 
 func (c *RedisConnection) Close() {
 	c.Client.Close()
 }
+
+func (c *RedisConnection) Ping(ctx context.Context) error {
+	return c.Client.Ping(ctx).Err()
+}
@@ -0,0 +1,289 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+)
+
+const (
+	ownersKeyBase = ControllerKeyPrefix + "owners:"
+	metaKeyBase   = ControllerKeyPrefix + "meta:"
+	// written by earlier versions to keep the hash of an empty ConfigMap, removed on the next write
+	legacyEmptyField = "_empty"
+)
+
+// StorageLayout stores the fields of a ConfigMap in a redis key. The field owners are tracked in a
+// companion hash, the ownership rules are the same for all layouts. The key's metadata hash records
+// the layout, so that the key of an empty ConfigMap is known to exist even if the layout can not represent it.
+type StorageLayout interface {
+	Name() string
+	// RedisType is the type reported by the TYPE command for keys of the layout
+	RedisType() string
+	// Read returns the fields of the key, nil if the key was never written
+	Read(ctx context.Context, client *goredis.Client, key string) (map[string]string, error)
+	// Write writes the fields owned by or free for owner and removes its stale fields except for
+	// the protected ones. It returns the fields owned by other ConfigMaps.
+	Write(ctx context.Context, client *goredis.Client, key string, owner string, data map[string]string, protected []string) ([]string, error)
+}
+
+var (
+	HashLayout      StorageLayout = &scriptLayout{name: "hash", redisType: "hash", script: newWriteScript(hashLayoutScript), read: readHash}
+	JSONLayout      StorageLayout = &scriptLayout{name: "json", redisType: "string", script: newWriteScript(jsonLayoutScript), read: readJSON}
+	RedisJSONLayout StorageLayout = &scriptLayout{name: "redisjson", redisType: "ReJSON-RL", script: newWriteScript(redisJSONLayoutScript), read: readRedisJSON}
+)
+
+var storageLayouts = []StorageLayout{HashLayout, JSONLayout, RedisJSONLayout}
+
+// ParseStorageLayout returns the layout with the given name, hash if the name is empty
+func ParseStorageLayout(name string) (StorageLayout, error) {
+	if name == "" {
+		return HashLayout, nil
+	}
+	for _, layout := range storageLayouts {
+		if layout.Name() == name {
+			return layout, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown storage layout %q, expected hash, json or redisjson", name)
+}
+
+// storageLayoutTypes returns the redis types of all storage layouts
+func storageLayoutTypes() []string {
+	types := make([]string, 0, len(storageLayouts))
+	for _, layout := range storageLayouts {
+		types = append(types, layout.RedisType())
+	}
+	return types
+}
+
+// OwnersKey returns the key of the hash that tracks the field owners of a redis key
+func OwnersKey(key string) string {
+	return ownersKeyBase + key
+}
+
+// MetaKey returns the key of the hash that holds the metadata of a redis key
+func MetaKey(key string) string {
+	return metaKeyBase + key
+}
+
+type scriptLayout struct {
+	name      string
+	redisType string
+	script    *goredis.Script
+	read      func(ctx context.Context, client *goredis.Client, key string) (map[string]string, error)
+}
+
+func (l *scriptLayout) Name() string {
+	return l.name
+}
+
+func (l *scriptLayout) RedisType() string {
+	return l.redisType
+}
+
+func (l *scriptLayout) Read(ctx context.Context, client *goredis.Client, key string) (map[string]string, error) {
+	data, err := l.read(ctx, client, key)
+	if err != nil || data != nil {
+		return data, err
+	}
+
+	// the key of an empty ConfigMap may not exist, the metadata tells it was written
+	exists, err := client.Exists(ctx, MetaKey(key)).Result()
+	if err != nil || exists == 0 {
+		return nil, err
+	}
+	return map[string]string{}, nil
+}
+
+func (l *scriptLayout) Write(ctx context.Context, client *goredis.Client, key string, owner string, data map[string]string, protected []string) ([]string, error) {
+	args := make([]interface{}, 0, 3+2*len(data)+len(protected))
+	args = append(args, l.name, owner, len(data))
+	for field, value := range data {
+		args = append(args, field, value)
+	}
+	for _, field := range protected {
+		args = append(args, field)
+	}
+
+	conflicts, err := l.script.Run(ctx, client, []string{key, OwnersKey(key), MetaKey(key)}, args...).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(conflicts)
+	return conflicts, nil
+}
+
+func readHash(ctx context.Context, client *goredis.Client, key string) (map[string]string, error) {
+	data, err := client.HGetAll(ctx, key).Result()
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	delete(data, legacyEmptyField)
+	return data, nil
+}
+
+func readJSON(ctx context.Context, client *goredis.Client, key string) (map[string]string, error) {
+	document, err := client.Get(ctx, key).Result()
+	if errors.Is(err, goredis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return backend.DecodeJSONFields([]byte(document))
+}
+
+func readRedisJSON(ctx context.Context, client *goredis.Client, key string) (map[string]string, error) {
+	document, err := client.Do(ctx, "JSON.GET", key).Text()
+	if errors.Is(err, goredis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return backend.DecodeJSONFields([]byte(document))
+}
+
+// The write script implements the field ownership, the layouts provide reading the fields into the
+// table fields as well as setting, removing and finally storing them. KEYS are the data, owners and
+// metadata keys, ARGV the layout name, the owner, the number of field/value pairs, the pairs and
+// the protected fields.
+const writeScriptTemplate = `
+local owner = ARGV[2]
+local pairsEnd = 3 + 2 * tonumber(ARGV[3])
+local desired = {}
+for i = 4, pairsEnd, 2 do
+	desired[ARGV[i]] = ARGV[i + 1]
+end
+local protected = {}
+for i = pairsEnd + 1, #ARGV do
+	protected[ARGV[i]] = true
+end
+
+local owners = {}
+local sole = true
+local ownerEntries = redis.call('HGETALL', KEYS[2])
+for i = 1, #ownerEntries, 2 do
+	owners[ownerEntries[i]] = ownerEntries[i + 1]
+	if ownerEntries[i + 1] ~= owner then
+		sole = false
+	end
+end
+
+local fields = {}
+local changed = false
+{{read}}
+
+local stale = {}
+for field, _ in pairs(fields) do
+	local fieldOwner = owners[field]
+	if desired[field] == nil and not protected[field] and (fieldOwner == owner or (fieldOwner == nil and sole)) then
+		table.insert(stale, field)
+	end
+end
+for _, field in ipairs(stale) do
+	{{remove}}
+	fields[field] = nil
+	changed = true
+	redis.call('HDEL', KEYS[2], field)
+end
+
+local conflicts = {}
+for field, value in pairs(desired) do
+	local fieldOwner = owners[field]
+	if fieldOwner ~= nil and fieldOwner ~= owner then
+		table.insert(conflicts, field)
+	else
+		if fields[field] ~= value then
+			{{set}}
+			fields[field] = value
+			changed = true
+		end
+		redis.call('HSET', KEYS[2], field, owner)
+	end
+end
+
+{{store}}
+redis.call('HSET', KEYS[3], 'layout', ARGV[1])
+return conflicts
+`
+
+func newWriteScript(layout map[string]string) *goredis.Script {
+	script := writeScriptTemplate
+	for _, part := range []string{"read", "remove", "set", "store"} {
+		script = strings.ReplaceAll(script, "{{"+part+"}}", layout[part])
+	}
+	return goredis.NewScript(script)
+}
+
+var hashLayoutScript = map[string]string{
+	"read": `
+local entries = redis.call('HGETALL', KEYS[1])
+for i = 1, #entries, 2 do
+	fields[entries[i]] = entries[i + 1]
+end
+fields['` + legacyEmptyField + `'] = nil
+redis.call('HDEL', KEYS[1], '` + legacyEmptyField + `')`,
+	"remove": `redis.call('HDEL', KEYS[1], field)`,
+	"set":    `redis.call('HSET', KEYS[1], field, value)`,
+	"store":  ``,
+}
+
+// encodes the fields as json object with sorted keys
+const encodeFieldsFunction = `
+local function encodeFields(fields)
+	local names = {}
+	for name, _ in pairs(fields) do
+		table.insert(names, name)
+	end
+	table.sort(names)
+	local members = {}
+	for _, name in ipairs(names) do
+		table.insert(members, cjson.encode(name) .. ':' .. cjson.encode(fields[name]))
+	end
+	return '{' .. table.concat(members, ',') .. '}'
+end`
+
+var jsonLayoutScript = map[string]string{
+	"read": encodeFieldsFunction + `
+local document = redis.call('GET', KEYS[1])
+if document then
+	fields = cjson.decode(document)
+	if type(fields) ~= 'table' then
+		return redis.error_reply('redis key does not hold a json object')
+	end
+end`,
+	"remove": ``,
+	"set":    ``,
+	"store": `
+if changed or not document then
+	redis.call('SET', KEYS[1], encodeFields(fields))
+end`,
+}
+
+var redisJSONLayoutScript = map[string]string{
+	"read": `
+local function path(field)
+	local escaped = string.gsub(field, '[\\"]', '\\%0')
+	return '$["' .. escaped .. '"]'
+end
+local document = redis.call('JSON.GET', KEYS[1])
+if document then
+	fields = cjson.decode(document)
+	if type(fields) ~= 'table' then
+		return redis.error_reply('redis key does not hold a json object')
+	end
+else
+	redis.call('JSON.SET', KEYS[1], '$', '{}')
+end`,
+	"remove": `redis.call('JSON.DEL', KEYS[1], path(field))`,
+	"set":    `redis.call('JSON.SET', KEYS[1], path(field), cjson.encode(value))`,
+	"store":  ``,
+}
@@ -0,0 +1,133 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// registerFakeRedisJSON adds the subset of the RedisJSON commands used by RedisJSONLayout to miniredis.
+// Documents live outside of the miniredis keyspace.
+func registerFakeRedisJSON(t *testing.T, redisServer *miniredis.Miniredis) {
+	documents := map[string]map[string]interface{}{}
+	lock := &sync.Mutex{}
+
+	member := func(path string) (string, bool) {
+		quoted, ok := strings.CutPrefix(path, "$[")
+		if !ok {
+			return "", false
+		}
+		var field string
+		err := json.Unmarshal([]byte(strings.TrimSuffix(quoted, "]")), &field)
+		return field, err == nil
+	}
+
+	require.NoError(t, redisServer.Server().Register("JSON.GET", func(c *server.Peer, cmd string, args []string) {
+		lock.Lock()
+		defer lock.Unlock()
+		document, ok := documents[args[0]]
+		if !ok {
+			c.WriteNull()
+			return
+		}
+		data, _ := json.Marshal(document)
+		c.WriteBulk(string(data))
+	}))
+	require.NoError(t, redisServer.Server().Register("JSON.SET", func(c *server.Peer, cmd string, args []string) {
+		lock.Lock()
+		defer lock.Unlock()
+		var value interface{}
+		if json.Unmarshal([]byte(args[2]), &value) != nil {
+			c.WriteError("ERR invalid json")
+			return
+		}
+		if args[1] == "$" {
+			documents[args[0]] = value.(map[string]interface{})
+			c.WriteOK()
+			return
+		}
+		field, ok := member(args[1])
+		if !ok || documents[args[0]] == nil {
+			c.WriteError("ERR invalid path")
+			return
+		}
+		documents[args[0]][field] = value
+		c.WriteOK()
+	}))
+	require.NoError(t, redisServer.Server().Register("JSON.DEL", func(c *server.Peer, cmd string, args []string) {
+		lock.Lock()
+		defer lock.Unlock()
+		field, ok := member(args[1])
+		if !ok {
+			c.WriteError("ERR invalid path")
+			return
+		}
+		delete(documents[args[0]], field)
+		c.WriteInt(1)
+	}))
+}
+
+func TestStorageLayouts(t *testing.T) {
+	for _, layout := range []StorageLayout{HashLayout, JSONLayout, RedisJSONLayout} {
+		t.Run(layout.Name(), func(t *testing.T) {
+			redisServer, redisConnection := newTestRedis(t)
+			registerFakeRedisJSON(t, redisServer)
+			client := redisConnection.Client
+			ctx := context.Background()
+
+			data, err := layout.Read(ctx, client, "app")
+			require.NoError(t, err)
+			assert.Nil(t, data)
+
+			conflicts, err := layout.Write(ctx, client, "app", "default/first", map[string]string{"a": "1", "shared": "first"}, nil)
+			require.NoError(t, err)
+			assert.Empty(t, conflicts)
+			conflicts, err = layout.Write(ctx, client, "app", "default/second", map[string]string{"b": "2", "shared": "second"}, nil)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"shared"}, conflicts)
+
+			data, err = layout.Read(ctx, client, "app")
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{"a": "1", "b": "2", "shared": "first"}, data)
+
+			// stale fields of the owner are removed, protected ones are kept
+			_, err = layout.Write(ctx, client, "app", "default/first", map[string]string{"a": "3"}, []string{"shared"})
+			require.NoError(t, err)
+			_, err = layout.Write(ctx, client, "app", "default/second", map[string]string{}, nil)
+			require.NoError(t, err)
+			data, err = layout.Read(ctx, client, "app")
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{"a": "3", "shared": "first"}, data)
+			assert.Equal(t, layout.Name(), redisServer.HGet(MetaKey("app"), "layout"))
+
+			// an empty ConfigMap is known to exist
+			_, err = layout.Write(ctx, client, "empty", "default/empty", map[string]string{}, nil)
+			require.NoError(t, err)
+			data, err = layout.Read(ctx, client, "empty")
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{}, data)
+		})
+	}
+}
+
+func TestHashLayoutRemovesLegacyEmptyField(t *testing.T) {
+	redisServer, redisConnection := newTestRedis(t)
+	redisServer.HSet("app", legacyEmptyField, "")
+
+	data, err := HashLayout.Read(context.Background(), redisConnection.Client, "app")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{}, data)
+
+	_, err = HashLayout.Write(context.Background(), redisConnection.Client, "app", "default/app", map[string]string{"a": "1"}, nil)
+	require.NoError(t, err)
+	fields, err := redisServer.HKeys("app")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, fields)
+}
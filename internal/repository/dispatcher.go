@@ -0,0 +1,192 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const DefaultListenerQueueSize = 1000
+
+type ListenerOptions struct {
+	// maximum number of elements with pending events. Notify blocks while the queue is full.
+	QueueSize int
+	// optional, restricts the events passed to the listener
+	Filter *EventFilter
+	// optional, unique name of the listener in metrics and logs. Defaults to the listener type and ID.
+	Name string
+}
+
+type queuedEvent[K any] struct {
+	ctx   context.Context
+	event *RepositoryEvent[K]
+}
+
+// listenerQueue decouples a listener from Notify. Pending events are coalesced per element
+// so that the listener only sees the latest event of an element, in order of first arrival.
+type listenerQueue[K any] struct {
+	id       ListenerID
+	listener RepositoryEventListener[K]
+	name     string
+	size     int
+	filter   *EventFilter
+	closed   bool
+	pending  map[types.NamespacedName]*queuedEvent[K]
+	order    []types.NamespacedName
+	lock     *sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+}
+
+func newListenerQueue[K any](id ListenerID, listener RepositoryEventListener[K], options *ListenerOptions) *listenerQueue[K] {
+	size := DefaultListenerQueueSize
+	var filter *EventFilter
+	// listeners of the same type must not share their metrics, closing one would delete the other's
+	name := fmt.Sprintf("%T/%d", listener, id)
+	if options != nil {
+		if options.QueueSize > 0 {
+			size = options.QueueSize
+		}
+		filter = options.Filter
+		if options.Name != "" {
+			name = options.Name
+		}
+	}
+
+	lock := &sync.Mutex{}
+	queue := &listenerQueue[K]{
+		id:       id,
+		listener: listener,
+		name:     name,
+		size:     size,
+		filter:   filter,
+		pending:  make(map[types.NamespacedName]*queuedEvent[K]),
+		order:    []types.NamespacedName{},
+		lock:     lock,
+		notEmpty: sync.NewCond(lock),
+		notFull:  sync.NewCond(lock),
+	}
+	queueDepth.WithLabelValues(name).Set(0)
+	go queue.run()
+	return queue
+}
+
+func (q *listenerQueue[K]) enqueue(ctx context.Context, event *RepositoryEvent[K]) {
+	// the event outlives the notifying call, keep its trace but not its cancellation
+	item := &queuedEvent[K]{ctx: context.WithoutCancel(ctx), event: event}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if pending, ok := q.pending[event.Name]; ok {
+		eventsCoalesced.WithLabelValues(q.name).Inc()
+		coalesced := coalesceEvents(pending.event, event)
+		if coalesced != nil {
+			q.pending[event.Name] = &queuedEvent[K]{ctx: item.ctx, event: coalesced}
+			return
+		}
+
+		// the listener never saw the element, drop it entirely
+		delete(q.pending, event.Name)
+		q.order = slices.DeleteFunc(q.order, func(name types.NamespacedName) bool { return name == event.Name })
+		queueDepth.WithLabelValues(q.name).Set(float64(len(q.order)))
+		q.notFull.Signal()
+		return
+	}
+
+	for len(q.order) >= q.size && !q.closed {
+		q.notFull.Wait()
+	}
+	if q.closed {
+		return
+	}
+	q.pending[event.Name] = item
+	q.order = append(q.order, event.Name)
+	queueDepth.WithLabelValues(q.name).Set(float64(len(q.order)))
+	q.notEmpty.Signal()
+}
+
+// close stops the worker and discards pending events
+func (q *listenerQueue[K]) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.pending = make(map[types.NamespacedName]*queuedEvent[K])
+	q.order = []types.NamespacedName{}
+	queueDepth.DeleteLabelValues(q.name)
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+// next blocks until an event is pending. It returns nil once the queue is closed.
+func (q *listenerQueue[K]) next() *queuedEvent[K] {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for len(q.order) == 0 && !q.closed {
+		q.notEmpty.Wait()
+	}
+	if q.closed {
+		return nil
+	}
+	name := q.order[0]
+	q.order = q.order[1:]
+	item := q.pending[name]
+	delete(q.pending, name)
+	queueDepth.WithLabelValues(q.name).Set(float64(len(q.order)))
+	q.notFull.Signal()
+	return item
+}
+
+func (q *listenerQueue[K]) run() {
+	for {
+		item := q.next()
+		if item == nil {
+			return
+		}
+		q.dispatch(item)
+	}
+}
+
+// dispatch hands the event to the listener. A panicking listener is reported and skips the event.
+func (q *listenerQueue[K]) dispatch(item *queuedEvent[K]) {
+	ctx, span := tracer.Start(item.ctx, "RepositoryEventListener.Handle")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("listener", q.name),
+		attribute.String("event.type", string(item.event.Type)),
+	)
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err := fmt.Errorf("listener panicked: %v", recovered)
+			log.Error().Err(err).Str("listener", q.name).Str("name", item.event.Name.String()).Msg("unable to handle repository event")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "listener panicked")
+			listenerPanics.WithLabelValues(q.name).Inc()
+		}
+	}()
+
+	q.listener.Handle(ctx, item.event)
+}
+
+// coalesceEvents merges a pending event with a newer one for the same element.
+// It returns nil if the events cancel each other out.
+func coalesceEvents[K any](pending *RepositoryEvent[K], next *RepositoryEvent[K]) *RepositoryEvent[K] {
+	switch {
+	case pending.Type == RepositoryEventCreated && isRemoval(next.Type):
+		return nil
+	case pending.Type == RepositoryEventCreated:
+		return &RepositoryEvent[K]{Type: RepositoryEventCreated, Name: next.Name, Element: next.Element}
+	case isRemoval(pending.Type) && next.Type == RepositoryEventCreated:
+		return &RepositoryEvent[K]{Type: RepositoryEventUpdated, Name: next.Name, Element: next.Element, Previous: pending.Previous}
+	default:
+		return &RepositoryEvent[K]{Type: next.Type, Name: next.Name, Element: next.Element, Previous: pending.Previous}
+	}
+}
@@ -0,0 +1,202 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type recordingListener struct {
+	events chan *RepositoryEvent[corev1.ConfigMap]
+	handle func(event *RepositoryEvent[corev1.ConfigMap])
+}
+
+func newRecordingListener(handle func(event *RepositoryEvent[corev1.ConfigMap])) *recordingListener {
+	return &recordingListener{
+		events: make(chan *RepositoryEvent[corev1.ConfigMap], 100),
+		handle: handle,
+	}
+}
+
+func (l *recordingListener) Handle(ctx context.Context, event *RepositoryEvent[corev1.ConfigMap]) {
+	if l.handle != nil {
+		l.handle(event)
+	}
+	l.events <- event
+}
+
+func (l *recordingListener) next(t *testing.T) *RepositoryEvent[corev1.ConfigMap] {
+	select {
+	case event := <-l.events:
+		return event
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no event received")
+		return nil
+	}
+}
+
+func newTestEvent(name string, version string) *RepositoryEvent[corev1.ConfigMap] {
+	return &RepositoryEvent[corev1.ConfigMap]{
+		Type: RepositoryEventUpdated,
+		Name: types.NamespacedName{Namespace: "default", Name: name},
+		Element: &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, ResourceVersion: version},
+		},
+	}
+}
+
+func TestListenerQueueCoalescesPendingEvents(t *testing.T) {
+	unblock := make(chan struct{})
+	listener := newRecordingListener(func(event *RepositoryEvent[corev1.ConfigMap]) {
+		if event.Element.ResourceVersion == "0" {
+			<-unblock
+		}
+	})
+	queue := newListenerQueue[corev1.ConfigMap](1, listener, nil)
+
+	queue.enqueue(context.Background(), newTestEvent("a", "0"))
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(queueDepth.WithLabelValues(queue.name)) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// the listener is busy with the first event, the following events pile up
+	queue.enqueue(context.Background(), newTestEvent("a", "1"))
+	queue.enqueue(context.Background(), newTestEvent("b", "1"))
+	queue.enqueue(context.Background(), newTestEvent("a", "2"))
+	assert.Equal(t, float64(2), testutil.ToFloat64(queueDepth.WithLabelValues(queue.name)))
+	close(unblock)
+
+	assert.Equal(t, "0", listener.next(t).Element.ResourceVersion)
+	event := listener.next(t)
+	assert.Equal(t, "a", event.Name.Name)
+	assert.Equal(t, "2", event.Element.ResourceVersion)
+	event = listener.next(t)
+	assert.Equal(t, "b", event.Name.Name)
+	assert.Equal(t, "1", event.Element.ResourceVersion)
+}
+
+func TestListenerQueueRecoversPanics(t *testing.T) {
+	listener := newRecordingListener(func(event *RepositoryEvent[corev1.ConfigMap]) {
+		if event.Name.Name == "panic" {
+			panic("listener failure")
+		}
+	})
+	queue := newListenerQueue[corev1.ConfigMap](2, listener, &ListenerOptions{QueueSize: 1})
+	panicsBefore := testutil.ToFloat64(listenerPanics.WithLabelValues(queue.name))
+
+	queue.enqueue(context.Background(), newTestEvent("panic", "1"))
+	queue.enqueue(context.Background(), newTestEvent("ok", "1"))
+
+	assert.Equal(t, "ok", listener.next(t).Name.Name)
+	assert.Equal(t, panicsBefore+1, testutil.ToFloat64(listenerPanics.WithLabelValues(queue.name)))
+}
+
+func TestListenerQueueCoalescesEventTypes(t *testing.T) {
+	unblock := make(chan struct{})
+	listener := newRecordingListener(func(event *RepositoryEvent[corev1.ConfigMap]) {
+		if event.Name.Name == "block" {
+			<-unblock
+		}
+	})
+	queue := newListenerQueue[corev1.ConfigMap](3, listener, nil)
+	queue.enqueue(context.Background(), newTestEvent("block", "0"))
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(queueDepth.WithLabelValues(queue.name)) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// created and deleted before delivery cancel each other out
+	created := newTestEvent("transient", "1")
+	created.Type = RepositoryEventCreated
+	queue.enqueue(context.Background(), created)
+	queue.enqueue(context.Background(), &RepositoryEvent[corev1.ConfigMap]{
+		Type:     RepositoryEventDeleted,
+		Name:     created.Name,
+		Previous: created.Element,
+	})
+
+	// deleted and re-created becomes an update against the originally deleted element
+	deleted := newTestEvent("recreated", "1")
+	queue.enqueue(context.Background(), &RepositoryEvent[corev1.ConfigMap]{
+		Type:     RepositoryEventDeleted,
+		Name:     deleted.Name,
+		Previous: deleted.Element,
+	})
+	recreated := newTestEvent("recreated", "2")
+	recreated.Type = RepositoryEventCreated
+	queue.enqueue(context.Background(), recreated)
+
+	// updates of a pending created event stay created
+	pendingCreated := newTestEvent("new", "1")
+	pendingCreated.Type = RepositoryEventCreated
+	queue.enqueue(context.Background(), pendingCreated)
+	queue.enqueue(context.Background(), newTestEvent("new", "2"))
+	close(unblock)
+
+	assert.Equal(t, "block", listener.next(t).Name.Name)
+	event := listener.next(t)
+	assert.Equal(t, "recreated", event.Name.Name)
+	assert.Equal(t, RepositoryEventUpdated, event.Type)
+	assert.Equal(t, "1", event.Previous.ResourceVersion)
+	assert.Equal(t, "2", event.Element.ResourceVersion)
+	event = listener.next(t)
+	assert.Equal(t, "new", event.Name.Name)
+	assert.Equal(t, RepositoryEventCreated, event.Type)
+	assert.Nil(t, event.Previous)
+	assert.Equal(t, "2", event.Element.ResourceVersion)
+}
+
+func TestListenerQueueClose(t *testing.T) {
+	listener := newRecordingListener(nil)
+	queue := newListenerQueue[corev1.ConfigMap](4, listener, &ListenerOptions{QueueSize: 1})
+	queue.close()
+
+	queue.enqueue(context.Background(), newTestEvent("a", "1"))
+	queue.enqueue(context.Background(), newTestEvent("b", "1"))
+	select {
+	case <-listener.events:
+		assert.Fail(t, "closed queue delivered an event")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func queueDepthListeners() []string {
+	metrics := make(chan prometheus.Metric, 100)
+	queueDepth.Collect(metrics)
+	close(metrics)
+	listeners := []string{}
+	for metric := range metrics {
+		var written dto.Metric
+		if err := metric.Write(&written); err == nil {
+			listeners = append(listeners, written.GetLabel()[0].GetValue())
+		}
+	}
+	return listeners
+}
+
+func TestListenerQueueMetricsPerListener(t *testing.T) {
+	repository := NewConfigMapRepository()
+	first := repository.AddListener(newRecordingListener(nil), nil)
+	repository.AddListener(newRecordingListener(nil), nil)
+	repository.AddListener(newRecordingListener(nil), &ListenerOptions{Name: "named"})
+	require.Len(t, repository.listeners, 3)
+	removed := repository.listeners[0].name
+	remaining := repository.listeners[1].name
+	assert.NotEqual(t, removed, remaining)
+	assert.Equal(t, "named", repository.listeners[2].name)
+	assert.Contains(t, queueDepthListeners(), removed)
+
+	// removing a listener must keep the series of another listener of the same type
+	repository.RemoveListener(first)
+	listeners := queueDepthListeners()
+	assert.NotContains(t, listeners, removed)
+	assert.Contains(t, listeners, remaining)
+}
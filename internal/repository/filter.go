@@ -0,0 +1,39 @@
+package repository
+
+import (
+	"slices"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// EventFilter restricts the events a listener receives. Unset fields match all events.
+type EventFilter struct {
+	Namespaces    []string
+	LabelSelector labels.Selector
+	EventTypes    []RepositoryEventType
+}
+
+// Matches reports whether the filter accepts the event. The label selector matches if either
+// the current or the previous element matches so that listeners notice elements leaving the selection.
+func (f *EventFilter) Matches(eventType RepositoryEventType, namespace string, objects ...metav1.Object) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.EventTypes) > 0 && !slices.Contains(f.EventTypes, eventType) {
+		return false
+	}
+	if len(f.Namespaces) > 0 && !slices.Contains(f.Namespaces, namespace) {
+		return false
+	}
+	if f.LabelSelector == nil {
+		return true
+	}
+
+	for _, object := range objects {
+		if f.LabelSelector.Matches(labels.Set(object.GetLabels())) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package repository
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "configmap_controller_repository_queue_depth",
+		Help: "Number of elements with pending repository events per listener",
+	}, []string{"listener"})
+
+	eventsCoalesced = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "configmap_controller_repository_events_coalesced_total",
+		Help: "Number of repository events merged into an already pending event",
+	}, []string{"listener"})
+
+	listenerPanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "configmap_controller_repository_listener_panics_total",
+		Help: "Number of repository events that made a listener panic",
+	}, []string{"listener"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(queueDepth, eventsCoalesced, listenerPanics)
+}
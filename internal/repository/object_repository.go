@@ -0,0 +1,189 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+
+	cache "github.com/mxcd/go-cache"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/mxcd/configmap-controller/internal/util"
+)
+
+var tracer = otel.Tracer("github.com/mxcd/configmap-controller/internal/repository")
+
+var ErrNotFound = errors.New("element not found")
+
+// ObjectPointer is the pointer type of a Kubernetes kind, e.g. *corev1.ConfigMap for corev1.ConfigMap
+type ObjectPointer[K any] interface {
+	*K
+	client.Object
+}
+
+// Repository holds the latest known state of Kubernetes objects of kind K and notifies
+// listeners about every change. PK is inferred, e.g. NewRepository[corev1.Secret]().
+type Repository[K any, PK ObjectPointer[K]] struct {
+	kind      string
+	cache     *cache.LocalCache[types.NamespacedName, K]
+	listeners []*listenerQueue[K]
+	// identifies the next added listener
+	nextListenerID ListenerID
+	lock           *sync.RWMutex
+	// serializes cache modifications so that every change yields exactly one consistent event
+	cacheLock *sync.Mutex
+}
+
+func NewRepository[K any, PK ObjectPointer[K]]() *Repository[K, PK] {
+	return &Repository[K, PK]{
+		kind: reflect.TypeFor[K]().Name(),
+		cache: cache.NewLocalCache[types.NamespacedName, K](&cache.LocalCacheOptions[types.NamespacedName]{
+			TTL:      0,
+			Size:     0,
+			CacheKey: &NamespacedNameCacheKey{},
+		}),
+		listeners: []*listenerQueue[K]{},
+		lock:      &sync.RWMutex{},
+		cacheLock: &sync.Mutex{},
+	}
+}
+
+// ListenerID identifies a registered listener. Listeners themselves are not compared, they need not be comparable.
+type ListenerID uint64
+
+// AddListener registers a listener with its own event queue. Options may be nil.
+// The returned ID removes the listener again.
+func (r *Repository[K, PK]) AddListener(listener RepositoryEventListener[K], options *ListenerOptions) ListenerID {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.nextListenerID++
+	r.listeners = append(r.listeners, newListenerQueue(r.nextListenerID, listener, options))
+	return r.nextListenerID
+}
+
+// RemoveListener unregisters the listener with the ID. Events still queued for it are discarded.
+func (r *Repository[K, PK]) RemoveListener(id ListenerID) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i, queue := range r.listeners {
+		if queue.id == id {
+			queue.close()
+			r.listeners = append(r.listeners[:i], r.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+// Notify queues the event for all listeners. It only blocks while a listener queue is full.
+func (r *Repository[K, PK]) Notify(ctx context.Context, event *RepositoryEvent[K]) {
+	ctx, span := tracer.Start(ctx, "Repository.Notify")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("event.type", string(event.Type)),
+		attribute.String("k8s.kind", r.kind),
+		attribute.String("k8s.namespace.name", event.Name.Namespace),
+		attribute.String("k8s.object.name", event.Name.Name),
+	)
+
+	objects := []metav1.Object{}
+	for _, element := range []*K{event.Element, event.Previous} {
+		if element != nil {
+			objects = append(objects, PK(element))
+		}
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, listener := range r.listeners {
+		if listener.filter.Matches(event.Type, event.Name.Namespace, objects...) {
+			listener.enqueue(ctx, event)
+		}
+	}
+}
+
+// Get returns the stored element. It must not be modified.
+func (r *Repository[K, PK]) Get(ctx context.Context, name types.NamespacedName) (*K, error) {
+	log.Trace().Str("kind", r.kind).Msgf("Getting element: %s", util.GetNamespacedNameString(name))
+	element, ok := r.cache.Get(name)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return element, nil
+}
+
+// Set stores a copy of the element and emits a created event for unknown elements
+// or an updated event that carries the previously stored element
+func (r *Repository[K, PK]) Set(ctx context.Context, name types.NamespacedName, element *K) error {
+	log.Trace().Str("kind", r.kind).Msgf("Setting element: %s", util.GetNamespacedNameString(name))
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+
+	event := &RepositoryEvent[K]{
+		Type:    RepositoryEventCreated,
+		Name:    name,
+		Element: element,
+	}
+	if previous, ok := r.cache.Get(name); ok {
+		event.Type = RepositoryEventUpdated
+		event.Previous = previous
+	}
+
+	r.cache.Set(name, *(PK(element).DeepCopyObject().(PK)))
+	r.Notify(ctx, event)
+	return nil
+}
+
+// Remove deletes the element and emits a deleted event that carries the removed element
+func (r *Repository[K, PK]) Remove(ctx context.Context, name types.NamespacedName) error {
+	log.Trace().Str("kind", r.kind).Msgf("Deleting element: %s", util.GetNamespacedNameString(name))
+	return r.remove(ctx, name, RepositoryEventDeleted)
+}
+
+// Release stops tracking an element that still exists and emits a released event that carries the element
+func (r *Repository[K, PK]) Release(ctx context.Context, name types.NamespacedName) error {
+	log.Trace().Str("kind", r.kind).Msgf("Releasing element: %s", util.GetNamespacedNameString(name))
+	return r.remove(ctx, name, RepositoryEventReleased)
+}
+
+func (r *Repository[K, PK]) remove(ctx context.Context, name types.NamespacedName, eventType RepositoryEventType) error {
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+
+	previous, ok := r.cache.Get(name)
+	if !ok {
+		log.Debug().Str("kind", r.kind).Msgf("element not found: %s", util.GetNamespacedNameString(name))
+		return ErrNotFound
+	}
+
+	r.cache.Remove(name)
+	r.Notify(ctx, &RepositoryEvent[K]{
+		Type:     eventType,
+		Name:     name,
+		Previous: previous,
+	})
+
+	return nil
+}
+
+// List returns all stored elements. They must not be modified.
+func (r *Repository[K, PK]) List(ctx context.Context) ([]*K, error) {
+	log.Trace().Str("kind", r.kind).Msg("Listing elements")
+	entries, err := r.cache.Load()
+	if err != nil {
+		log.Error().Err(err).Str("kind", r.kind).Msg("Error loading elements")
+		return nil, err
+	}
+
+	elements := make([]*K, len(entries))
+	for i, entry := range entries {
+		elements[i] = entry.Value
+	}
+
+	return elements, nil
+}
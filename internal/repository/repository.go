@@ -1,6 +1,7 @@
 package repository
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -31,14 +32,26 @@ const (
 	RepositoryEventCreated RepositoryEventType = "created"
 	RepositoryEventUpdated RepositoryEventType = "updated"
 	RepositoryEventDeleted RepositoryEventType = "deleted"
+	// the element still exists but is no longer tracked by the repository
+	RepositoryEventReleased RepositoryEventType = "released"
 )
 
 type RepositoryEvent[K any] struct {
-	Type    RepositoryEventType
-	Name    types.NamespacedName
+	Type RepositoryEventType
+	Name types.NamespacedName
+	// current element, nil for deleted and released events
 	Element *K
+	// element as stored before the change, nil for created events
+	Previous *K
 }
 
+// RepositoryEventListener receives repository events. The passed context carries
+// the trace of the operation that caused the event.
 type RepositoryEventListener[K any] interface {
-	Handle(event *RepositoryEvent[K])
+	Handle(ctx context.Context, event *RepositoryEvent[K])
+}
+
+// isRemoval returns true for events after which the repository no longer holds the element
+func isRemoval(eventType RepositoryEventType) bool {
+	return eventType == RepositoryEventDeleted || eventType == RepositoryEventReleased
 }
@@ -1,9 +1,15 @@
 package repository
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 )
 
@@ -19,3 +25,158 @@ func TestNamespacedNameCacheKey(t *testing.T) {
 	assert.Equal(t, "bar", namespacedName.Name)
 
 }
+
+func newLabeledConfigMap(namespace string, name string, version string, labels map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, ResourceVersion: version, Labels: labels},
+	}
+}
+
+func TestConfigMapRepositoryEvents(t *testing.T) {
+	ctx := context.Background()
+	repository := NewConfigMapRepository()
+	listener := newRecordingListener(nil)
+	repository.AddListener(listener, nil)
+	name := types.NamespacedName{Namespace: "default", Name: "a"}
+
+	require.NoError(t, repository.Set(ctx, name, newLabeledConfigMap("default", "a", "1", nil)))
+	event := listener.next(t)
+	assert.Equal(t, RepositoryEventCreated, event.Type)
+	assert.Equal(t, "1", event.Element.ResourceVersion)
+	assert.Nil(t, event.Previous)
+
+	require.NoError(t, repository.Set(ctx, name, newLabeledConfigMap("default", "a", "2", nil)))
+	event = listener.next(t)
+	assert.Equal(t, RepositoryEventUpdated, event.Type)
+	assert.Equal(t, "2", event.Element.ResourceVersion)
+	assert.Equal(t, "1", event.Previous.ResourceVersion)
+
+	require.NoError(t, repository.Remove(ctx, name))
+	event = listener.next(t)
+	assert.Equal(t, RepositoryEventDeleted, event.Type)
+	assert.Nil(t, event.Element)
+	assert.Equal(t, "2", event.Previous.ResourceVersion)
+
+	assert.Error(t, repository.Remove(ctx, name))
+}
+
+func TestConfigMapRepositoryListenerFilter(t *testing.T) {
+	ctx := context.Background()
+	repository := NewConfigMapRepository()
+	listener := newRecordingListener(nil)
+	repository.AddListener(listener, &ListenerOptions{Filter: &EventFilter{
+		Namespaces:    []string{"apps"},
+		LabelSelector: labels.SelectorFromSet(labels.Set{"sync": "true"}),
+	}})
+
+	selected := map[string]string{"sync": "true"}
+	require.NoError(t, repository.Set(ctx, types.NamespacedName{Namespace: "other", Name: "a"}, newLabeledConfigMap("other", "a", "1", selected)))
+	require.NoError(t, repository.Set(ctx, types.NamespacedName{Namespace: "apps", Name: "b"}, newLabeledConfigMap("apps", "b", "1", nil)))
+	require.NoError(t, repository.Set(ctx, types.NamespacedName{Namespace: "apps", Name: "c"}, newLabeledConfigMap("apps", "c", "1", selected)))
+	event := listener.next(t)
+	assert.Equal(t, "c", event.Name.Name)
+
+	// an element leaving the selection is still reported
+	require.NoError(t, repository.Set(ctx, types.NamespacedName{Namespace: "apps", Name: "c"}, newLabeledConfigMap("apps", "c", "2", nil)))
+	event = listener.next(t)
+	assert.Equal(t, "c", event.Name.Name)
+	assert.Equal(t, "2", event.Element.ResourceVersion)
+
+	filter := &EventFilter{EventTypes: []RepositoryEventType{RepositoryEventDeleted}}
+	assert.False(t, filter.Matches(RepositoryEventCreated, "apps"))
+	assert.True(t, filter.Matches(RepositoryEventDeleted, "apps"))
+	assert.True(t, (*EventFilter)(nil).Matches(RepositoryEventCreated, "apps"))
+}
+
+func TestConfigMapRepositoryRemoveListener(t *testing.T) {
+	ctx := context.Background()
+	repository := NewConfigMapRepository()
+	listener := newRecordingListener(nil)
+	id := repository.AddListener(listener, nil)
+	repository.RemoveListener(id)
+	assert.Empty(t, repository.listeners)
+
+	require.NoError(t, repository.Set(ctx, types.NamespacedName{Namespace: "default", Name: "a"}, newLabeledConfigMap("default", "a", "1", nil)))
+	select {
+	case <-listener.events:
+		assert.Fail(t, "removed listener received an event")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// funcListener is not comparable, removing it must not compare listeners
+type funcListener func(ctx context.Context, event *RepositoryEvent[corev1.ConfigMap])
+
+func (l funcListener) Handle(ctx context.Context, event *RepositoryEvent[corev1.ConfigMap]) {
+	l(ctx, event)
+}
+
+func TestConfigMapRepositoryRemoveNonComparableListener(t *testing.T) {
+	ctx := context.Background()
+	repository := NewConfigMapRepository()
+	kept := make(chan *RepositoryEvent[corev1.ConfigMap], 10)
+	removed := make(chan *RepositoryEvent[corev1.ConfigMap], 10)
+	repository.AddListener(funcListener(func(ctx context.Context, event *RepositoryEvent[corev1.ConfigMap]) {
+		kept <- event
+	}), nil)
+	id := repository.AddListener(funcListener(func(ctx context.Context, event *RepositoryEvent[corev1.ConfigMap]) {
+		removed <- event
+	}), nil)
+	assert.NotPanics(t, func() { repository.RemoveListener(id) })
+	assert.Len(t, repository.listeners, 1)
+
+	require.NoError(t, repository.Set(ctx, types.NamespacedName{Namespace: "default", Name: "a"}, newLabeledConfigMap("default", "a", "1", nil)))
+	select {
+	case <-kept:
+	case <-time.After(time.Second):
+		assert.Fail(t, "remaining listener received no event")
+	}
+	select {
+	case <-removed:
+		assert.Fail(t, "removed listener received an event")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type secretListener struct {
+	events chan *RepositoryEvent[corev1.Secret]
+}
+
+func (l *secretListener) Handle(ctx context.Context, event *RepositoryEvent[corev1.Secret]) {
+	l.events <- event
+}
+
+func TestRepositoryServesOtherKinds(t *testing.T) {
+	ctx := context.Background()
+	repository := NewRepository[corev1.Secret]()
+	listener := &secretListener{events: make(chan *RepositoryEvent[corev1.Secret], 10)}
+	repository.AddListener(listener, nil)
+
+	name := types.NamespacedName{Namespace: "default", Name: "credentials"}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: name.Namespace, Name: name.Name},
+		Data:       map[string][]byte{"password": []byte("secret")},
+	}
+	require.NoError(t, repository.Set(ctx, name, secret))
+
+	select {
+	case event := <-listener.events:
+		assert.Equal(t, RepositoryEventCreated, event.Type)
+		assert.Equal(t, name, event.Name)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no event received")
+	}
+
+	// the repository keeps its own copy
+	secret.Data["password"] = []byte("changed")
+	stored, err := repository.Get(ctx, name)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret"), stored.Data["password"])
+
+	elements, err := repository.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, elements, 1)
+
+	_, err = repository.Get(ctx, types.NamespacedName{Namespace: "default", Name: "missing"})
+	assert.ErrorIs(t, err, ErrNotFound)
+}
@@ -0,0 +1,464 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+)
+
+const (
+	// writes are retried when another writer changed the key in the meantime
+	maxWriteAttempts = 5
+	// error responses are cut in log messages
+	maxErrorBody = 512
+)
+
+const (
+	// LongPollChanges repeats a GET of the changes path with If-None-Match, the service answers once the
+	// ETag of the key differs or with 304 Not Modified after a timeout
+	LongPollChanges = "longpoll"
+	// SSEChanges reads a server-sent event stream from the changes path, every event is a change
+	SSEChanges = "sse"
+)
+
+type RestBackendOptions struct {
+	// e.g. https://config.example.com/api
+	BaseURL string
+	// sent with every request, e.g. Authorization
+	Headers http.Header
+	// path of a key's document below the base url, {key} is replaced by the escaped key.
+	// Empty uses /configmaps/{key}.
+	DataPath string
+	// path returning a json array of all keys, empty uses /configmaps
+	ListPath string
+	// path notifying about changes of a key, {key} is replaced by the escaped key. Empty disables watches.
+	ChangesPath string
+	// LongPollChanges or SSEChanges, empty uses LongPollChanges
+	ChangesMode string
+	// timeout of every request except for watches, zero uses 10s
+	Timeout time.Duration
+	// nil uses http.DefaultClient
+	Client *http.Client
+}
+
+// RestBackend stores every key as a json document in an HTTP service. Writes are read-modify-write cycles
+// guarded by ETag and If-Match, they are retried if the service answers 412 Precondition Failed.
+// Expiring keys are hidden once expired and removed by List.
+type RestBackend struct {
+	baseURL     string
+	headers     http.Header
+	dataPath    string
+	listPath    string
+	changesPath string
+	changesMode string
+	timeout     time.Duration
+	client      *http.Client
+}
+
+// document is the json body of a key
+type document struct {
+	Data      map[string]string `json:"data"`
+	Owners    map[string]string `json:"owners,omitempty"`
+	ExpiresAt *time.Time        `json:"expiresAt,omitempty"`
+}
+
+func NewRestBackend(options *RestBackendOptions) (*RestBackend, error) {
+	_, err := url.Parse(options.BaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base url: %w", err)
+	}
+	changesMode := options.ChangesMode
+	switch changesMode {
+	case "":
+		changesMode = LongPollChanges
+	case LongPollChanges, SSEChanges:
+	default:
+		return nil, fmt.Errorf("unknown changes mode %q, expected longpoll or sse", changesMode)
+	}
+
+	restBackend := &RestBackend{
+		baseURL:     strings.TrimSuffix(options.BaseURL, "/"),
+		headers:     options.Headers,
+		dataPath:    options.DataPath,
+		listPath:    options.ListPath,
+		changesPath: options.ChangesPath,
+		changesMode: changesMode,
+		timeout:     options.Timeout,
+		client:      options.Client,
+	}
+	if restBackend.dataPath == "" {
+		restBackend.dataPath = "/configmaps/{key}"
+	}
+	if restBackend.listPath == "" {
+		restBackend.listPath = "/configmaps"
+	}
+	if restBackend.timeout == 0 {
+		restBackend.timeout = 10 * time.Second
+	}
+	if restBackend.client == nil {
+		restBackend.client = http.DefaultClient
+	}
+	return restBackend, nil
+}
+
+// url returns the url of the path with the key, the segments of the key are escaped separately
+func (b *RestBackend) url(path string, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return b.baseURL + strings.ReplaceAll(path, "{key}", strings.Join(segments, "/"))
+}
+
+func (b *RestBackend) request(ctx context.Context, method string, url string, body []byte, header http.Header) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range b.headers {
+		request.Header[name] = values
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	return b.client.Do(request)
+}
+
+// statusError returns an error with the status and the beginning of the body
+func statusError(method string, url string, response *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(response.Body, maxErrorBody))
+	return fmt.Errorf("%s %s: %s: %s", method, url, response.Status, strings.TrimSpace(string(body)))
+}
+
+// read returns the document of the key and its ETag, nil if the key does not exist
+func (b *RestBackend) read(ctx context.Context, key string) (*document, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+	url := b.url(b.dataPath, key)
+	response, err := b.request(ctx, http.MethodGet, url, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, "", nil
+	default:
+		return nil, "", statusError(http.MethodGet, url, response)
+	}
+	doc := &document{}
+	err = json.NewDecoder(response.Body).Decode(doc)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid document of key %q: %w", key, err)
+	}
+	if doc.Data == nil {
+		doc.Data = map[string]string{}
+	}
+	if doc.Owners == nil {
+		doc.Owners = map[string]string{}
+	}
+	return doc, response.Header.Get("ETag"), nil
+}
+
+// write sends the document with If-Match, or If-None-Match if the key did not exist. It returns false if
+// the key changed since it was read.
+func (b *RestBackend) write(ctx context.Context, key string, etag string, doc *document) (bool, error) {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return false, err
+	}
+	return b.conditional(ctx, http.MethodPut, key, etag, body)
+}
+
+// conditional sends a request guarded by the ETag, it returns false if the precondition failed
+func (b *RestBackend) conditional(ctx context.Context, method string, key string, etag string, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+	header := http.Header{}
+	if etag != "" {
+		header.Set("If-Match", etag)
+	} else {
+		header.Set("If-None-Match", "*")
+	}
+	url := b.url(b.dataPath, key)
+	response, err := b.request(ctx, method, url, body, header)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusPreconditionFailed:
+		return false, nil
+	case method == http.MethodDelete && response.StatusCode == http.StatusNotFound:
+		return true, nil
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return true, nil
+	}
+	return false, statusError(method, url, response)
+}
+
+func expired(doc *document) bool {
+	return doc != nil && doc.ExpiresAt != nil && time.Now().After(*doc.ExpiresAt)
+}
+
+func (b *RestBackend) Get(ctx context.Context, key string) (*backend.Entry, error) {
+	doc, _, err := b.read(ctx, key)
+	if err != nil || doc == nil || expired(doc) {
+		return nil, err
+	}
+	return &backend.Entry{Data: doc.Data, Owners: doc.Owners}, nil
+}
+
+func (b *RestBackend) Put(ctx context.Context, key string, owner string, data map[string]string, protected []string) ([]string, error) {
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		doc, etag, err := b.read(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		changed := doc == nil
+		if doc == nil || expired(doc) {
+			// an expired key is written anew
+			doc = &document{Data: map[string]string{}, Owners: map[string]string{}}
+			changed = true
+		}
+
+		entry := &backend.Entry{Data: maps.Clone(doc.Data), Owners: maps.Clone(doc.Owners)}
+		conflicts := backend.ApplyPut(entry, owner, data, protected)
+		slices.Sort(conflicts)
+		if !changed && maps.Equal(entry.Data, doc.Data) && maps.Equal(entry.Owners, doc.Owners) {
+			return conflicts, nil
+		}
+
+		doc.Data, doc.Owners = entry.Data, entry.Owners
+		written, err := b.write(ctx, key, etag, doc)
+		if err != nil {
+			return nil, err
+		}
+		if written {
+			return conflicts, nil
+		}
+	}
+	return nil, fmt.Errorf("key %q changed concurrently, giving up after %d attempts", key, maxWriteAttempts)
+}
+
+func (b *RestBackend) Delete(ctx context.Context, key string, owner string, policy *backend.KeyPolicy) error {
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		doc, etag, err := b.read(ctx, key)
+		if err != nil || doc == nil {
+			return err
+		}
+		if expired(doc) {
+			_, err = b.conditional(ctx, http.MethodDelete, key, etag, nil)
+			return err
+		}
+
+		owners := maps.Clone(doc.Owners)
+		var written bool
+		if backend.ReleaseFields(owners, owner) {
+			switch policy.Action {
+			case backend.KeyPolicyDelete:
+				written, err = b.conditional(ctx, http.MethodDelete, key, etag, nil)
+			case backend.KeyPolicyExpire:
+				// an expiring key keeps its time to live
+				if doc.ExpiresAt == nil {
+					expiresAt := time.Now().Add(policy.TTL)
+					doc.ExpiresAt = &expiresAt
+				}
+				doc.Owners = map[string]string{}
+				written, err = b.write(ctx, key, etag, doc)
+			default:
+				// kept keys lose their owners
+				if len(doc.Owners) == 0 {
+					return nil
+				}
+				doc.Owners = map[string]string{}
+				written, err = b.write(ctx, key, etag, doc)
+			}
+		} else {
+			if !slices.Contains(slices.Collect(maps.Values(doc.Owners)), owner) {
+				return nil
+			}
+			if policy.Action == backend.KeyPolicyDelete {
+				// putting no fields removes all fields of the owner
+				entry := &backend.Entry{Data: doc.Data, Owners: doc.Owners}
+				backend.ApplyPut(entry, owner, map[string]string{}, nil)
+			} else if policy.Action == backend.KeyPolicyExpire {
+				log.Warn().Str("name", owner).Str("key", key).Msg("shared http key can not expire, keeping fields")
+			}
+			doc.Owners = owners
+			written, err = b.write(ctx, key, etag, doc)
+		}
+		if err != nil || written {
+			return err
+		}
+	}
+	return fmt.Errorf("key %q changed concurrently, giving up after %d attempts", key, maxWriteAttempts)
+}
+
+// Watch follows the changes path of the key, the channel is closed if a request fails or the stream ends.
+// It returns nil if no changes path is configured.
+func (b *RestBackend) Watch(ctx context.Context, key string) (<-chan struct{}, error) {
+	if b.changesPath == "" {
+		return nil, nil
+	}
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer close(changes)
+		var err error
+		if b.changesMode == SSEChanges {
+			err = b.stream(ctx, key, changes)
+		} else {
+			err = b.longPoll(ctx, key, changes)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Debug().Err(err).Str("key", key).Msg("http watch closed")
+		}
+	}()
+	return changes, nil
+}
+
+func notify(changes chan struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
+
+// longPoll polls the changes path until a request fails, every answer with a new ETag is a change
+func (b *RestBackend) longPoll(ctx context.Context, key string, changes chan struct{}) error {
+	url := b.url(b.changesPath, key)
+	etag := ""
+	for {
+		header := http.Header{}
+		if etag != "" {
+			header.Set("If-None-Match", etag)
+		}
+		response, err := b.request(ctx, http.MethodGet, url, nil, header)
+		if err != nil {
+			return err
+		}
+		switch response.StatusCode {
+		case http.StatusNotModified:
+		case http.StatusOK:
+			// a service ignoring If-None-Match would be polled in a busy loop
+			if next := response.Header.Get("ETag"); next == "" || next == etag {
+				err = fmt.Errorf("GET %s: answer without a new ETag", url)
+			} else {
+				etag = next
+				notify(changes)
+			}
+		default:
+			err = statusError(http.MethodGet, url, response)
+		}
+		_, _ = io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// stream reads the event stream of the changes path until it ends
+func (b *RestBackend) stream(ctx context.Context, key string, changes chan struct{}) error {
+	url := b.url(b.changesPath, key)
+	response, err := b.request(ctx, http.MethodGet, url, nil, http.Header{"Accept": []string{"text/event-stream"}})
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return statusError(http.MethodGet, url, response)
+	}
+	// changes before the stream was connected are not announced
+	notify(changes)
+
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	event := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// an empty line dispatches the event
+			if event {
+				notify(changes)
+			}
+			event = false
+		case strings.HasPrefix(line, ":"):
+			// comments keep the connection alive
+		default:
+			event = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("event stream ended")
+}
+
+// List returns the keys listed by the service, expired keys are removed
+func (b *RestBackend) List(ctx context.Context, pattern string) ([]string, error) {
+	listCtx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+	url := b.baseURL + b.listPath
+	response, err := b.request(listCtx, http.MethodGet, url, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, statusError(http.MethodGet, url, response)
+	}
+	listed := []string{}
+	err = json.NewDecoder(response.Body).Decode(&listed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key list: %w", err)
+	}
+
+	matches := backend.PatternMatcher(pattern)
+	keys := []string{}
+	for _, key := range listed {
+		if !matches(key) {
+			continue
+		}
+		doc, etag, err := b.read(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if expired(doc) {
+			_, err = b.conditional(ctx, http.MethodDelete, key, etag, nil)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if doc != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,439 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+	"github.com/mxcd/configmap-controller/internal/configmap"
+	"github.com/mxcd/configmap-controller/internal/controller"
+	"github.com/mxcd/configmap-controller/internal/repository"
+)
+
+const testToken = "Bearer secret"
+
+// fakeService is a config service storing documents with ETags, changes are announced by long polling
+// or server-sent events
+type fakeService struct {
+	lock      *sync.Mutex
+	documents map[string][]byte
+	etags     map[string]string
+	revision  int
+	// closed on every change
+	changed chan struct{}
+	// called before a PUT is handled
+	beforePut func(key string)
+}
+
+func newFakeService(t *testing.T) (*fakeService, *httptest.Server) {
+	service := &fakeService{
+		lock:      &sync.Mutex{},
+		documents: map[string][]byte{},
+		etags:     map[string]string{},
+		changed:   make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /configmaps", service.list)
+	mux.HandleFunc("GET /configmaps/{key...}", service.get)
+	mux.HandleFunc("PUT /configmaps/{key...}", service.put)
+	mux.HandleFunc("DELETE /configmaps/{key...}", service.delete)
+	mux.HandleFunc("GET /changes/{key...}", service.changes)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != testToken {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return service, server
+}
+
+func newTestRestBackend(t *testing.T, server *httptest.Server, changesMode string) *RestBackend {
+	restBackend, err := NewRestBackend(&RestBackendOptions{
+		BaseURL:     server.URL,
+		Headers:     http.Header{"Authorization": []string{testToken}},
+		ChangesPath: "/changes/{key}",
+		ChangesMode: changesMode,
+	})
+	require.NoError(t, err)
+	return restBackend
+}
+
+// set stores a document as another client of the service would. The caller must hold lock.
+func (s *fakeService) set(key string, document []byte) {
+	s.revision++
+	if document == nil {
+		delete(s.documents, key)
+		delete(s.etags, key)
+	} else {
+		s.documents[key] = document
+		s.etags[key] = fmt.Sprintf(`"%d"`, s.revision)
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *fakeService) Set(key string, document string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.set(key, []byte(document))
+}
+
+func (s *fakeService) list(w http.ResponseWriter, _ *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keys := []string{}
+	for key := range s.documents {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	_ = json.NewEncoder(w).Encode(keys)
+}
+
+func (s *fakeService) get(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := r.PathValue("key")
+	document, ok := s.documents[key]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("ETag", s.etags[key])
+	_, _ = w.Write(document)
+}
+
+// precondition checks If-Match and If-None-Match. The caller must hold lock.
+func (s *fakeService) precondition(w http.ResponseWriter, r *http.Request, key string) bool {
+	etag, exists := s.etags[key]
+	if match := r.Header.Get("If-Match"); match != "" && match != etag {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return false
+	}
+	if r.Header.Get("If-None-Match") == "*" && exists {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+func (s *fakeService) put(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if s.beforePut != nil {
+		s.beforePut(key)
+	}
+	document, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.precondition(w, r, key) {
+		return
+	}
+	s.set(key, document)
+	w.Header().Set("ETag", s.etags[key])
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *fakeService) delete(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := r.PathValue("key")
+	if _, ok := s.documents[key]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.precondition(w, r, key) {
+		return
+	}
+	s.set(key, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *fakeService) changes(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if r.Header.Get("Accept") == "text/event-stream" {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, ": connected\n\n")
+		w.(http.Flusher).Flush()
+		for {
+			s.lock.Lock()
+			etag, changed := s.etags[key], s.changed
+			s.lock.Unlock()
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+			s.lock.Lock()
+			next := s.etags[key]
+			s.lock.Unlock()
+			if next != etag {
+				_, _ = fmt.Fprintf(w, "event: change\ndata: %s\n\n", next)
+				w.(http.Flusher).Flush()
+			}
+		}
+	}
+
+	timeout := time.After(time.Second)
+	for {
+		s.lock.Lock()
+		etag, changed := s.etags[key], s.changed
+		s.lock.Unlock()
+		if etag == "" {
+			// a missing key has an ETag of its own
+			etag = `"missing"`
+		}
+		if etag != r.Header.Get("If-None-Match") {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func TestRestBackendOwnership(t *testing.T) {
+	service, server := newFakeService(t)
+	restBackend := newTestRestBackend(t, server, "")
+	ctx := context.Background()
+
+	entry, err := restBackend.Get(ctx, "default/app")
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+
+	conflicts, err := restBackend.Put(ctx, "default/app", "default/first", map[string]string{"a": "1", "shared": "first"}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, conflicts)
+	conflicts, err = restBackend.Put(ctx, "default/app", "default/second", map[string]string{"b": "2", "shared": "second"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"shared"}, conflicts)
+
+	// stale fields of the owner are removed, protected ones are kept
+	_, err = restBackend.Put(ctx, "default/app", "default/first", map[string]string{"a": "3"}, []string{"shared"})
+	require.NoError(t, err)
+	entry, err = restBackend.Get(ctx, "default/app")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "3", "b": "2", "shared": "first"}, entry.Data)
+	assert.Equal(t, map[string]string{"a": "default/first", "b": "default/second", "shared": "default/first"}, entry.Owners)
+
+	// unchanged data is not written again
+	service.lock.Lock()
+	revision := service.revision
+	service.lock.Unlock()
+	_, err = restBackend.Put(ctx, "default/app", "default/first", map[string]string{"a": "3"}, []string{"shared"})
+	require.NoError(t, err)
+	assert.Equal(t, revision, service.revision)
+
+	// an empty ConfigMap is known to exist
+	_, err = restBackend.Put(ctx, "default/empty", "default/empty", map[string]string{}, nil)
+	require.NoError(t, err)
+	entry, err = restBackend.Get(ctx, "default/empty")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{}, entry.Data)
+}
+
+func TestRestBackendConcurrentWrite(t *testing.T) {
+	service, server := newFakeService(t)
+	restBackend := newTestRestBackend(t, server, "")
+	ctx := context.Background()
+
+	_, err := restBackend.Put(ctx, "default/app", "default/app", map[string]string{"a": "1"}, nil)
+	require.NoError(t, err)
+
+	// another client changes the document between the read and the write of the controller
+	edited := false
+	service.beforePut = func(key string) {
+		if !edited {
+			edited = true
+			service.Set(key, `{"data":{"a":"1","external":"x"},"owners":{"a":"default/app"}}`)
+		}
+	}
+	_, err = restBackend.Put(ctx, "default/app", "default/second", map[string]string{"b": "2"}, nil)
+	require.NoError(t, err)
+	entry, err := restBackend.Get(ctx, "default/app")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "1", "b": "2", "external": "x"}, entry.Data)
+
+	// a service that always changes the document exhausts the attempts
+	service.beforePut = func(key string) {
+		service.Set(key, `{"data":{}}`)
+	}
+	_, err = restBackend.Put(ctx, "default/app", "default/app", map[string]string{"c": "3"}, nil)
+	assert.ErrorContains(t, err, "changed concurrently")
+}
+
+func TestRestBackendDelete(t *testing.T) {
+	_, server := newFakeService(t)
+	restBackend := newTestRestBackend(t, server, "")
+	ctx := context.Background()
+
+	_, err := restBackend.Put(ctx, "shared", "default/first", map[string]string{"a": "1"}, nil)
+	require.NoError(t, err)
+	_, err = restBackend.Put(ctx, "shared", "default/second", map[string]string{"b": "2"}, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, restBackend.Delete(ctx, "shared", "default/second", &backend.KeyPolicy{Action: backend.KeyPolicyDelete}))
+	entry, err := restBackend.Get(ctx, "shared")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "1"}, entry.Data)
+	assert.Equal(t, map[string]string{"a": "default/first"}, entry.Owners)
+
+	require.NoError(t, restBackend.Delete(ctx, "shared", "default/first", &backend.KeyPolicy{Action: backend.KeyPolicyExpire, TTL: 100 * time.Millisecond}))
+	keys, err := restBackend.List(ctx, "*")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"shared"}, keys)
+
+	// expired keys are hidden and removed by List
+	time.Sleep(150 * time.Millisecond)
+	entry, err = restBackend.Get(ctx, "shared")
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+	keys, err = restBackend.List(ctx, "*")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	_, err = restBackend.Put(ctx, "default/app", "default/app", map[string]string{"a": "1"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, restBackend.Delete(ctx, "default/app", "", &backend.KeyPolicy{Action: backend.KeyPolicyDelete}))
+	keys, err = restBackend.List(ctx, "*/*")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestRestBackendErrors(t *testing.T) {
+	_, server := newFakeService(t)
+	restBackend, err := NewRestBackend(&RestBackendOptions{BaseURL: server.URL})
+	require.NoError(t, err)
+
+	_, err = restBackend.Get(context.Background(), "default/app")
+	assert.ErrorContains(t, err, "401 Unauthorized: unauthorized")
+
+	_, err = NewRestBackend(&RestBackendOptions{BaseURL: server.URL, ChangesMode: "websocket"})
+	assert.Error(t, err)
+
+	// without changes path keys are polled
+	changes, err := restBackend.Watch(context.Background(), "default/app")
+	require.NoError(t, err)
+	assert.Nil(t, changes)
+}
+
+func TestRestBackendWatch(t *testing.T) {
+	for _, mode := range []string{LongPollChanges, SSEChanges} {
+		t.Run(mode, func(t *testing.T) {
+			service, server := newFakeService(t)
+			restBackend := newTestRestBackend(t, server, mode)
+			ctx, cancel := context.WithCancel(context.Background())
+
+			changes, err := restBackend.Watch(ctx, "default/app")
+			require.NoError(t, err)
+			// the key is pulled once the watch is established
+			select {
+			case <-changes:
+			case <-time.After(5 * time.Second):
+				t.Fatal("no initial notification")
+			}
+
+			service.Set("default/app", `{"data":{"foo":"bar"}}`)
+			service.Set("default/other", `{"data":{"foo":"bar"}}`)
+			select {
+			case <-changes:
+			case <-time.After(5 * time.Second):
+				t.Fatal("no change notification")
+			}
+			select {
+			case <-changes:
+				t.Fatal("unexpected change notification")
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			cancel()
+			assert.Eventually(t, func() bool {
+				_, ok := <-changes
+				return !ok
+			}, 5*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestSynchronizerRest(t *testing.T) {
+	service, server := newFakeService(t)
+	restBackend := newTestRestBackend(t, server, SSEChanges)
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "app",
+			Annotations: map[string]string{controller.ManagedAnnotation: "true"},
+		},
+		Data: map[string]string{"foo": "bar"},
+	}
+	reconciler := &controller.ConfigMapReconciler{
+		Client:     fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(configMap).Build(),
+		Scheme:     clientgoscheme.Scheme,
+		Repository: repository.NewConfigMapRepository(),
+	}
+	synchronizer := configmap.NewConfigMapSynchronizer(&configmap.ConfigMapSynchronizerOptions{
+		Backend:    restBackend,
+		Reconciler: reconciler,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(t, synchronizer.Start(ctx))
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	// events are handled once the synchronizer runs
+	assert.Eventually(t, func() bool {
+		synchronizer.Handle(context.Background(), &repository.RepositoryEvent[corev1.ConfigMap]{
+			Type:    repository.RepositoryEventUpdated,
+			Name:    client.ObjectKeyFromObject(configMap),
+			Element: configMap.DeepCopy(),
+		})
+		entry, err := restBackend.Get(context.Background(), "default/app")
+		return err == nil && entry != nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	service.lock.Lock()
+	document := strings.Replace(string(service.documents["default/app"]), `"bar"`, `"baz"`, 1)
+	service.lock.Unlock()
+	service.Set("default/app", document)
+	assert.Eventually(t, func() bool {
+		stored := &corev1.ConfigMap{}
+		require.NoError(t, reconciler.Get(context.Background(), client.ObjectKeyFromObject(configMap), stored))
+		return stored.Data["foo"] == "baz"
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,63 @@
+package sharding
+
+import (
+	"encoding/binary"
+	"sort"
+	"strconv"
+
+	"github.com/zeebo/blake3"
+)
+
+// Ring is an immutable consistent hash ring. Every member is placed on the ring multiple
+// times (virtual nodes) to spread keys evenly; adding or removing a member only moves
+// the keys of that member.
+type Ring struct {
+	members []string
+	hashes  []uint64
+	owners  map[uint64]string
+}
+
+func NewRing(members []string, virtualNodes int) *Ring {
+	ring := &Ring{
+		members: append([]string{}, members...),
+		hashes:  make([]uint64, 0, len(members)*virtualNodes),
+		owners:  make(map[uint64]string, len(members)*virtualNodes),
+	}
+	sort.Strings(ring.members)
+
+	for _, member := range ring.members {
+		for i := 0; i < virtualNodes; i++ {
+			hash := hashKey(member + "#" + strconv.Itoa(i))
+			if _, ok := ring.owners[hash]; ok {
+				continue
+			}
+			ring.owners[hash] = member
+			ring.hashes = append(ring.hashes, hash)
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+
+	return ring
+}
+
+// Owner returns the member responsible for the given key or an empty string if the ring has no members
+func (r *Ring) Owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	hash := hashKey(key)
+	index := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= hash })
+	if index == len(r.hashes) {
+		index = 0
+	}
+	return r.owners[r.hashes[index]]
+}
+
+func (r *Ring) Members() []string {
+	return append([]string{}, r.members...)
+}
+
+func hashKey(key string) uint64 {
+	hash := blake3.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(hash[:8])
+}
@@ -0,0 +1,40 @@
+package sharding
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingDistributesKeys(t *testing.T) {
+	ring := NewRing([]string{"replica-a", "replica-b", "replica-c"}, virtualNodes)
+
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		counts[ring.Owner(fmt.Sprintf("default/configmap-%d", i))]++
+	}
+
+	assert.Len(t, counts, 3)
+	for member, count := range counts {
+		assert.InDelta(t, 1000, count, 250, "unbalanced shard for %s", member)
+	}
+}
+
+func TestRingMovesOnlyKeysOfChangedMember(t *testing.T) {
+	before := NewRing([]string{"replica-a", "replica-b", "replica-c"}, virtualNodes)
+	after := NewRing([]string{"replica-a", "replica-b"}, virtualNodes)
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("default/configmap-%d", i)
+		if before.Owner(key) != "replica-c" {
+			assert.Equal(t, before.Owner(key), after.Owner(key))
+		}
+	}
+}
+
+func TestEmptyRing(t *testing.T) {
+	ring := NewRing(nil, virtualNodes)
+	assert.Equal(t, "", ring.Owner("default/configmap"))
+	assert.Empty(t, ring.Members())
+}
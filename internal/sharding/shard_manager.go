@@ -0,0 +1,232 @@
+package sharding
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+
+	"github.com/mxcd/configmap-controller/internal/redis"
+)
+
+const (
+	membersKey   = redis.ControllerKeyPrefix + "members"
+	leaseKeyBase = redis.ControllerKeyPrefix + "lease:"
+	virtualNodes = 128
+)
+
+// acquires a lease that is free or already held by the caller and extends its TTL
+var acquireLeaseScript = goredis.NewScript(`
+local holder = redis.call('GET', KEYS[1])
+if holder == false or holder == ARGV[1] then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// extends the TTL of a lease only if it is still held by the caller, a released lease stays free
+var renewLeaseScript = goredis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releases a lease only if it is held by the caller
+var releaseLeaseScript = goredis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+type ShardManagerOptions struct {
+	Redis             *redis.RedisConnection
+	ReplicaID         string
+	HeartbeatInterval time.Duration
+	// time after which a replica without heartbeat is removed from the ring. Also used as lease TTL,
+	// held leases are renewed on every heartbeat.
+	MemberTTL time.Duration
+}
+
+// ShardManager registers the replica in redis, maintains the consistent hash ring of all live
+// replicas and hands out per-key leases that guarantee that a key is synced by one replica at a time.
+type ShardManager struct {
+	options   *ShardManagerOptions
+	ring      *Ring
+	listeners []func()
+	// keys of the leases held by this replica
+	leases map[string]bool
+	lock   *sync.RWMutex
+}
+
+func NewShardManager(options *ShardManagerOptions) *ShardManager {
+	return &ShardManager{
+		options: options,
+		ring:    NewRing(nil, virtualNodes),
+		leases:  make(map[string]bool),
+		lock:    &sync.RWMutex{},
+	}
+}
+
+// AddChangeListener registers a callback that is invoked whenever the ring membership changes
+func (m *ShardManager) AddChangeListener(listener func()) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.listeners = append(m.listeners, listener)
+}
+
+func (m *ShardManager) ReplicaID() string {
+	return m.options.ReplicaID
+}
+
+// Owns returns true if the key is assigned to this replica. No key is owned before the first heartbeat.
+func (m *ShardManager) Owns(key string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.ring.Owner(key) == m.options.ReplicaID
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable. All replicas take part in sharding.
+func (m *ShardManager) NeedLeaderElection() bool {
+	return false
+}
+
+// Start implements manager.Runnable. It heartbeats until the context is cancelled and then leaves the ring.
+func (m *ShardManager) Start(ctx context.Context) error {
+	log.Info().Str("replica", m.options.ReplicaID).Msg("joining shard ring")
+
+	for {
+		err := m.heartbeat(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Error().Err(err).Str("replica", m.options.ReplicaID).Msg("unable to send shard heartbeat")
+		}
+
+		select {
+		case <-ctx.Done():
+			m.leave()
+			return nil
+		case <-time.After(m.options.HeartbeatInterval):
+		}
+	}
+}
+
+func (m *ShardManager) heartbeat(ctx context.Context) error {
+	now := time.Now()
+	client := m.options.Redis.Client
+
+	err := client.ZAdd(ctx, membersKey, goredis.Z{
+		Score:  float64(now.Add(m.options.MemberTTL).UnixMilli()),
+		Member: m.options.ReplicaID,
+	}).Err()
+	if err != nil {
+		return err
+	}
+
+	err = client.ZRemRangeByScore(ctx, membersKey, "-inf", "("+strconv.FormatInt(now.UnixMilli(), 10)).Err()
+	if err != nil {
+		return err
+	}
+
+	members, err := client.ZRange(ctx, membersKey, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+
+	m.updateMembers(members)
+	return m.renewLeases(ctx)
+}
+
+// renewLeases extends the TTL of all held leases, a lease must never lapse between two pulls of its key
+func (m *ShardManager) renewLeases(ctx context.Context) error {
+	m.lock.RLock()
+	keys := make([]string, 0, len(m.leases))
+	for key := range m.leases {
+		keys = append(keys, key)
+	}
+	m.lock.RUnlock()
+	if len(keys) == 0 {
+		return nil
+	}
+
+	pipeline := m.options.Redis.Client.Pipeline()
+	results := make([]*goredis.Cmd, len(keys))
+	for i, key := range keys {
+		results[i] = renewLeaseScript.Eval(ctx, pipeline, []string{leaseKeyBase + key}, m.options.ReplicaID, m.options.MemberTTL.Milliseconds())
+	}
+	_, err := pipeline.Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, key := range keys {
+		if acquired, _ := results[i].Int(); acquired != 1 && m.leases[key] {
+			log.Warn().Str("replica", m.options.ReplicaID).Str("key", key).Msg("shard lease lost to another replica")
+			delete(m.leases, key)
+		}
+	}
+	return nil
+}
+
+func (m *ShardManager) updateMembers(members []string) {
+	slices.Sort(members)
+
+	m.lock.Lock()
+	if slices.Equal(members, m.ring.Members()) {
+		m.lock.Unlock()
+		return
+	}
+	m.ring = NewRing(members, virtualNodes)
+	listeners := append([]func(){}, m.listeners...)
+	m.lock.Unlock()
+
+	log.Info().Str("replica", m.options.ReplicaID).Strs("members", members).Msg("shard ring changed")
+	for _, listener := range listeners {
+		listener()
+	}
+}
+
+func (m *ShardManager) leave() {
+	log.Info().Str("replica", m.options.ReplicaID).Msg("leaving shard ring")
+	ctx, cancel := context.WithTimeout(context.Background(), m.options.HeartbeatInterval)
+	defer cancel()
+
+	err := m.options.Redis.Client.ZRem(ctx, membersKey, m.options.ReplicaID).Err()
+	if err != nil {
+		log.Error().Err(err).Str("replica", m.options.ReplicaID).Msg("unable to leave shard ring")
+	}
+	m.updateMembers(nil)
+}
+
+// AcquireLease acquires or renews the lease for a key. It returns false if another replica holds the lease.
+func (m *ShardManager) AcquireLease(ctx context.Context, key string) (bool, error) {
+	acquired, err := acquireLeaseScript.Run(ctx, m.options.Redis.Client, []string{leaseKeyBase + key},
+		m.options.ReplicaID, m.options.MemberTTL.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if acquired == 1 {
+		m.leases[key] = true
+	} else {
+		delete(m.leases, key)
+	}
+	return acquired == 1, nil
+}
+
+// ReleaseLease releases the lease for a key if it is held by this replica
+func (m *ShardManager) ReleaseLease(ctx context.Context, key string) error {
+	m.lock.Lock()
+	delete(m.leases, key)
+	m.lock.Unlock()
+	return releaseLeaseScript.Run(ctx, m.options.Redis.Client, []string{leaseKeyBase + key}, m.options.ReplicaID).Err()
+}
@@ -0,0 +1,73 @@
+package sharding
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mxcd/configmap-controller/internal/redis"
+)
+
+func newTestShardManager(t *testing.T, redisServer *miniredis.Miniredis, replicaID string) *ShardManager {
+	redisPort, err := strconv.Atoi(redisServer.Port())
+	require.NoError(t, err)
+	redisConnection, err := redis.NewRedisConnection(&redis.RedisConnectionOptions{
+		Host: redisServer.Host(),
+		Port: redisPort,
+	})
+	require.NoError(t, err)
+	t.Cleanup(redisConnection.Close)
+
+	return NewShardManager(&ShardManagerOptions{
+		Redis:             redisConnection,
+		ReplicaID:         replicaID,
+		HeartbeatInterval: 20 * time.Millisecond,
+		MemberTTL:         time.Second,
+	})
+}
+
+func TestShardManagerRenewsLeases(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	shardManager := newTestShardManager(t, redisServer, "replica-a")
+	other := newTestShardManager(t, redisServer, "replica-b")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(t, shardManager.Start(ctx))
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	acquired, err := shardManager.AcquireLease(context.Background(), "default/app")
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	// the heartbeat renews the lease long before it lapses
+	for i := 0; i < 3; i++ {
+		redisServer.FastForward(600 * time.Millisecond)
+		assert.Eventually(t, func() bool {
+			return redisServer.TTL(leaseKeyBase+"default/app") > 600*time.Millisecond
+		}, time.Second, 5*time.Millisecond)
+	}
+	acquired, err = other.AcquireLease(context.Background(), "default/app")
+	require.NoError(t, err)
+	assert.False(t, acquired)
+
+	// released leases are no longer renewed
+	require.NoError(t, shardManager.ReleaseLease(context.Background(), "default/app"))
+	acquired, err = other.AcquireLease(context.Background(), "default/app")
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	time.Sleep(100 * time.Millisecond)
+	lease, err := redisServer.Get(leaseKeyBase + "default/app")
+	require.NoError(t, err)
+	assert.Equal(t, "replica-b", lease)
+}
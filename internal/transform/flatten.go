@@ -0,0 +1,170 @@
+package transform
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"strings"
+)
+
+// structuredFormat converts a document into flat fields and back
+type structuredFormat interface {
+	flatten(value string) (map[string]string, error)
+	// rebuild returns a document with the fields, keeping the layout of the base document if there is one
+	rebuild(fields map[string]string, base *string) (string, error)
+}
+
+var formats = map[string]structuredFormat{
+	"yaml":       yamlFormat{},
+	"json":       jsonFormat{},
+	"toml":       tomlFormat{},
+	"properties": propertiesFormat,
+	"env":        envFormat,
+}
+
+var formatExtensions = map[string]string{
+	".yaml":       "yaml",
+	".yml":        "yaml",
+	".json":       "json",
+	".toml":       "toml",
+	".properties": "properties",
+	".env":        "env",
+}
+
+func init() {
+	Register("flatten", newFlattenStep)
+}
+
+// flattenStep flattens one structured ConfigMap value into dotted path fields and rebuilds it on pull
+type flattenStep struct {
+	key    string
+	prefix string
+	format structuredFormat
+}
+
+// newFlattenStep parses "<key>[,prefix=<field prefix>][,format=<format>]". The format defaults to the key's
+// file extension. On pull the document is rebuilt from all fields with the prefix. An empty prefix claims all
+// fields, it requires the key to be the only key of the ConfigMap.
+func newFlattenStep(argument string) (Step, error) {
+	options := strings.Split(argument, ",")
+	step := &flattenStep{key: strings.TrimSpace(options[0])}
+	if step.key == "" {
+		return nil, fmt.Errorf("missing key")
+	}
+
+	formatName := formatExtensions[path.Ext(step.key)]
+	if step.key == ".env" {
+		formatName = "env"
+	}
+	for _, option := range options[1:] {
+		name, value, _ := strings.Cut(option, "=")
+		switch strings.TrimSpace(name) {
+		case "prefix":
+			step.prefix = strings.TrimSpace(value)
+		case "format":
+			formatName = strings.TrimSpace(value)
+		default:
+			return nil, fmt.Errorf("unknown flatten option %q", name)
+		}
+	}
+
+	format, ok := formats[formatName]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q of key %q, expected yaml, json, toml, properties or env", formatName, step.key)
+	}
+	step.format = format
+	return step, nil
+}
+
+func (s *flattenStep) Push(data map[string]string) (map[string]string, error) {
+	document, ok := data[s.key]
+	if !ok {
+		return data, nil
+	}
+
+	err := s.checkPrefix(data)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := s.format.flatten(document)
+	if err != nil {
+		return nil, fmt.Errorf("unable to flatten key %q: %w", s.key, err)
+	}
+
+	pushed := make(map[string]string, len(data)+len(fields))
+	for key, value := range data {
+		if key != s.key {
+			pushed[key] = value
+		}
+	}
+	for field, value := range fields {
+		field = s.prefix + field
+		if _, ok := pushed[field]; ok {
+			return nil, fmt.Errorf("flattened field %q of key %q collides with another key", field, s.key)
+		}
+		pushed[field] = value
+	}
+	return pushed, nil
+}
+
+func (s *flattenStep) Pull(data map[string]string, base map[string]string) (map[string]string, error) {
+	err := s.checkPrefix(base)
+	if err != nil {
+		return nil, err
+	}
+
+	pulled := make(map[string]string, len(data))
+	fields := map[string]string{}
+	for key, value := range data {
+		if field, ok := strings.CutPrefix(key, s.prefix); ok {
+			fields[field] = value
+		} else {
+			pulled[key] = value
+		}
+	}
+
+	baseDocument, hasBase := base[s.key]
+	if len(fields) == 0 && !hasBase {
+		return pulled, nil
+	}
+	if _, ok := pulled[s.key]; ok {
+		return nil, fmt.Errorf("field %q collides with the flattened key", s.key)
+	}
+
+	if !hasBase {
+		document, err := s.format.rebuild(fields, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to rebuild key %q: %w", s.key, err)
+		}
+		pulled[s.key] = document
+		return pulled, nil
+	}
+
+	// an unchanged document keeps its exact formatting
+	var baseFields map[string]string
+	baseFields, err = s.format.flatten(baseDocument)
+	if err == nil && maps.Equal(baseFields, fields) {
+		pulled[s.key] = baseDocument
+		return pulled, nil
+	}
+	document, err := s.format.rebuild(fields, &baseDocument)
+	if err != nil {
+		return nil, fmt.Errorf("unable to rebuild key %q: %w", s.key, err)
+	}
+	pulled[s.key] = document
+	return pulled, nil
+}
+
+// checkPrefix fails if the step has no prefix and the ConfigMap data has other keys, their fields could
+// not be told apart from the flattened fields on pull
+func (s *flattenStep) checkPrefix(data map[string]string) error {
+	if s.prefix != "" {
+		return nil
+	}
+	for key := range data {
+		if key != s.key {
+			return fmt.Errorf("flattening key %q without prefix requires it to be the only key, found %q", s.key, key)
+		}
+	}
+	return nil
+}
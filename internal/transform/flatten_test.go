@@ -0,0 +1,255 @@
+package transform
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const yamlDocument = `# application settings
+server:
+  port: 8080 # http port
+  host: localhost
+features:
+  - checkout
+  - search
+name: "042"
+`
+
+const jsonDocument = `{
+    "server": {
+        "port": 8080,
+        "host": "localhost"
+    },
+    "features": ["checkout", "search"],
+    "debug": false
+}
+`
+
+const tomlDocument = `name = 'app'
+
+[server]
+host = 'localhost'
+port = 8080
+`
+
+const propertiesDocument = `# database
+db.url = jdbc:postgresql://localhost/app
+db.user:admin
+! legacy
+greeting = hello \
+    world
+`
+
+const envDocument = `# app
+export LOG_LEVEL=info # verbose
+DB_PASSWORD="s3cr3t value"
+EMPTY=
+`
+
+func TestFlattenRoundTrip(t *testing.T) {
+	tests := []struct {
+		key      string
+		document string
+		fields   map[string]string
+	}{
+		{
+			key:      "application.yaml",
+			document: yamlDocument,
+			fields: map[string]string{
+				"server.port": "8080", "server.host": "localhost",
+				"features.0": "checkout", "features.1": "search", "name": "042",
+			},
+		},
+		{
+			key:      "config.json",
+			document: jsonDocument,
+			fields: map[string]string{
+				"server.port": "8080", "server.host": "localhost",
+				"features.0": "checkout", "features.1": "search", "debug": "false",
+			},
+		},
+		{
+			key:      "config.toml",
+			document: tomlDocument,
+			fields:   map[string]string{"name": "app", "server.host": "localhost", "server.port": "8080"},
+		},
+		{
+			key:      "app.properties",
+			document: propertiesDocument,
+			fields:   map[string]string{"db.url": "jdbc:postgresql://localhost/app", "db.user": "admin", "greeting": "hello world"},
+		},
+		{
+			key:      ".env",
+			document: envDocument,
+			fields:   map[string]string{"LOG_LEVEL": "info", "DB_PASSWORD": "s3cr3t value", "EMPTY": ""},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			pipeline, err := Parse("flatten:" + test.key)
+			require.NoError(t, err)
+
+			pushed, err := pipeline.Push(map[string]string{test.key: test.document})
+			require.NoError(t, err)
+			assert.Equal(t, test.fields, pushed)
+
+			// unchanged fields keep the document as is
+			pulled, err := pipeline.Pull(pushed, map[string]string{test.key: test.document})
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{test.key: test.document}, pulled)
+
+			// without the original document the fields are rebuilt into an equivalent document
+			pulled, err = pipeline.Pull(pushed, nil)
+			require.NoError(t, err)
+			repushed, err := pipeline.Push(pulled)
+			require.NoError(t, err)
+			assert.Equal(t, test.fields, repushed)
+		})
+	}
+}
+
+func TestFlattenYAMLKeepsComments(t *testing.T) {
+	pipeline, err := Parse("flatten:application.yaml")
+	require.NoError(t, err)
+	base := map[string]string{"application.yaml": yamlDocument}
+
+	pulled, err := pipeline.Pull(map[string]string{
+		"server.port": "9090",
+		"server.host": "localhost",
+		"features.0":  "checkout",
+		"name":        "043",
+		"server.tls":  "true",
+	}, base)
+	require.NoError(t, err)
+	assert.Equal(t, `# application settings
+server:
+  port: 9090 # http port
+  host: localhost
+  tls: true
+features:
+  - checkout
+name: "043"
+`, pulled["application.yaml"])
+}
+
+func TestFlattenJSONKeepsOrder(t *testing.T) {
+	pipeline, err := Parse("flatten:config.json")
+	require.NoError(t, err)
+	base := map[string]string{"config.json": jsonDocument}
+
+	pulled, err := pipeline.Pull(map[string]string{
+		"server.port": "not a number",
+		"server.host": "localhost",
+		"features.0":  "checkout",
+		"features.1":  "search",
+		"features.2":  "payments",
+		"debug":       "true",
+	}, base)
+	require.NoError(t, err)
+	assert.Equal(t, `{
+    "server": {
+        "port": "not a number",
+        "host": "localhost"
+    },
+    "features": [
+        "checkout",
+        "search",
+        "payments"
+    ],
+    "debug": true
+}
+`, pulled["config.json"])
+}
+
+func TestFlattenLineFormatsKeepComments(t *testing.T) {
+	pipeline, err := Parse("flatten:app.properties")
+	require.NoError(t, err)
+	pulled, err := pipeline.Pull(map[string]string{
+		"db.url":   "jdbc:postgresql://db/app",
+		"greeting": "hello world",
+		"new.key":  "a=b",
+	}, map[string]string{"app.properties": propertiesDocument})
+	require.NoError(t, err)
+	assert.Equal(t, `# database
+db.url = jdbc:postgresql://db/app
+! legacy
+greeting = hello \
+    world
+new.key=a=b
+`, pulled["app.properties"])
+
+	pipeline, err = Parse("flatten:.env")
+	require.NoError(t, err)
+	pulled, err = pipeline.Pull(map[string]string{
+		"LOG_LEVEL":   "debug",
+		"DB_PASSWORD": "new secret",
+		"EMPTY":       "",
+		"NEW":         "it's",
+	}, map[string]string{".env": envDocument})
+	require.NoError(t, err)
+	assert.Equal(t, `# app
+export LOG_LEVEL=debug # verbose
+DB_PASSWORD="new secret"
+EMPTY=
+NEW="it's"
+`, pulled[".env"])
+}
+
+func TestFlattenWithPrefix(t *testing.T) {
+	pipeline, err := Parse("flatten:application.yaml,prefix=app.; rename:OTHER=other")
+	require.NoError(t, err)
+
+	data := map[string]string{"application.yaml": "server:\n  port: 8080\n", "OTHER": "x"}
+	pushed, err := pipeline.Push(data)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"app.server.port": "8080", "other": "x"}, pushed)
+
+	pushed["app.server.port"] = "9090"
+	pulled, err := pipeline.Pull(pushed, data)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"application.yaml": "server:\n  port: 9090\n", "OTHER": "x"}, pulled)
+}
+
+func TestFlattenErrors(t *testing.T) {
+	_, err := Parse("flatten:config.ini")
+	assert.Error(t, err)
+	_, err = Parse("flatten:config,format=xml")
+	assert.Error(t, err)
+
+	pipeline, err := Parse("flatten:config,format=json")
+	require.NoError(t, err)
+	_, err = pipeline.Push(map[string]string{"config": "{invalid"})
+	assert.Error(t, err)
+
+	// other keys would be claimed by the document on pull
+	pipeline, err = Parse("flatten:application.yaml")
+	require.NoError(t, err)
+	data := map[string]string{"application.yaml": "a: 1\n", "OTHER": "x"}
+	_, err = pipeline.Push(data)
+	assert.ErrorContains(t, err, "without prefix")
+	_, err = pipeline.Pull(map[string]string{"a": "2", "OTHER": "y"}, data)
+	assert.ErrorContains(t, err, "without prefix")
+	pulled, err := pipeline.Pull(map[string]string{"a": "2"}, map[string]string{"application.yaml": "a: 1\n"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"application.yaml": "a: 2\n"}, pulled)
+
+	_, err = pipeline.Push(map[string]string{"application.yaml": "a.b: 1\n"})
+	assert.Error(t, err)
+}
+
+func TestFlattenTOMLKeepsTypes(t *testing.T) {
+	pipeline, err := Parse("flatten:config.toml")
+	require.NoError(t, err)
+
+	pulled, err := pipeline.Pull(map[string]string{
+		"name":        "app",
+		"server.host": "localhost",
+		"server.port": "9090",
+	}, map[string]string{"config.toml": tomlDocument})
+	require.NoError(t, err)
+	assert.Contains(t, pulled["config.toml"], "port = 9090")
+	assert.Contains(t, pulled["config.toml"], "host = 'localhost'")
+}
@@ -0,0 +1,340 @@
+package transform
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Line based formats keep comments, blank lines and the order of entries. Changed entries keep their
+// key and separator, removed entries are dropped and new entries are appended in key order.
+
+type lineEntry struct {
+	// original text, several lines for continued or multi line values
+	raw string
+	// false for blank and comment lines
+	entry bool
+	key   string
+	value string
+	// text before and after the value, e.g. the key and an inline comment
+	prefix string
+	suffix string
+	// quote character of the value, env only
+	quote byte
+}
+
+type lineFormat struct {
+	parse       func(text string) ([]lineEntry, error)
+	encodeEntry func(entry lineEntry, value string) string
+	newEntry    func(key string, value string) string
+}
+
+func (f lineFormat) flatten(value string) (map[string]string, error) {
+	entries, err := f.parse(value)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]string{}
+	for _, entry := range entries {
+		if entry.entry {
+			fields[entry.key] = entry.value
+		}
+	}
+	return fields, nil
+}
+
+func (f lineFormat) rebuild(fields map[string]string, base *string) (string, error) {
+	entries := []lineEntry{}
+	if base != nil {
+		parsed, err := f.parse(*base)
+		if err == nil {
+			entries = parsed
+		}
+	}
+
+	lines := []string{}
+	written := map[string]bool{}
+	for _, entry := range entries {
+		if !entry.entry {
+			lines = append(lines, entry.raw)
+			continue
+		}
+		value, ok := fields[entry.key]
+		if !ok {
+			continue
+		}
+		written[entry.key] = true
+		if value == entry.value {
+			lines = append(lines, entry.raw)
+		} else {
+			lines = append(lines, f.encodeEntry(entry, value))
+		}
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		if !written[key] {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		lines = append(lines, f.newEntry(key, fields[key]))
+	}
+
+	if len(lines) == 0 {
+		return "", nil
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// splitLines splits the text into lines without the trailing empty line
+func splitLines(text string) []string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+var propertiesFormat = lineFormat{
+	parse: parseProperties,
+	encodeEntry: func(entry lineEntry, value string) string {
+		return entry.prefix + escapeProperty(value, false)
+	},
+	newEntry: func(key string, value string) string {
+		return escapeProperty(key, true) + "=" + escapeProperty(value, false)
+	},
+}
+
+// parseProperties parses java .properties files including continued lines and escapes
+func parseProperties(text string) ([]lineEntry, error) {
+	if text == "" {
+		return nil, nil
+	}
+
+	entries := []lineEntry{}
+	lines := splitLines(text)
+	for i := 0; i < len(lines); i++ {
+		raw := lines[i]
+		logical := strings.TrimLeft(raw, " \t\f")
+		if logical == "" || logical[0] == '#' || logical[0] == '!' {
+			entries = append(entries, lineEntry{raw: raw})
+			continue
+		}
+
+		for endsWithContinuation(logical) && i+1 < len(lines) {
+			i++
+			raw += "\n" + lines[i]
+			logical = logical[:len(logical)-1] + strings.TrimLeft(lines[i], " \t\f")
+		}
+
+		keyEnd := 0
+		for keyEnd < len(logical) {
+			c := logical[keyEnd]
+			if c == '\\' {
+				keyEnd += 2
+				continue
+			}
+			if c == '=' || c == ':' || c == ' ' || c == '\t' || c == '\f' {
+				break
+			}
+			keyEnd++
+		}
+		keyEnd = min(keyEnd, len(logical))
+
+		valueStart := keyEnd
+		for valueStart < len(logical) && strings.ContainsRune(" \t\f", rune(logical[valueStart])) {
+			valueStart++
+		}
+		if valueStart < len(logical) && (logical[valueStart] == '=' || logical[valueStart] == ':') {
+			valueStart++
+			for valueStart < len(logical) && strings.ContainsRune(" \t\f", rune(logical[valueStart])) {
+				valueStart++
+			}
+		}
+
+		indent := raw[:len(raw)-len(strings.TrimLeft(raw, " \t\f"))]
+		entries = append(entries, lineEntry{
+			raw:    raw,
+			entry:  true,
+			key:    unescapeProperty(logical[:keyEnd]),
+			value:  unescapeProperty(logical[valueStart:]),
+			prefix: indent + logical[:valueStart],
+		})
+	}
+	return entries, nil
+}
+
+func endsWithContinuation(line string) bool {
+	backslashes := len(line) - len(strings.TrimRight(line, "\\"))
+	return backslashes%2 == 1
+}
+
+func unescapeProperty(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+
+	builder := &strings.Builder{}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\\' || i+1 == len(value) {
+			builder.WriteByte(c)
+			continue
+		}
+		i++
+		switch value[i] {
+		case 't':
+			builder.WriteByte('\t')
+		case 'n':
+			builder.WriteByte('\n')
+		case 'r':
+			builder.WriteByte('\r')
+		case 'f':
+			builder.WriteByte('\f')
+		case 'u':
+			if i+4 < len(value) {
+				if code, err := strconv.ParseUint(value[i+1:i+5], 16, 16); err == nil {
+					builder.WriteRune(rune(code))
+					i += 4
+					continue
+				}
+			}
+			builder.WriteByte('u')
+		default:
+			builder.WriteByte(value[i])
+		}
+	}
+	return builder.String()
+}
+
+func escapeProperty(value string, key bool) string {
+	builder := &strings.Builder{}
+	for i, c := range value {
+		switch {
+		case c == '\\':
+			builder.WriteString(`\\`)
+		case c == '\n':
+			builder.WriteString(`\n`)
+		case c == '\r':
+			builder.WriteString(`\r`)
+		case c == '\t':
+			builder.WriteString(`\t`)
+		case c == '\f':
+			builder.WriteString(`\f`)
+		case c == ' ' && (key || i == 0):
+			builder.WriteString(`\ `)
+		case (c == '=' || c == ':' || c == '#' || c == '!') && (key || i == 0):
+			builder.WriteByte('\\')
+			builder.WriteRune(c)
+		default:
+			builder.WriteRune(c)
+		}
+	}
+	return builder.String()
+}
+
+var envFormat = lineFormat{
+	parse: parseEnv,
+	encodeEntry: func(entry lineEntry, value string) string {
+		return entry.prefix + quoteEnv(value, entry.quote) + entry.suffix
+	},
+	newEntry: func(key string, value string) string {
+		return key + "=" + quoteEnv(value, 0)
+	},
+}
+
+// parseEnv parses .env files with optional export prefix, quoted and multi line values and inline comments
+func parseEnv(text string) ([]lineEntry, error) {
+	if text == "" {
+		return nil, nil
+	}
+
+	entries := []lineEntry{}
+	lines := splitLines(text)
+	for i := 0; i < len(lines); i++ {
+		raw := lines[i]
+		trimmed := strings.TrimSpace(raw)
+		if trimmed == "" || trimmed[0] == '#' {
+			entries = append(entries, lineEntry{raw: raw})
+			continue
+		}
+
+		separator := strings.Index(raw, "=")
+		if separator < 0 {
+			return nil, fmt.Errorf("line %d: missing '='", i+1)
+		}
+		key := strings.TrimPrefix(strings.TrimSpace(raw[:separator]), "export ")
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return nil, fmt.Errorf("line %d: missing key", i+1)
+		}
+
+		valueStart := separator + 1
+		for valueStart < len(raw) && (raw[valueStart] == ' ' || raw[valueStart] == '\t') {
+			valueStart++
+		}
+		entry := lineEntry{entry: true, key: key, prefix: raw[:valueStart]}
+		rest := raw[valueStart:]
+
+		if rest != "" && (rest[0] == '"' || rest[0] == '\'') {
+			quote := rest[0]
+			// quoted values may span several lines
+			for closingQuote(rest, quote) < 0 && i+1 < len(lines) {
+				i++
+				raw += "\n" + lines[i]
+				rest += "\n" + lines[i]
+			}
+			end := closingQuote(rest, quote)
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated quote", i+1)
+			}
+			entry.quote = quote
+			entry.value = rest[1:end]
+			if quote == '"' {
+				entry.value = unescapeEnv(entry.value)
+			}
+			entry.suffix = rest[end+1:]
+		} else {
+			value := rest
+			if comment := strings.Index(rest, " #"); comment >= 0 {
+				value = rest[:comment]
+			}
+			entry.value = strings.TrimSpace(value)
+			entry.suffix = rest[len(entry.value):]
+		}
+		entry.raw = raw
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// closingQuote returns the index of the quote that closes the value starting with a quote, -1 if there is none
+func closingQuote(value string, quote byte) int {
+	for i := 1; i < len(value); i++ {
+		if value[i] == '\\' && quote == '"' {
+			i++
+			continue
+		}
+		if value[i] == quote {
+			return i
+		}
+	}
+	return -1
+}
+
+func unescapeEnv(value string) string {
+	replacer := strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\"`, `"`, `\\`, `\`)
+	return replacer.Replace(value)
+}
+
+// quoteEnv keeps the original quotes if possible and quotes values that would not survive unquoted
+func quoteEnv(value string, quote byte) string {
+	if quote == '\'' && !strings.Contains(value, "'") {
+		return "'" + value + "'"
+	}
+	if quote == 0 && !strings.ContainsAny(value, " \t\n\"'#\\$") {
+		return value
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`)
+	return `"` + replacer.Replace(value) + `"`
+}
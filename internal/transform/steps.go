@@ -0,0 +1,191 @@
+package transform
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+func init() {
+	Register("rename", newRenameStep)
+	Register("prefix", newPrefixStep)
+	Register("case", newCaseStep)
+	Register("base64", newBase64Step)
+	Register("trim", newTrimStep)
+}
+
+type keyStep struct {
+	push func(key string) (string, error)
+	pull func(key string) (string, error)
+}
+
+// KeyStep returns a step that converts every key with the given functions
+func KeyStep(push func(key string) (string, error), pull func(key string) (string, error)) Step {
+	return &keyStep{push: push, pull: pull}
+}
+
+func (s *keyStep) Push(data map[string]string) (map[string]string, error) {
+	return convertKeys(data, s.push)
+}
+
+func (s *keyStep) Pull(data map[string]string, _ map[string]string) (map[string]string, error) {
+	return convertKeys(data, s.pull)
+}
+
+func convertKeys(data map[string]string, convert func(key string) (string, error)) (map[string]string, error) {
+	converted := make(map[string]string, len(data))
+	sources := make(map[string]string, len(data))
+	for key, value := range data {
+		convertedKey, err := convert(key)
+		if err != nil {
+			return nil, err
+		}
+		if source, ok := sources[convertedKey]; ok {
+			return nil, fmt.Errorf("keys %q and %q both convert to %q", source, key, convertedKey)
+		}
+		sources[convertedKey] = key
+		converted[convertedKey] = value
+	}
+	return converted, nil
+}
+
+type valueStep struct {
+	push func(value string) (string, error)
+	pull func(value string) (string, error)
+}
+
+// ValueStep returns a step that converts every value with the given functions
+func ValueStep(push func(value string) (string, error), pull func(value string) (string, error)) Step {
+	return &valueStep{push: push, pull: pull}
+}
+
+func (s *valueStep) Push(data map[string]string) (map[string]string, error) {
+	return convertValues(data, s.push)
+}
+
+func (s *valueStep) Pull(data map[string]string, _ map[string]string) (map[string]string, error) {
+	return convertValues(data, s.pull)
+}
+
+func convertValues(data map[string]string, convert func(value string) (string, error)) (map[string]string, error) {
+	converted := make(map[string]string, len(data))
+	for key, value := range data {
+		convertedValue, err := convert(value)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", key, err)
+		}
+		converted[key] = convertedValue
+	}
+	return converted, nil
+}
+
+// newRenameStep renames ConfigMap keys to redis fields, e.g. "LEGACY_URL=service.url,DB=database.host"
+func newRenameStep(argument string) (Step, error) {
+	renames := map[string]string{}
+	reverse := map[string]string{}
+	for _, rename := range strings.Split(argument, ",") {
+		from, to, ok := strings.Cut(rename, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid rename %q, expected <configmap key>=<redis field>", rename)
+		}
+		if _, ok := renames[from]; ok {
+			return nil, fmt.Errorf("key %q renamed twice", from)
+		}
+		if _, ok := reverse[to]; ok {
+			return nil, fmt.Errorf("several keys renamed to %q", to)
+		}
+		renames[from] = to
+		reverse[to] = from
+	}
+
+	lookup := func(names map[string]string) func(string) (string, error) {
+		return func(key string) (string, error) {
+			if name, ok := names[key]; ok {
+				return name, nil
+			}
+			return key, nil
+		}
+	}
+	return KeyStep(lookup(renames), lookup(reverse)), nil
+}
+
+// newPrefixStep strips the prefix from ConfigMap keys and adds it to redis fields. Keys without the prefix fail.
+func newPrefixStep(prefix string) (Step, error) {
+	if prefix == "" {
+		return nil, fmt.Errorf("missing prefix")
+	}
+	return KeyStep(
+		func(key string) (string, error) {
+			stripped, ok := strings.CutPrefix(key, prefix)
+			if !ok || stripped == "" {
+				return "", fmt.Errorf("key %q does not start with prefix %q", key, prefix)
+			}
+			return stripped, nil
+		},
+		func(key string) (string, error) {
+			return prefix + key, nil
+		},
+	), nil
+}
+
+// newCaseStep converts the case of keys. lower and upper convert ConfigMap keys to lower or upper case,
+// dotted and kebab convert env style ConfigMap keys like FEATURE_ENABLED to feature.enabled or feature-enabled.
+func newCaseStep(style string) (Step, error) {
+	lower := func(key string) (string, error) { return strings.ToLower(key), nil }
+	upper := func(key string) (string, error) { return strings.ToUpper(key), nil }
+	switch style {
+	case "lower":
+		return KeyStep(lower, upper), nil
+	case "upper":
+		return KeyStep(upper, lower), nil
+	case "dotted":
+		return separatorCaseStep("."), nil
+	case "kebab":
+		return separatorCaseStep("-"), nil
+	}
+	return nil, fmt.Errorf("unknown case %q, expected lower, upper, dotted or kebab", style)
+}
+
+func separatorCaseStep(separator string) Step {
+	return KeyStep(
+		func(key string) (string, error) {
+			return strings.ReplaceAll(strings.ToLower(key), "_", separator), nil
+		},
+		func(key string) (string, error) {
+			return strings.ReplaceAll(strings.ToUpper(key), separator, "_"), nil
+		},
+	)
+}
+
+// newBase64Step encodes ConfigMap values on push with "encode" or decodes them with "decode"
+func newBase64Step(mode string) (Step, error) {
+	encode := func(value string) (string, error) {
+		return base64.StdEncoding.EncodeToString([]byte(value)), nil
+	}
+	decode := func(value string) (string, error) {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid base64 value: %w", err)
+		}
+		return string(decoded), nil
+	}
+	switch mode {
+	case "encode":
+		return ValueStep(encode, decode), nil
+	case "decode":
+		return ValueStep(decode, encode), nil
+	}
+	return nil, fmt.Errorf("unknown base64 mode %q, expected encode or decode", mode)
+}
+
+// newTrimStep removes leading and trailing whitespace from ConfigMap values on push.
+// Pulled values are trimmed already, so the ConfigMap converges to the trimmed values.
+func newTrimStep(argument string) (Step, error) {
+	if argument != "" {
+		return nil, fmt.Errorf("trim takes no argument")
+	}
+	trim := func(value string) (string, error) { return strings.TrimSpace(value), nil }
+	keep := func(value string) (string, error) { return value, nil }
+	return ValueStep(trim, keep), nil
+}
@@ -0,0 +1,264 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// yamlFormat keeps comments and key order of the base document. Indentation is normalized to two spaces.
+type yamlFormat struct{}
+
+func (yamlFormat) flatten(value string) (map[string]string, error) {
+	document := &yaml.Node{}
+	err := yaml.Unmarshal([]byte(value), document)
+	if err != nil {
+		return nil, err
+	}
+	return flattenNode(document)
+}
+
+func (yamlFormat) rebuild(fields map[string]string, base *string) (string, error) {
+	document := &yaml.Node{}
+	if base == nil || yaml.Unmarshal([]byte(*base), document) != nil || len(document.Content) == 0 {
+		document = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{nil}}
+	}
+
+	root, err := rebuildNode(document.Content[0], fields)
+	if err != nil {
+		return "", err
+	}
+	document.Content[0] = root
+
+	buffer := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(buffer)
+	encoder.SetIndent(2)
+	err = encoder.Encode(document)
+	if err != nil {
+		return "", err
+	}
+	err = encoder.Close()
+	if err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// jsonFormat keeps key order and the indentation of the base document
+type jsonFormat struct{}
+
+func (jsonFormat) flatten(value string) (map[string]string, error) {
+	if !json.Valid([]byte(value)) {
+		return nil, fmt.Errorf("invalid json")
+	}
+	return yamlFormat{}.flatten(value)
+}
+
+func (jsonFormat) rebuild(fields map[string]string, base *string) (string, error) {
+	var root *yaml.Node
+	indent := "  "
+	newline := true
+	if base != nil && json.Valid([]byte(*base)) {
+		document := &yaml.Node{}
+		if yaml.Unmarshal([]byte(*base), document) == nil && len(document.Content) > 0 {
+			root = document.Content[0]
+		}
+		indent = detectJSONIndent(*base)
+		newline = strings.HasSuffix(*base, "\n")
+	}
+
+	root, err := rebuildNode(root, fields)
+	if err != nil {
+		return "", err
+	}
+
+	buffer := &bytes.Buffer{}
+	writeJSONNode(buffer, root)
+	if indent != "" {
+		indented := &bytes.Buffer{}
+		err = json.Indent(indented, buffer.Bytes(), "", indent)
+		if err != nil {
+			return "", err
+		}
+		buffer = indented
+	}
+	if newline {
+		buffer.WriteString("\n")
+	}
+	return buffer.String(), nil
+}
+
+func writeJSONNode(buffer *bytes.Buffer, node *yaml.Node) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		buffer.WriteString("{")
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if i > 0 {
+				buffer.WriteString(",")
+			}
+			key, _ := json.Marshal(node.Content[i].Value)
+			buffer.Write(key)
+			buffer.WriteString(":")
+			writeJSONNode(buffer, node.Content[i+1])
+		}
+		buffer.WriteString("}")
+	case yaml.SequenceNode:
+		buffer.WriteString("[")
+		for i, item := range node.Content {
+			if i > 0 {
+				buffer.WriteString(",")
+			}
+			writeJSONNode(buffer, item)
+		}
+		buffer.WriteString("]")
+	default:
+		switch node.Tag {
+		case "!!int", "!!float", "!!bool", "!!null":
+			if json.Valid([]byte(node.Value)) {
+				buffer.WriteString(node.Value)
+				return
+			}
+		}
+		value, _ := json.Marshal(node.Value)
+		buffer.Write(value)
+	}
+}
+
+// detectJSONIndent returns the indentation of the first indented line, empty for single line documents
+func detectJSONIndent(value string) string {
+	lines := strings.Split(strings.TrimSpace(value), "\n")
+	if len(lines) < 2 {
+		return ""
+	}
+	for _, line := range lines[1:] {
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if indent != "" {
+			return indent
+		}
+	}
+	return "  "
+}
+
+// tomlFormat converts documents to and from trees. Comments are not kept and keys are sorted.
+type tomlFormat struct{}
+
+func (tomlFormat) flatten(value string) (map[string]string, error) {
+	document := map[string]interface{}{}
+	err := toml.Unmarshal([]byte(value), &document)
+	if err != nil {
+		return nil, err
+	}
+	return flattenNode(tomlToNode(document))
+}
+
+func (tomlFormat) rebuild(fields map[string]string, base *string) (string, error) {
+	root := newContainer(false)
+	if base != nil {
+		document := map[string]interface{}{}
+		if toml.Unmarshal([]byte(*base), &document) == nil {
+			root = tomlToNode(document)
+		}
+	}
+
+	root, err := rebuildNode(root, fields)
+	if err != nil {
+		return "", err
+	}
+	document, ok := nodeToTOML(root).(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("toml document must be a table")
+	}
+	data, err := toml.Marshal(document)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func tomlToNode(value interface{}) *yaml.Node {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		node := newContainer(false)
+		for _, key := range slices.Sorted(maps.Keys(value)) {
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, tomlToNode(value[key]))
+		}
+		return node
+	case []interface{}:
+		node := newContainer(true)
+		for _, item := range value {
+			node.Content = append(node.Content, tomlToNode(item))
+		}
+		return node
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+	case int64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.FormatInt(value, 10)}
+	case float64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: strconv.FormatFloat(value, 'g', -1, 64)}
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(value)}
+	case time.Time:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!timestamp", Value: value.Format(time.RFC3339Nano)}
+	case fmt.Stringer:
+		// local dates and times
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!timestamp", Value: value.String()}
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: fmt.Sprint(value)}
+}
+
+func nodeToTOML(node *yaml.Node) interface{} {
+	switch node.Kind {
+	case yaml.MappingNode:
+		table := make(map[string]interface{}, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			table[node.Content[i].Value] = nodeToTOML(node.Content[i+1])
+		}
+		return table
+	case yaml.SequenceNode:
+		array := make([]interface{}, len(node.Content))
+		for i, item := range node.Content {
+			array[i] = nodeToTOML(item)
+		}
+		return array
+	}
+
+	switch node.Tag {
+	case "!!int":
+		if value, err := strconv.ParseInt(node.Value, 10, 64); err == nil {
+			return value
+		}
+	case "!!float":
+		if value, err := strconv.ParseFloat(node.Value, 64); err == nil {
+			return value
+		}
+	case "!!bool":
+		if value, err := strconv.ParseBool(node.Value); err == nil {
+			return value
+		}
+	case "!!timestamp":
+		if value, err := time.Parse(time.RFC3339Nano, node.Value); err == nil {
+			return value
+		}
+		localDateTime := toml.LocalDateTime{}
+		if localDateTime.UnmarshalText([]byte(node.Value)) == nil {
+			return localDateTime
+		}
+		localDate := toml.LocalDate{}
+		if localDate.UnmarshalText([]byte(node.Value)) == nil {
+			return localDate
+		}
+		localTime := toml.LocalTime{}
+		if localTime.UnmarshalText([]byte(node.Value)) == nil {
+			return localTime
+		}
+	}
+	return node.Value
+}
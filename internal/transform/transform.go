@@ -0,0 +1,159 @@
+package transform
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Step converts ConfigMap data into redis fields on push and back on pull. Pull must undo Push
+// so that bidirectional synchronization converges. The base is the current data on the ConfigMap side
+// of the step, it may be used to keep the layout of rebuilt values and is nil if unknown.
+type Step interface {
+	Push(data map[string]string) (map[string]string, error)
+	Pull(data map[string]string, base map[string]string) (map[string]string, error)
+}
+
+// Factory creates a step from the argument following the step name, empty if there is none
+type Factory func(argument string) (Step, error)
+
+var (
+	factories     = map[string]Factory{}
+	factoriesLock = &sync.RWMutex{}
+)
+
+// Register makes a step available to Parse under the given name. Registering a name twice panics.
+func Register(name string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("transform step %q registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// Pipeline applies its steps in order on push and in reverse order on pull. A nil Pipeline does not transform.
+type Pipeline struct {
+	steps []Step
+}
+
+func NewPipeline(steps ...Step) *Pipeline {
+	return &Pipeline{steps: steps}
+}
+
+// Parse parses semicolon separated steps of the form name or name:argument,
+// e.g. "prefix:APP_; case:dotted; base64:decode". An empty spec returns nil.
+func Parse(spec string) (*Pipeline, error) {
+	steps := []Step{}
+	for _, stepSpec := range strings.Split(spec, ";") {
+		stepSpec = strings.TrimSpace(stepSpec)
+		if stepSpec == "" {
+			continue
+		}
+
+		name, argument, _ := strings.Cut(stepSpec, ":")
+		factoriesLock.RLock()
+		factory, ok := factories[strings.TrimSpace(name)]
+		factoriesLock.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown transform step %q", name)
+		}
+		step, err := factory(strings.TrimSpace(argument))
+		if err != nil {
+			return nil, fmt.Errorf("invalid transform step %q: %w", stepSpec, err)
+		}
+		steps = append(steps, step)
+	}
+
+	if len(steps) == 0 {
+		return nil, nil
+	}
+	return NewPipeline(steps...), nil
+}
+
+// Push converts ConfigMap data into redis fields. It fails if the result does not survive
+// a round trip, i.e. pulling it would change the ConfigMap keys or pushing again the redis fields.
+func (p *Pipeline) Push(data map[string]string) (map[string]string, error) {
+	pushed, err := p.push(data)
+	if err != nil {
+		return nil, err
+	}
+
+	pulled, err := p.Pull(pushed, data)
+	if err != nil {
+		return nil, fmt.Errorf("transform is not reversible: %w", err)
+	}
+	for key := range data {
+		if _, ok := pulled[key]; !ok {
+			return nil, fmt.Errorf("transform is not reversible for key %q", key)
+		}
+	}
+	if len(pulled) != len(data) {
+		return nil, fmt.Errorf("transform is not reversible, keys %s are added on pull", strings.Join(addedKeys(data, pulled), ", "))
+	}
+	repushed, err := p.push(pulled)
+	if err != nil {
+		return nil, fmt.Errorf("transform does not converge: %w", err)
+	}
+	if !maps.Equal(pushed, repushed) {
+		return nil, fmt.Errorf("transform does not converge")
+	}
+	return pushed, nil
+}
+
+// Pull converts redis fields back into ConfigMap data. The optional base is the current ConfigMap data.
+func (p *Pipeline) Pull(data map[string]string, base map[string]string) (map[string]string, error) {
+	if p == nil {
+		return maps.Clone(data), nil
+	}
+
+	// the base of every step is the current data pushed through the previous steps
+	bases := make([]map[string]string, len(p.steps))
+	for i, step := range p.steps {
+		bases[i] = base
+		if base != nil {
+			var err error
+			base, err = step.Push(base)
+			if err != nil {
+				base = nil
+			}
+		}
+	}
+
+	var err error
+	for i := len(p.steps) - 1; i >= 0; i-- {
+		data, err = p.steps[i].Pull(data, bases[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func (p *Pipeline) push(data map[string]string) (map[string]string, error) {
+	if p == nil {
+		return maps.Clone(data), nil
+	}
+
+	var err error
+	for _, step := range p.steps {
+		data, err = step.Push(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func addedKeys(data map[string]string, pulled map[string]string) []string {
+	keys := []string{}
+	for key := range pulled {
+		if _, ok := data[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,133 @@
+package transform
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipelineRoundTrip(t *testing.T) {
+	tests := []struct {
+		spec   string
+		data   map[string]string
+		pushed map[string]string
+	}{
+		{
+			spec:   "",
+			data:   map[string]string{"FOO": "bar"},
+			pushed: map[string]string{"FOO": "bar"},
+		},
+		{
+			spec:   "case:dotted",
+			data:   map[string]string{"FEATURE_CHECKOUT_ENABLED": "true"},
+			pushed: map[string]string{"feature.checkout.enabled": "true"},
+		},
+		{
+			spec:   "case:kebab",
+			data:   map[string]string{"LOG_LEVEL": "debug"},
+			pushed: map[string]string{"log-level": "debug"},
+		},
+		{
+			spec:   "case:upper",
+			data:   map[string]string{"host": "localhost"},
+			pushed: map[string]string{"HOST": "localhost"},
+		},
+		{
+			spec:   "prefix:APP_; case:dotted",
+			data:   map[string]string{"APP_DB_HOST": "db", "APP_DB_PORT": "5432"},
+			pushed: map[string]string{"db.host": "db", "db.port": "5432"},
+		},
+		{
+			spec:   "rename:LEGACY_URL=service.url, DB=database",
+			data:   map[string]string{"LEGACY_URL": "http://svc", "DB": "db", "OTHER": "x"},
+			pushed: map[string]string{"service.url": "http://svc", "database": "db", "OTHER": "x"},
+		},
+		{
+			spec:   "base64:encode",
+			data:   map[string]string{"cert": "-----BEGIN-----"},
+			pushed: map[string]string{"cert": "LS0tLS1CRUdJTi0tLS0t"},
+		},
+		{
+			spec:   "base64:decode; case:lower",
+			data:   map[string]string{"TOKEN": "c2VjcmV0"},
+			pushed: map[string]string{"token": "secret"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			pipeline, err := Parse(test.spec)
+			require.NoError(t, err)
+
+			pushed, err := pipeline.Push(test.data)
+			require.NoError(t, err)
+			assert.Equal(t, test.pushed, pushed)
+
+			pulled, err := pipeline.Pull(pushed, nil)
+			require.NoError(t, err)
+			assert.Equal(t, test.data, pulled)
+		})
+	}
+}
+
+func TestPipelineTrimConverges(t *testing.T) {
+	pipeline, err := Parse("trim")
+	require.NoError(t, err)
+
+	pushed, err := pipeline.Push(map[string]string{"foo": " bar\n"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"foo": "bar"}, pushed)
+
+	pulled, err := pipeline.Pull(pushed, nil)
+	require.NoError(t, err)
+	repushed, err := pipeline.Push(pulled)
+	require.NoError(t, err)
+	assert.Equal(t, pushed, repushed)
+}
+
+func TestPipelineRejectsIrreversibleData(t *testing.T) {
+	pipeline, err := Parse("case:dotted")
+	require.NoError(t, err)
+	_, err = pipeline.Push(map[string]string{"Mixed_Case": "x"})
+	assert.Error(t, err)
+	_, err = pipeline.Push(map[string]string{"FOO": "x", "foo": "y"})
+	assert.Error(t, err)
+
+	pipeline, err = Parse("prefix:APP_")
+	require.NoError(t, err)
+	_, err = pipeline.Push(map[string]string{"OTHER": "x"})
+	assert.Error(t, err)
+
+	pipeline, err = Parse("base64:decode")
+	require.NoError(t, err)
+	_, err = pipeline.Push(map[string]string{"foo": "not base64!"})
+	assert.Error(t, err)
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{"unknown", "case:camel", "base64", "prefix", "rename:A", "rename:A=b,A=c", "rename:A=b,C=b", "trim:x"} {
+		_, err := Parse(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	Register("test-reverse", func(argument string) (Step, error) {
+		reverse := func(value string) (string, error) {
+			runes := []rune(value)
+			for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+				runes[i], runes[j] = runes[j], runes[i]
+			}
+			return string(runes), nil
+		}
+		return ValueStep(reverse, reverse), nil
+	})
+	assert.Panics(t, func() { Register("test-reverse", nil) })
+
+	pipeline, err := Parse("test-reverse")
+	require.NoError(t, err)
+	pushed, err := pipeline.Push(map[string]string{"foo": "abc"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"foo": "cba"}, pushed)
+}
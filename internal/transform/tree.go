@@ -0,0 +1,251 @@
+package transform
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Structured documents are handled as yaml.Node trees, which keep key order and comments.
+// Fields are the dotted paths of the scalars, sequence items are addressed by index.
+
+const pathSeparator = "."
+
+// flattenNode returns the scalar fields of the tree
+func flattenNode(node *yaml.Node) (map[string]string, error) {
+	fields := map[string]string{}
+	err := flattenInto(fields, "", node)
+	if err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+func flattenInto(fields map[string]string, path string, node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil
+		}
+		return flattenInto(fields, path, node.Content[0])
+	case yaml.AliasNode:
+		return flattenInto(fields, path, node.Alias)
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if key == "" || strings.Contains(key, pathSeparator) {
+				return fmt.Errorf("key %q can not be flattened", key)
+			}
+			err := flattenInto(fields, joinPath(path, key), node.Content[i+1])
+			if err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			err := flattenInto(fields, joinPath(path, strconv.Itoa(i)), item)
+			if err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if path == "" {
+			return fmt.Errorf("document is not a mapping or sequence")
+		}
+		fields[path] = node.Value
+	}
+	return nil
+}
+
+func joinPath(path string, segment string) string {
+	if path == "" {
+		return segment
+	}
+	return path + pathSeparator + segment
+}
+
+// rebuildNode updates the root container so that its scalars match the fields. Untouched nodes keep their
+// position and comments, new nodes are appended in path order. A nil root starts an empty mapping.
+func rebuildNode(root *yaml.Node, fields map[string]string) (*yaml.Node, error) {
+	paths := make([]string, 0, len(fields))
+	for path := range fields {
+		paths = append(paths, path)
+	}
+	slices.SortFunc(paths, comparePaths)
+
+	if root == nil || (root.Kind != yaml.MappingNode && root.Kind != yaml.SequenceNode) {
+		root = newContainer(len(paths) > 0 && isIndex(strings.Split(paths[0], pathSeparator)[0]))
+	}
+	expandAliases(root)
+
+	for _, path := range paths {
+		err := setPath(root, strings.Split(path, pathSeparator), fields[path])
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", path, err)
+		}
+	}
+	pruneNode(root, "", fields)
+	return root, nil
+}
+
+func setPath(node *yaml.Node, segments []string, value string) error {
+	segment := segments[0]
+	last := len(segments) == 1
+
+	var child **yaml.Node
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == segment {
+				child = &node.Content[i+1]
+				break
+			}
+		}
+		if child == nil {
+			key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: segment}
+			node.Content = append(node.Content, key, nil)
+			child = &node.Content[len(node.Content)-1]
+		}
+	case yaml.SequenceNode:
+		index, err := strconv.Atoi(segment)
+		if err != nil || index < 0 || index > len(node.Content) {
+			return fmt.Errorf("invalid sequence index %q", segment)
+		}
+		if index == len(node.Content) {
+			node.Content = append(node.Content, nil)
+		}
+		child = &node.Content[index]
+	}
+
+	if last {
+		setScalar(child, value)
+		return nil
+	}
+	sequence := isIndex(segments[1])
+	if *child == nil || !isContainer(*child, sequence) {
+		*child = newContainer(sequence)
+	}
+	return setPath(*child, segments[1:], value)
+}
+
+// setScalar keeps string scalars strings, other scalars get the type of the new value
+func setScalar(node **yaml.Node, value string) {
+	if *node != nil && (*node).Kind == yaml.ScalarNode {
+		if (*node).Value == value {
+			return
+		}
+		(*node).Value = value
+		if (*node).Tag != "!!str" {
+			(*node).Tag = resolveTag(value)
+			(*node).Style = 0
+		}
+		return
+	}
+	*node = &yaml.Node{Kind: yaml.ScalarNode, Tag: resolveTag(value), Value: value}
+}
+
+// pruneNode removes scalars without field and containers that became empty. It returns true if the node is removed.
+func pruneNode(node *yaml.Node, path string, fields map[string]string) bool {
+	switch node.Kind {
+	case yaml.MappingNode:
+		if len(node.Content) == 0 {
+			return false
+		}
+		content := node.Content[:0]
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if !pruneNode(node.Content[i+1], joinPath(path, node.Content[i].Value), fields) {
+				content = append(content, node.Content[i], node.Content[i+1])
+			}
+		}
+		node.Content = content
+		return len(content) == 0
+	case yaml.SequenceNode:
+		if len(node.Content) == 0 {
+			return false
+		}
+		content := node.Content[:0]
+		for i, item := range node.Content {
+			if !pruneNode(item, joinPath(path, strconv.Itoa(i)), fields) {
+				content = append(content, item)
+			}
+		}
+		node.Content = content
+		return len(content) == 0
+	case yaml.ScalarNode:
+		_, ok := fields[path]
+		return !ok
+	}
+	return true
+}
+
+// expandAliases replaces aliases with copies of their anchored nodes so that fields can be changed independently
+func expandAliases(node *yaml.Node) {
+	for i, child := range node.Content {
+		if child.Kind == yaml.AliasNode && child.Alias != nil {
+			node.Content[i] = copyNode(child.Alias)
+		}
+		expandAliases(node.Content[i])
+	}
+}
+
+func copyNode(node *yaml.Node) *yaml.Node {
+	copied := *node
+	copied.Anchor = ""
+	copied.Content = make([]*yaml.Node, len(node.Content))
+	for i, child := range node.Content {
+		copied.Content[i] = copyNode(child)
+	}
+	return &copied
+}
+
+func newContainer(sequence bool) *yaml.Node {
+	if sequence {
+		return &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	}
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+}
+
+func isContainer(node *yaml.Node, sequence bool) bool {
+	if sequence {
+		return node.Kind == yaml.SequenceNode
+	}
+	return node.Kind == yaml.MappingNode
+}
+
+func isIndex(segment string) bool {
+	index, err := strconv.Atoi(segment)
+	return err == nil && index >= 0 && strconv.Itoa(index) == segment
+}
+
+// comparePaths orders paths segment by segment, indices numerically
+func comparePaths(a string, b string) int {
+	aSegments, bSegments := strings.Split(a, pathSeparator), strings.Split(b, pathSeparator)
+	for i := 0; i < len(aSegments) && i < len(bSegments); i++ {
+		if aSegments[i] == bSegments[i] {
+			continue
+		}
+		if isIndex(aSegments[i]) && isIndex(bSegments[i]) {
+			aIndex, _ := strconv.Atoi(aSegments[i])
+			bIndex, _ := strconv.Atoi(bSegments[i])
+			return aIndex - bIndex
+		}
+		return strings.Compare(aSegments[i], bSegments[i])
+	}
+	return len(aSegments) - len(bSegments)
+}
+
+// resolveTag returns the tag a plain yaml scalar with the value would get. Empty values are strings.
+func resolveTag(value string) string {
+	if value == "" || strings.ContainsAny(value, "\n#") {
+		return "!!str"
+	}
+	node := &yaml.Node{}
+	err := yaml.Unmarshal([]byte(value), node)
+	if err != nil || len(node.Content) == 0 || node.Content[0].Kind != yaml.ScalarNode || node.Content[0].Value != value {
+		return "!!str"
+	}
+	return node.Content[0].Tag
+}
@@ -1,19 +1,187 @@
 package util
 
-import "github.com/mxcd/go-config/config"
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mxcd/go-config/config"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/mxcd/configmap-controller/internal/backend"
+)
+
+// durationKeys lists all config values that are parsed as durations (e.g. "5s", "1m30s")
+var durationKeys = []string{
+	"HEALTH_REDIS_TIMEOUT",
+	"HEALTH_ETCD_TIMEOUT",
+	"HEALTH_POSTGRES_TIMEOUT",
+	"ETCD_DIAL_TIMEOUT",
+	"HTTP_TIMEOUT",
+	"HEALTH_CACHE_SYNC_TIMEOUT",
+	"HEALTH_SYNC_STALL_THRESHOLD",
+	"SHARDING_HEARTBEAT_INTERVAL",
+	"SHARDING_MEMBER_TTL",
+	"SHUTDOWN_GRACE_PERIOD",
+	"GC_INTERVAL",
+	"GC_GRACE_PERIOD",
+}
+
+// keyPolicyKeys lists all config values that are parsed as key policies (keep, delete or expire:<duration>)
+var keyPolicyKeys = []string{
+	"RELEASE_POLICY",
+	"DELETION_POLICY",
+	"GC_POLICY",
+}
 
 func InitConfig() error {
 	err := config.LoadConfigWithOptions([]config.Value{
 		config.String("LOG_LEVEL").NotEmpty().Default("info"),
 		config.Bool("DEV").Default(false),
 
+		// stores the ConfigMap data: redis, etcd, postgres, file or http
+		config.String("STORAGE_BACKEND").NotEmpty().Default("redis"),
+
 		config.String("REDIS_HOST").NotEmpty().Default("localhost"),
 		config.Int("REDIS_PORT").Default(6379),
 		config.String("REDIS_PASSWORD").Sensitive().Default(""),
 		config.Int("REDIS_DATABASE_INDEX").Default(0),
 		config.Bool("REDIS_SENTINEL").Default(false),
+		config.String("REDIS_KEY_PREFIX").Default(""),
+		// text/template with the fields Cluster, Namespace and Name
+		config.String("REDIS_KEY_TEMPLATE").NotEmpty().Default("{{.Namespace}}/{{.Name}}"),
+		// template of cluster scoped keys
+		config.String("REDIS_CLUSTER_KEY_TEMPLATE").NotEmpty().Default("{{.Cluster}}/{{.Namespace}}/{{.Name}}"),
+		// shared or cluster, default scope of the templated keys
+		config.String("KEY_SCOPE").NotEmpty().Default("shared"),
+		// hash, json or redisjson
+		config.String("REDIS_STORAGE_LAYOUT").NotEmpty().Default("hash"),
+
+		// comma separated client urls
+		config.String("ETCD_ENDPOINTS").Default("http://localhost:2379"),
+		config.String("ETCD_USERNAME").Default(""),
+		config.String("ETCD_PASSWORD").Sensitive().Default(""),
+		config.String("ETCD_DIAL_TIMEOUT").NotEmpty().Default("5s"),
+		// prepended to every etcd key, the redis key prefix and template apply as well
+		config.String("ETCD_KEY_PREFIX").Default("/config/"),
+		// fields or json
+		config.String("ETCD_STORAGE_LAYOUT").NotEmpty().Default("fields"),
+
+		config.String("POSTGRES_URL").Sensitive().Default("postgres://localhost:5432/postgres"),
+		// the metadata of the controller is kept in <table>_meta
+		config.String("POSTGRES_TABLE").NotEmpty().Default("configmap_data"),
+		// watch keys with LISTEN/NOTIFY, disable behind poolers without LISTEN support to poll instead
+		config.Bool("POSTGRES_LISTEN").Default(true),
+		// create the tables and triggers on startup
+		config.Bool("POSTGRES_CREATE_SCHEMA").Default(true),
+
+		// every key is stored as a file below the directory, e.g. a mounted volume or a git checkout
+		config.String("FILE_DIRECTORY").NotEmpty().Default("config"),
+		// yaml or env
+		config.String("FILE_FORMAT").NotEmpty().Default("yaml"),
+
+		// required for STORAGE_BACKEND http, e.g. https://config.example.com/api
+		config.String("HTTP_BASE_URL").Default(""),
+		// sent with every request as "Name: value", e.g. "Authorization: Bearer <token>"
+		config.String("HTTP_AUTH_HEADER").Sensitive().Default(""),
+		// {key} is replaced by the escaped key
+		config.String("HTTP_DATA_PATH").NotEmpty().Default("/configmaps/{key}"),
+		config.String("HTTP_LIST_PATH").NotEmpty().Default("/configmaps"),
+		// optional, keys are polled without a changes path
+		config.String("HTTP_CHANGES_PATH").Default(""),
+		// longpoll or sse
+		config.String("HTTP_CHANGES_MODE").NotEmpty().Default("longpoll"),
+		config.String("HTTP_TIMEOUT").NotEmpty().Default("10s"),
+
+		config.String("CLUSTER_NAME").Default(""),
+		// several clusters synchronize through the shared keys, requires CLUSTER_NAME
+		config.Bool("MULTI_CLUSTER_ENABLED").Default(false),
+
+		config.String("HEALTH_REDIS_TIMEOUT").NotEmpty().Default("2s"),
+		config.String("HEALTH_ETCD_TIMEOUT").NotEmpty().Default("2s"),
+		config.String("HEALTH_POSTGRES_TIMEOUT").NotEmpty().Default("2s"),
+		config.String("HEALTH_CACHE_SYNC_TIMEOUT").NotEmpty().Default("2s"),
+		config.String("HEALTH_SYNC_STALL_THRESHOLD").NotEmpty().Default("1m"),
+
+		config.Bool("SHARDING_ENABLED").Default(false),
+		config.String("SHARDING_REPLICA_ID").Default(""),
+		config.String("SHARDING_HEARTBEAT_INTERVAL").NotEmpty().Default("5s"),
+		config.String("SHARDING_MEMBER_TTL").NotEmpty().Default("15s"),
+
+		config.String("SHUTDOWN_GRACE_PERIOD").NotEmpty().Default("10s"),
+
+		// what happens to the redis key when the managed annotation is removed: keep, delete or expire:<duration>
+		config.String("RELEASE_POLICY").NotEmpty().Default("keep"),
+		// default for deleted ConfigMaps without deletion-policy annotation: keep, delete or expire:<duration>
+		config.String("DELETION_POLICY").NotEmpty().Default("keep"),
+
+		config.Int("REPOSITORY_QUEUE_SIZE").Default(1000),
+
+		config.Bool("GC_ENABLED").Default(false),
+		config.String("GC_INTERVAL").NotEmpty().Default("10m"),
+		config.String("GC_GRACE_PERIOD").NotEmpty().Default("1h"),
+		// applied to orphaned redis keys: keep (report only), delete or expire:<duration>. Only keep is
+		// allowed without REDIS_KEY_PREFIX.
+		config.String("GC_POLICY").NotEmpty().Default("keep"),
+		config.Bool("GC_DRY_RUN").Default(false),
+
+		// optional, restricts the informer cache to ConfigMaps matching the selector
+		config.String("MANAGED_LABEL_SELECTOR").Default(""),
 	}, &config.LoadConfigOptions{
 		DotEnvFile: "controller.env",
 	})
-	return err
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keyPolicyKeys {
+		_, err := backend.ParseKeyPolicy(config.Get().String(key))
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+
+	gcPolicy, _ := backend.ParseKeyPolicy(config.Get().String("GC_POLICY"))
+	if config.Get().Bool("GC_ENABLED") && gcPolicy.Action != backend.KeyPolicyKeep && config.Get().String("REDIS_KEY_PREFIX") == "" {
+		return fmt.Errorf("GC_POLICY %s requires REDIS_KEY_PREFIX, keys without prefix can not be told apart from keys of other applications", gcPolicy)
+	}
+
+	storageBackend := config.Get().String("STORAGE_BACKEND")
+	if !slices.Contains([]string{"redis", "etcd", "postgres", "file", "http"}, storageBackend) {
+		return fmt.Errorf("invalid STORAGE_BACKEND %q, expected redis, etcd, postgres, file or http", storageBackend)
+	}
+	if storageBackend == "http" && config.Get().String("HTTP_BASE_URL") == "" {
+		return fmt.Errorf("HTTP_BASE_URL is required for STORAGE_BACKEND http")
+	}
+	if authHeader := config.Get().String("HTTP_AUTH_HEADER"); authHeader != "" && !strings.Contains(authHeader, ":") {
+		return fmt.Errorf("invalid HTTP_AUTH_HEADER, expected \"Name: value\"")
+	}
+
+	keyScope := config.Get().String("KEY_SCOPE")
+	if keyScope != "shared" && keyScope != "cluster" {
+		return fmt.Errorf("invalid KEY_SCOPE %q, expected shared or cluster", keyScope)
+	}
+	if config.Get().String("CLUSTER_NAME") == "" && (keyScope == "cluster" || config.Get().Bool("MULTI_CLUSTER_ENABLED")) {
+		return fmt.Errorf("CLUSTER_NAME is required for cluster scoped keys and MULTI_CLUSTER_ENABLED")
+	}
+
+	_, err = labels.Parse(config.Get().String("MANAGED_LABEL_SELECTOR"))
+	if err != nil {
+		return fmt.Errorf("invalid label selector for MANAGED_LABEL_SELECTOR: %w", err)
+	}
+
+	for _, key := range durationKeys {
+		_, err := time.ParseDuration(config.Get().String(key))
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// GetDuration returns a duration config value. The value is validated by InitConfig.
+func GetDuration(key string) time.Duration {
+	duration, _ := time.ParseDuration(config.Get().String(key))
+	return duration
 }